@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	. "./lib"
+)
+
+// Distributed rendering: a coordinator splits every pass of the image into
+// tiles and hands them out over HTTP to workers running the same scene. Workers
+// send back the tile's buffer, grown by the filter radius, and the coordinator
+// merges it into the image. Task and Tile bodies are gob encoded.
+//
+//	GET  /task?scene=<hash>&worker=<id>  next Task, 204 once all tasks are done
+//	POST /result?scene=<hash>            a Tile
+
+var flagCoordinator = flag.String("coordinator", "", "listen on address and hand out render tasks to workers")
+var flagWorker = flag.String("worker", "", "render tasks from the coordinator at address")
+var flagPasses = flag.Int("passes", 1, "number of passes the coordinator renders")
+var flagTileSize = flag.Int("tile", 64, "tile size in pixels for distributed rendering")
+var flagTaskTimeout = flag.Duration("task-timeout", 10*time.Minute, "time after which a task is handed to another worker")
+
+// drainTimeout is how long the coordinator waits for workers to find out that
+// all tasks are done before it shuts down.
+const drainTimeout = 10 * time.Second
+
+var errNoTasks = errors.New("no tasks left")
+var errBusy = errors.New("all remaining tasks are in flight")
+
+type Task struct {
+	ID                   int
+	Region               image.Rectangle
+	Seed                 int64
+	SPP                  int
+	MaxDepth             int
+	ShadowRays           int
+	MaxSpecularDepth     int
+	MaxTransmissionDepth int
+	Filter               string
+	Integrator           string
+	Features             bool
+}
+
+type Tile struct {
+	ID       int
+	Offset   image.Point
+	W, H     int
+	Pixels   []Pixel
+	Features []Feature
+}
+
+type coordinator struct {
+	sceneHash uint64
+	buf       *Buffer
+
+	mu       sync.Mutex
+	pending  []Task
+	inFlight map[int]time.Time
+	tasks    map[int]Task
+	left     int
+	done     chan struct{}
+	// workers that asked for tasks and haven't been told that none are left
+	workers map[string]bool
+	idle    chan struct{}
+}
+
+func runCoordinator(addr string, buf *Buffer, sceneHash uint64) {
+	if wholeImageIntegrators[*flagIntegrator] {
+		fmt.Println("The", *flagIntegrator, "integrator cannot be split into tiles")
+		os.Exit(2)
+	}
+	c := newCoordinator(buf, sceneHash, *flagPasses, *flagTileSize)
+	srv := &http.Server{Addr: addr, Handler: c.handler()}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}()
+	fmt.Println("Coordinating", c.left, "tasks on", addr)
+
+	t := time.Now()
+	<-c.done
+	fmt.Println("Total time:", time.Now().Sub(t))
+	// let the workers find out that we are done, then finish the replies
+	// still being sent
+	select {
+	case <-c.idle:
+	case <-time.After(drainTimeout):
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	srv.Shutdown(ctx)
+	cancel()
+
+	saveCheckpoint(buf, sceneHash)
+	out := buf
+	if *flagDenoise {
+		out = buf.Denoise(DefaultDenoiseOptions)
+	}
+	if err := WritePng(OutputFile, out.Image(ColorChannel)); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// newCoordinator splits the given number of passes into tiles of size pixels.
+func newCoordinator(buf *Buffer, sceneHash uint64, passes, size int) *coordinator {
+	c := &coordinator{
+		sceneHash: sceneHash,
+		buf:       buf,
+		inFlight:  make(map[int]time.Time),
+		tasks:     make(map[int]Task),
+		done:      make(chan struct{}),
+		workers:   make(map[string]bool),
+		idle:      make(chan struct{}),
+	}
+	renderMu.Lock()
+	for i := 0; i < passes; i++ {
+		pass := Passes
+		Passes++
+		for y := 0; y < Height; y += size {
+			for x := 0; x < Width; x += size {
+				id := len(c.tasks)
+				task := Task{
+					ID:                   id,
+					Region:               image.Rect(x, y, x+size, y+size).Intersect(image.Rect(0, 0, Width, Height)),
+					Seed:                 Seed + int64(pass)<<20 + int64(id)<<8,
+					SPP:                  SPP,
+					MaxDepth:             MaxDepth,
+					ShadowRays:           ShadowRays,
+					MaxSpecularDepth:     *flagMaxSpecularDepth,
+					MaxTransmissionDepth: *flagMaxTransmissionDepth,
+					Filter:               *flagFilter,
+					Integrator:           *flagIntegrator,
+					Features:             *flagDenoise,
+				}
+				c.tasks[id] = task
+				c.pending = append(c.pending, task)
+			}
+		}
+	}
+	renderMu.Unlock()
+	c.left = len(c.tasks)
+	return c
+}
+
+func (c *coordinator) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/task", c.handleTask)
+	mux.HandleFunc("/result", c.handleResult)
+	return mux
+}
+
+func (c *coordinator) checkScene(w http.ResponseWriter, r *http.Request) bool {
+	hash, err := strconv.ParseUint(r.URL.Query().Get("scene"), 10, 64)
+	if err != nil || hash != c.sceneHash {
+		http.Error(w, "scene does not match the coordinator's", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+func (c *coordinator) handleTask(w http.ResponseWriter, r *http.Request) {
+	if !c.checkScene(w, r) {
+		return
+	}
+	worker := r.URL.Query().Get("worker")
+	c.mu.Lock()
+	// hand tasks of workers that went away to someone else
+	for id, deadline := range c.inFlight {
+		if time.Now().After(deadline) {
+			delete(c.inFlight, id)
+			c.pending = append(c.pending, c.tasks[id])
+		}
+	}
+	if len(c.pending) == 0 {
+		left := c.left
+		if left == 0 {
+			delete(c.workers, worker)
+			c.checkIdle()
+		} else {
+			c.workers[worker] = true
+		}
+		c.mu.Unlock()
+		if left == 0 {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		return
+	}
+	task := c.pending[0]
+	c.pending = c.pending[1:]
+	c.inFlight[task.ID] = time.Now().Add(*flagTaskTimeout)
+	c.workers[worker] = true
+	c.mu.Unlock()
+
+	gob.NewEncoder(w).Encode(task)
+}
+
+func (c *coordinator) handleResult(w http.ResponseWriter, r *http.Request) {
+	if !c.checkScene(w, r) {
+		return
+	}
+	var tile Tile
+	if err := gob.NewDecoder(r.Body).Decode(&tile); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !c.checkTile(&tile) {
+		http.Error(w, "malformed tile", http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	_, ok := c.inFlight[tile.ID]
+	if ok {
+		delete(c.inFlight, tile.ID)
+	} else {
+		// the task may have timed out and been handed out again, count
+		// whichever copy arrives first
+		for i, task := range c.pending {
+			if task.ID == tile.ID {
+				c.pending = append(c.pending[:i], c.pending[i+1:]...)
+				ok = true
+				break
+			}
+		}
+	}
+	if !ok {
+		c.mu.Unlock()
+		return
+	}
+	c.left--
+	left := c.left
+	c.checkIdle()
+	c.mu.Unlock()
+
+	tb := NewBuffer(tile.W, tile.H)
+	copy(tb.Pixels, tile.Pixels)
+	copy(tb.Features, tile.Features)
+	// checkpoints only see whole tiles
+	renderMu.Lock()
+	c.buf.MergeAt(tile.Offset.X, tile.Offset.Y, tb)
+	renderMu.Unlock()
+
+	fmt.Println("Finished task", tile.ID, ",", left, "left")
+	if left == 0 {
+		close(c.done)
+	}
+}
+
+// checkTile tells whether the tile is the region of its task grown by the
+// margin the worker renders for the filter, so that it can't write over other
+// parts of the image.
+func (c *coordinator) checkTile(tile *Tile) bool {
+	task, ok := c.tasks[tile.ID]
+	if !ok {
+		return false
+	}
+	filter, ok := FilterByName(task.Filter)
+	if !ok || tile.W < 0 || tile.H < 0 {
+		return false
+	}
+	bounds := tileBounds(task.Region, filter)
+	if (image.Rectangle{tile.Offset, tile.Offset.Add(image.Pt(tile.W, tile.H))}) != bounds {
+		return false
+	}
+	return len(tile.Pixels) == tile.W*tile.H && len(tile.Features) == tile.W*tile.H
+}
+
+// checkIdle closes idle once all tasks are done and every worker has been told
+// so. The caller holds c.mu.
+func (c *coordinator) checkIdle() {
+	if c.left == 0 && len(c.workers) == 0 {
+		select {
+		case <-c.idle:
+		default:
+			close(c.idle)
+		}
+	}
+}
+
+// tileBounds grows region by the filter radius, since samples splat that far
+// outside it.
+func tileBounds(region image.Rectangle, filter Filter) image.Rectangle {
+	margin := int(math.Ceil(filter.Radius()))
+	return region.Inset(-margin).Intersect(image.Rect(0, 0, Width, Height))
+}
+
+func runWorker(addr string, scene *Scene, cam *Camera, sceneHash uint64) {
+	client := &http.Client{}
+	host, _ := os.Hostname()
+	id := fmt.Sprintf("%s-%d", host, os.Getpid())
+	failures := 0
+	for {
+		task, err := fetchTask(client, addr, sceneHash, id)
+		if err == errNoTasks {
+			fmt.Println("No tasks left")
+			return
+		}
+		if err == errBusy {
+			time.Sleep(time.Second)
+			continue
+		}
+		if err != nil {
+			failures++
+			if failures > 10 {
+				fmt.Println("Giving up:", err)
+				os.Exit(1)
+			}
+			time.Sleep(time.Second)
+			continue
+		}
+		failures = 0
+
+		t := time.Now()
+		tile, err := renderTask(scene, cam, task)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("Rendered task", task.ID, "in", time.Now().Sub(t))
+
+		for attempt := 0; ; attempt++ {
+			err := postTile(client, addr, sceneHash, tile)
+			if err == nil {
+				break
+			}
+			if attempt == 10 {
+				fmt.Println("Giving up:", err)
+				os.Exit(1)
+			}
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// renderTask renders the region of the task with its settings.
+func renderTask(scene *Scene, cam *Camera, task Task) (*Tile, error) {
+	SPP = task.SPP
+	MaxDepth = task.MaxDepth
+	ShadowRays = task.ShadowRays
+	*flagMaxSpecularDepth = task.MaxSpecularDepth
+	*flagMaxTransmissionDepth = task.MaxTransmissionDepth
+	*flagDenoise = task.Features
+	*flagIntegrator = task.Integrator
+	if _, ok := IntegratorByName(task.Integrator, scene, integratorOptions()); !ok {
+		return nil, fmt.Errorf("unknown integrator: %s", task.Integrator)
+	}
+	filter, ok := FilterByName(task.Filter)
+	if !ok {
+		return nil, fmt.Errorf("unknown filter: %s", task.Filter)
+	}
+
+	bounds := tileBounds(task.Region, filter)
+	buf := NewBuffer(bounds.Dx(), bounds.Dy())
+	buf.Filter = filter
+	renderRegion(scene, cam, buf, task.Region, bounds.Min, task.Seed, false)
+	return &Tile{ID: task.ID, Offset: bounds.Min, W: buf.W, H: buf.H, Pixels: buf.Pixels, Features: buf.Features}, nil
+}
+
+func fetchTask(client *http.Client, addr string, sceneHash uint64, worker string) (Task, error) {
+	var task Task
+	resp, err := client.Get(fmt.Sprintf("http://%s/task?scene=%d&worker=%s", addr, sceneHash, url.QueryEscape(worker)))
+	if err != nil {
+		return task, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = gob.NewDecoder(resp.Body).Decode(&task)
+	case http.StatusNoContent:
+		err = errNoTasks
+	case http.StatusServiceUnavailable:
+		err = errBusy
+	case http.StatusConflict:
+		fmt.Println("Coordinator is rendering a different scene")
+		os.Exit(1)
+	default:
+		err = fmt.Errorf("coordinator replied %s", resp.Status)
+	}
+	return task, err
+}
+
+func postTile(client *http.Client, addr string, sceneHash uint64, tile *Tile) error {
+	body, w := io.Pipe()
+	go func() {
+		w.CloseWithError(gob.NewEncoder(w).Encode(tile))
+	}()
+	resp, err := client.Post(fmt.Sprintf("http://%s/result?scene=%d", addr, sceneHash), "application/octet-stream", body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("coordinator replied %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"image"
+	"math"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	. "./lib"
+)
+
+// workerEnv tells the test binary to run as a worker of the coordinator at
+// the given address instead of running the tests.
+const workerEnv = "PATHTRACER_TEST_WORKER"
+
+func TestMain(m *testing.M) {
+	if addr := os.Getenv(workerEnv); addr != "" {
+		scene, cam := testScene()
+		runWorker(addr, scene, cam, scene.Hash(cam))
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// testScene is the default scene without the teapot, which renders quickly.
+func testScene() (*Scene, *Camera) {
+	scene := &Scene{}
+	scene.AddAll([]Hittable{
+		&Quad{Corner: Vector{0, 0, 0}, U: Vector{0, 0, 5}, V: Vector{5, 0, 0}, Mat: Lambertian(RGB{.5, .5, .5})},
+		&Sphere{Center: Vector{2.25, 3, 2.25}, Radius: 1, Mat: Emissive(RGB{1, 1, 1}, 6)},
+		&Sphere{Center: Vector{1.25, .5, 3}, Radius: .5, Mat: Lambertian(RGB{.8, .1, .1})},
+	})
+	return scene, NewCamera(CamPosition, CamDirection, Fov, Width/Height, ApertureDiameter)
+}
+
+func TestDistributedRender(t *testing.T) {
+	SPP, MaxDepth, ShadowRays, Seed, Passes = 1, 2, 1, 1, 0
+	*flagFilter = "gaussian"
+	scene, cam := testScene()
+	buf := NewBuffer(Width, Height)
+	buf.Filter, _ = FilterByName(*flagFilter)
+	c := newCoordinator(buf, scene.Hash(cam), 2, 128)
+	srv := httptest.NewServer(c.handler())
+	defer srv.Close()
+
+	var workers []*exec.Cmd
+	for i := 0; i < 3; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^$")
+		cmd.Env = append(os.Environ(), workerEnv+"="+strings.TrimPrefix(srv.URL, "http://"))
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		workers = append(workers, cmd)
+	}
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Minute):
+		t.Fatal("the workers did not finish")
+	}
+	for _, cmd := range workers {
+		if err := cmd.Wait(); err != nil {
+			t.Error("worker:", err)
+		}
+	}
+	select {
+	case <-c.idle:
+	default:
+		t.Error("workers exited without being told that no tasks are left")
+	}
+
+	// render the same tasks here, in any order, to compare
+	want := NewBuffer(Width, Height)
+	for id := len(c.tasks) - 1; id >= 0; id-- {
+		tile, err := renderTask(scene, cam, c.tasks[id])
+		if err != nil {
+			t.Fatal(err)
+		}
+		tb := NewBuffer(tile.W, tile.H)
+		copy(tb.Pixels, tile.Pixels)
+		want.MergeAt(tile.Offset.X, tile.Offset.Y, tb)
+	}
+	for y := 0; y < Height; y++ {
+		for x := 0; x < Width; x++ {
+			if buf.Samples(x, y) != want.Samples(x, y) {
+				t.Fatalf("pixel %d,%d has %d samples, want %d", x, y, buf.Samples(x, y), want.Samples(x, y))
+			}
+			got, exp := buf.Color(x, y), want.Color(x, y)
+			if math.Abs(got.R-exp.R) > 1e-9*(1+exp.R) || math.Abs(got.G-exp.G) > 1e-9*(1+exp.G) || math.Abs(got.B-exp.B) > 1e-9*(1+exp.B) {
+				t.Fatalf("pixel %d,%d is %v, want %v", x, y, got, exp)
+			}
+		}
+	}
+}
+
+func TestCheckTile(t *testing.T) {
+	*flagFilter = "gaussian"
+	filter, _ := FilterByName(*flagFilter)
+	c := newCoordinator(NewBuffer(Width, Height), 0, 1, 128)
+	task := c.tasks[7]
+	bounds := tileBounds(task.Region, filter)
+	tile := func(id int, r image.Rectangle) *Tile {
+		n := r.Dx() * r.Dy()
+		return &Tile{ID: id, Offset: r.Min, W: r.Dx(), H: r.Dy(), Pixels: make([]Pixel, n), Features: make([]Feature, n)}
+	}
+	tests := []struct {
+		name string
+		tile *Tile
+		ok   bool
+	}{
+		{"task bounds", tile(7, bounds), true},
+		{"unknown task", tile(len(c.tasks), bounds), false},
+		{"other task", tile(8, bounds), false},
+		{"moved", tile(7, bounds.Add(image.Pt(1, 0))), false},
+		{"larger", tile(7, bounds.Inset(-1)), false},
+		{"region only", tile(7, task.Region), false},
+	}
+	for _, test := range tests {
+		if ok := c.checkTile(test.tile); ok != test.ok {
+			t.Errorf("%s: checkTile = %v", test.name, ok)
+		}
+	}
+	short := tile(7, bounds)
+	short.Pixels = short.Pixels[1:]
+	if c.checkTile(short) {
+		t.Error("accepted a tile with missing pixels")
+	}
+}
@@ -3,10 +3,12 @@ package main
 import (
 	"flag"
 	"fmt"
+	"image"
 	"math"
 	"math/rand"
 	"os"
 	"runtime"
+	"sync"
 	"time"
 
 	"github.com/lxn/walk"
@@ -41,15 +43,46 @@ const AdaptiveExponent = 3
 
 var NumCPU = runtime.NumCPU()
 
+var Seed int64
+var Passes int // render passes started, seeds the samplers of the next pass
+
+// renderMu is held while a pass renders, so that checkpoints only ever see
+// whole passes.
+var renderMu sync.Mutex
+
 var random = rand.New(rand.NewSource(0))
 
 var flagCpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
+var flagFilter = flag.String("filter", "box", "pixel reconstruction filter: box, gaussian, mitchell or blackman-harris")
+var flagDenoise = flag.Bool("denoise", false, "denoise the image using albedo and normal feature buffers")
+var flagSeed = flag.Int64("seed", 0, "random seed, 0 picks one from the clock")
+var flagCheckpoint = flag.String("checkpoint", "", "periodically save the render state to file")
+var flagCheckpointInterval = flag.Duration("checkpoint-interval", 5*time.Minute, "time between checkpoints")
+var flagResume = flag.String("resume", "", "resume rendering from a checkpoint file")
+var flagEnvMap = flag.String("envmap", "", "light the scene with an equirectangular .hdr environment map")
+var flagEnvRotation = flag.Float64("env-rotation", 0, "rotation of the environment map around the vertical axis in degrees")
+var flagEnvIntensity = flag.Float64("env-intensity", 1, "environment map brightness multiplier")
+var flagSky = flag.Bool("sky", false, "light the scene with an analytic sky and sun")
+var flagSunElevation = flag.Float64("sun-elevation", 45, "elevation of the sun above the horizon in degrees")
+var flagSunAzimuth = flag.Float64("sun-azimuth", 0, "azimuth of the sun in degrees")
+var flagTurbidity = flag.Float64("turbidity", 3, "atmospheric turbidity of the sky, 2 is clear and 10 hazy")
+var flagSkyIntensity = flag.Float64("sky-intensity", .05, "sky and sun brightness multiplier")
+var flagLightSampler = flag.String("light-sampler", DefaultLightSampling, "how shadow rays choose a light: uniform, power or bvh")
+var flagMaxSpecularDepth = flag.Int("max-specular-depth", 10, "mirror and glossy reflections a path may take")
+var flagMaxTransmissionDepth = flag.Int("max-transmission-depth", 10, "refractions a path may take")
+var flagGLTF = flag.String("gltf", "", "render the scene of a .gltf or .glb file, seen from its first camera")
+var flagMeshCache = flag.Bool("mesh-cache", true, "keep loaded meshes in cache files next to them for faster loading")
+var flagIntegrator = flag.String("integrator", "path", "light transport algorithm: path, spectral, bdpt, mlt or sppm, or ao, normals, depth, primitives, kd-cost or wireframe for debugging")
 
 var mw = new(MyMainWindow)
 var imageView *walk.ImageView
 
 func main() {
 	flag.Parse()
+	if flag.Arg(0) == "merge" {
+		runMerge(flag.Args()[1:])
+		return
+	}
 	if *flagCpuprofile != "" {
 		f, err := os.Create(*flagCpuprofile)
 		if err != nil {
@@ -59,9 +92,71 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
+	scene, cam := loadScene()
+	if !scene.SetLightSampling(*flagLightSampler) {
+		fmt.Println("Unknown light sampler:", *flagLightSampler)
+		os.Exit(2)
+	}
+	if *flagEnvMap != "" {
+		env, err := LoadEnvironmentLight(*flagEnvMap, *flagEnvRotation*math.Pi/180, *flagEnvIntensity)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		scene.Background = env
+	} else if *flagSky {
+		scene.Background = NewSky(*flagSunElevation*math.Pi/180, *flagSunAzimuth*math.Pi/180, *flagTurbidity, *flagSkyIntensity)
+	}
+	if _, ok := IntegratorByName(*flagIntegrator, scene, integratorOptions()); !ok && !wholeImageIntegrators[*flagIntegrator] {
+		fmt.Println("Unknown integrator:", *flagIntegrator)
+		os.Exit(2)
+	}
+	sceneHash := scene.Hash(cam)
+	filter, ok := FilterByName(*flagFilter)
+	if !ok {
+		fmt.Println("Unknown filter:", *flagFilter)
+		os.Exit(2)
+	}
+
 	buf := NewBuffer(Width, Height)
-	scene := setUpScene()
-	cam := NewCamera(CamPosition, CamDirection, Fov, Width/Height, ApertureDiameter)
+	Seed = *flagSeed
+	if Seed == 0 {
+		Seed = time.Now().UnixNano()
+	}
+	if *flagResume != "" {
+		c, err := LoadCheckpoint(*flagResume)
+		if err == nil {
+			err = c.Check(CheckpointHash(sceneHash, filter, *flagIntegrator, integratorOptions()), Width, Height)
+		}
+		if err != nil {
+			fmt.Println("Cannot resume:", err)
+			os.Exit(1)
+		}
+		buf = c.Buffer()
+		Seed = c.Seed
+		Passes = c.Passes
+		if *flagCheckpoint == "" {
+			*flagCheckpoint = *flagResume
+		}
+		fmt.Println("Resuming after", Passes, "passes")
+	}
+	buf.Filter = filter
+	if *flagWorker != "" {
+		runWorker(*flagWorker, scene, cam, sceneHash)
+		return
+	}
+	if *flagCheckpoint != "" {
+		go func() {
+			for range time.Tick(*flagCheckpointInterval) {
+				saveCheckpoint(buf, sceneHash)
+			}
+		}()
+	}
+
+	if *flagCoordinator != "" {
+		runCoordinator(*flagCoordinator, buf, sceneHash)
+		return
+	}
 
 	var sppField, shadowRayField, rayBounceDepthField *walk.NumberEdit
 	win := MainWindow{
@@ -137,10 +232,15 @@ func main() {
 					go func() {
 						t := time.Now()
 						render(scene, cam, buf)
+						saveCheckpoint(buf, sceneHash)
 						TotalTime = TotalTime.Add(time.Now().Sub(t))
 						fmt.Println("Total time: " + TotalTime.Format("15:04:05.0000"))
-						WritePng(OutputFile, buf.Image(ColorChannel))
-						img, _ := walk.NewBitmapFromImage(buf.Image(ColorChannel))
+						out := buf
+						if *flagDenoise {
+							out = buf.Denoise(DefaultDenoiseOptions)
+						}
+						WritePng(OutputFile, out.Image(ColorChannel))
+						img, _ := walk.NewBitmapFromImage(out.Image(ColorChannel))
 						imageView.SetImage(img)
 					}()
 				},
@@ -153,6 +253,29 @@ func main() {
 	}
 
 }
+
+// loadScene sets up the built-in scene, or the one of the -gltf file.
+func loadScene() (*Scene, *Camera) {
+	cam := NewCamera(CamPosition, CamDirection, Fov, Width/Height, ApertureDiameter)
+	if *flagGLTF == "" {
+		return setUpScene(), cam
+	}
+	g, err := LoadGLTF(*flagGLTF)
+	if err == nil && g.Mesh == nil {
+		err = fmt.Errorf("%s: no meshes", *flagGLTF)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	scene := &Scene{}
+	g.AddTo(scene)
+	if len(g.Cameras) > 0 {
+		cam = g.Cameras[0].Camera(float64(Width) / Height)
+	}
+	return scene, cam
+}
+
 func setUpScene() *Scene {
 	scene := &Scene{}
 	//mat := Metal(RGB{0.9, 1.0, 0.9}, math.Pi/8)
@@ -172,21 +295,20 @@ func setUpScene() *Scene {
 	//			case 2:
 	//				mat = Metal(RGB{random.Float64(), random.Float64(), random.Float64()}, random.Float64(), 0.85)
 	//			case 3, 4:
-	//				mat = Light(RGB{random.Float64(), 1, random.Float64()}, 1)
+	//				mat = Emissive(RGB{random.Float64(), 1, random.Float64()}, 1)
 	//			}
 	//			objects = append(objects, &Sphere{Radius: random.Float64() * .5, Center: Vector{float64(i), 0, float64(j)}, Mat: mat})
 	//		}
 	//	}
-	bl := Vector{0, 0, 0}
-	br := Vector{5, 0, 0}
-	tl := Vector{0, 0, 5}
-	tr := Vector{5, 0, 5}
-	objects = append(objects, NewTriangle(bl, br, tl, Vector{0, 1, 0}, Vector{0, 1, 0}, Vector{0, 1, 0}, Lambertian(RGB{.5, .5, .5})))
-	objects = append(objects, NewTriangle(tl, tr, br, Vector{0, 1, 0}, Vector{0, 1, 0}, Vector{0, 1, 0}, Lambertian(RGB{.5, .5, .5})))
-	objects = append(objects, &Sphere{Center: Vector{2.25, 3, 2.25}, Radius: 1, Mat: Light(RGB{1, 1, 1}, .2)})
+	objects = append(objects, &Quad{Corner: Vector{0, 0, 0}, U: Vector{0, 0, 5}, V: Vector{5, 0, 0}, Mat: Lambertian(RGB{.5, .5, .5})})
+	objects = append(objects, &Sphere{Center: Vector{2.25, 3, 2.25}, Radius: 1, Mat: Emissive(RGB{1, 1, 1}, 6)})
 	objects = append(objects, &Sphere{Center: Vector{1.25, .5, 3}, Radius: .5, Mat: Lambertian(RGB{.8, .1, .1})})
-	//barrel, _ := LoadOBJ("barrel.obj", Vector{1.5, 1, 1.5}, .5, *Light(RGB{.8, .6, .2}, .75))
-	teapot, _ := LoadOBJ("teapot.obj", Vector{2.4, .8, -1}, .25, *Transparent(RGB{.9, 1, .9}, 1.5, 0, .3, .7))
+	//barrel, _ := LoadOBJ("barrel.obj", Vector{1.5, 1, 1.5}, .5, *Emissive(RGB{.8, .6, .2}, .75))
+	load := LoadMesh
+	if *flagMeshCache {
+		load = LoadCachedMesh
+	}
+	teapot, _ := load("teapot.obj", Vector{2.4, .8, -1}, .25, *Transparent(RGB{.9, 1, .9}, 1.5, 0, .3, .7))
 
 	//objects = append(objects, barrel)
 	objects = append(objects, teapot)
@@ -200,26 +322,78 @@ type MyMainWindow struct {
 	tabWidget *walk.TabWidget
 }
 
+func saveCheckpoint(buf *Buffer, sceneHash uint64) {
+	renderMu.Lock()
+	defer renderMu.Unlock()
+	if *flagCheckpoint == "" || Passes == 0 {
+		return
+	}
+	hash := CheckpointHash(sceneHash, buf.Filter, *flagIntegrator, integratorOptions())
+	if err := NewCheckpoint(buf, hash, Seed, Passes).Save(*flagCheckpoint); err != nil {
+		fmt.Println("Checkpoint failed:", err)
+	}
+}
+
 func render(scene *Scene, cam *Camera, buf *Buffer) {
+	renderMu.Lock()
+	defer renderMu.Unlock()
+	pass := Passes
+	Passes++
+	seed := Seed + int64(pass)<<20
+	switch *flagIntegrator {
+	case "mlt":
+		// SPP is the average number of mutations per pixel
+		NewMLT(scene, MaxDepth).Render(scene, cam, buf, Width, Height, SPP, seed, NumCPU)
+	case "sppm":
+		// SPP is the number of photon passes
+		NewSPPM(scene, MaxDepth, 0, ShadowRays).Render(scene, cam, buf, Width, Height, SPP, seed, NumCPU)
+	default:
+		renderRegion(scene, cam, buf, image.Rect(0, 0, Width, Height), image.Point{}, seed, true)
+	}
+}
+
+// renderRegion renders the pixels of region into buf, whose top left pixel
+// lies at offset in image coordinates.
+func renderRegion(scene *Scene, cam *Camera, buf *Buffer, region image.Rectangle, offset image.Point, seed int64, verbose bool) {
 	intersections := 0
+	integrator, _ := IntegratorByName(*flagIntegrator, scene, integratorOptions())
+	// light paths splat onto the whole image, but only the part in region is
+	// kept, so each of them counts as that fraction of a light path
+	fraction := float64(region.Dx()*region.Dy()) / (Width * Height)
 	runtime.GOMAXPROCS(NumCPU)
-	ch := make(chan int, Height)
+	ch := make(chan int, region.Dy())
 	for i := 0; i < NumCPU; i++ {
 		go func(i int) {
-			rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
-			for y := i; y < Height; y += NumCPU {
-				for x := 0; x < Width; x++ {
+			rnd := rand.New(rand.NewSource(seed + int64(i)))
+			ctx := &SampleContext{
+				Scene:         scene,
+				Camera:        cam,
+				Rand:          rnd,
+				Intersections: &intersections,
+				Film:          buf,
+				Width:         Width,
+				Height:        Height,
+				Region:        region,
+				Offset:        offset,
+			}
+			for y := region.Min.Y + i; y < region.Max.Y; y += NumCPU {
+				for x := region.Min.X; x < region.Max.X; x++ {
 					for i := 0; i < SPP; i++ {
-						u := (float64(x) + rnd.Float64()) / float64(Width)
-						v := (float64(y) + rnd.Float64()) / float64(Height)
+						fx := float64(x) + rnd.Float64()
+						fy := float64(y) + rnd.Float64()
 
-						r := cam.RayAt(u, v, rnd)
+						r := cam.RayAt(fx/float64(Width), fy/float64(Height), rnd)
 
-						c := getColor(r, scene, 0, rnd, &intersections)
-						buf.AddSample(x, y, c)
+						c := integrator.Li(r, ctx)
+						buf.Splat(fx-float64(offset.X), fy-float64(offset.Y), c)
+						buf.AddLightPath(x-offset.X, y-offset.Y, fraction)
+						if *flagDenoise {
+							albedo, normal := getFeatures(r, scene, &intersections)
+							buf.AddFeature(x-offset.X, y-offset.Y, albedo, normal)
+						}
 					}
 					if AdaptiveSamples > 0 {
-						v := buf.StandardDeviation(x, y).MaxComponent()
+						v := buf.StandardDeviation(x-offset.X, y-offset.Y).MaxComponent()
 						v = v / AdaptiveThreshold
 						if v > 1 {
 							v = 1
@@ -229,12 +403,13 @@ func render(scene *Scene, cam *Camera, buf *Buffer) {
 						v = math.Pow(v, AdaptiveExponent)
 						samples := int(v * float64(AdaptiveSamples))
 						for i := 0; i < samples; i++ {
-							u := (float64(x) + rnd.Float64()) / float64(Width)
-							v := (float64(y) + rnd.Float64()) / float64(Height)
-							r := cam.RayAt(u, v, rnd)
+							fx := float64(x) + rnd.Float64()
+							fy := float64(y) + rnd.Float64()
+							r := cam.RayAt(fx/float64(Width), fy/float64(Height), rnd)
 
-							c := getColor(r, scene, 0, rnd, &intersections)
-							buf.AddSample(x, y, c)
+							c := integrator.Li(r, ctx)
+							buf.Splat(fx-float64(offset.X), fy-float64(offset.Y), c)
+							buf.AddLightPath(x-offset.X, y-offset.Y, fraction)
 						}
 					}
 				}
@@ -242,62 +417,42 @@ func render(scene *Scene, cam *Camera, buf *Buffer) {
 			}
 		}(i)
 	}
-	for j := 0; j < Height; j++ {
+	for j := 0; j < region.Dy(); j++ {
 		row := <-ch
-		fmt.Println("Finished row", row, "out of", Height, ",", (float64(j) / Height * 100), "% done")
+		if verbose {
+			fmt.Println("Finished row", row, "out of", Height, ",", (float64(j) / Height * 100), "% done")
+		}
+	}
+	if verbose {
+		fmt.Println("Intersections: ", intersections)
 	}
-	fmt.Println("Intersections: ", intersections)
 
 }
 
-func getColor(r Ray, scene *Scene, depth int, rnd *rand.Rand, intersections *int) RGB {
-	if depth > MaxDepth {
-		return background(r)
+func integratorOptions() IntegratorOptions {
+	return IntegratorOptions{
+		MaxDepth:             MaxDepth,
+		MaxSpecularDepth:     *flagMaxSpecularDepth,
+		MaxTransmissionDepth: *flagMaxTransmissionDepth,
+		ShadowRays:           ShadowRays,
 	}
-	b, hit := scene.KDTree.Hit(r, tMin, tMax, intersections)
+}
 
-	if b {
-		if hit.Material.Emittance > 0.0 {
-			return hit.Material.Color()
-		}
-		mode := BounceTypeAny
-		bouncedRay, reflected, p := hit.Bounce(r, rnd.Float64(), rnd.Float64(), mode, hit, rnd)
-		if mode == BounceTypeAny {
-			p = 1
-		}
-		if p > 0 && reflected {
-			// specular
-			indirectLight := getColor(bouncedRay, scene, depth+1, rnd, intersections)
-			tinted := indirectLight.Mix(hit.Material.Color().Multiply(indirectLight), hit.Material.Tint)
-			return tinted.MultiplyScalar(p)
-		} else if p > 0 && !reflected {
-			//diffuse
-			indirectLight := getColor(bouncedRay, scene, depth+1, rnd, intersections)
-			directLight := getLighting(scene, hit, bouncedRay, rnd)
-			return hit.Material.Color().Multiply(directLight.Add(indirectLight)).MultiplyScalar(p)
-		}
-		return RGB{}
+// wholeImageIntegrators render the whole image at once rather than pixel by
+// pixel, see render.
+var wholeImageIntegrators = map[string]bool{"mlt": true, "sppm": true}
+
+func getFeatures(r Ray, scene *Scene, intersections *int) (RGB, Vector) {
+	b, hit := scene.KDTree.Hit(r, tMin, tMax, intersections)
+	if !b {
+		return background(r, scene), Vector{}
 	}
-	return background(r)
+	return hit.Surface().Color(), hit.Normal
 }
-func getLighting(scene *Scene, hit Hit, bounce Ray, rnd *rand.Rand) RGB {
-	var intersections int
-	var contrib RGB
-	for _, light := range scene.Lights {
-		for i := 0; i < ShadowRays; i++ {
-			L_i := light.Material().Color().MultiplyScalar(light.Material().Emittance)
-			pToL := light.RandomPoint(rnd, hit.Point).Subtract(hit.Point)
-			occluded := scene.KDTree.Intersects(Ray{Origin: hit.Point, Direction: pToL}, tMin, tMax, &intersections)
-			if !occluded {
-				dot := math.Max(0.0, hit.Normal.Dot(pToL.MultiplyScalar(-1)))
-				contrib = contrib.Add(L_i.MultiplyScalar(dot))
-			}
-		}
+func background(r Ray, scene *Scene) RGB {
+	if scene.Background != nil {
+		return scene.Background.Radiance(r.Direction)
 	}
-	return contrib
-}
-
-func background(r Ray) RGB {
 	return RGB{0, 0, 0}
 	//return RGB{0, .3, .5}.MultiplyScalar(math.Max(0.0, r.Direction.Dot(Vector{0, 1, 1})))
 }
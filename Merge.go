@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	. "./lib"
+)
+
+// runMerge implements the merge subcommand, which combines checkpoints
+// rendered independently, e.g. on different machines, into one image.
+func runMerge(args []string) {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	output := flags.String("o", OutputFile, "write the merged image to file")
+	checkpoint := flags.String("checkpoint", "", "also write the merged checkpoint to file")
+	denoise := flags.Bool("denoise", false, "denoise the merged image")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: merge [flags] checkpoint...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var merged *Checkpoint
+	seeds := make(map[int64]string)
+	for _, path := range flags.Args() {
+		c, err := LoadCheckpoint(path)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if other, ok := seeds[c.Seed]; ok {
+			fmt.Printf("%s: shares the seed %d with %s\n", path, c.Seed, other)
+			os.Exit(1)
+		}
+		seeds[c.Seed] = path
+		if merged == nil {
+			merged = c
+			continue
+		}
+		if err := merged.Merge(c); err != nil {
+			fmt.Printf("%s: %v\n", path, err)
+			os.Exit(1)
+		}
+	}
+	fmt.Println("Merged", flags.NArg(), "checkpoints,", merged.Passes, "passes")
+
+	if *checkpoint != "" {
+		if err := merged.Save(*checkpoint); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	buf := merged.Buffer()
+	if *denoise {
+		buf = buf.Denoise(DefaultDenoiseOptions)
+	}
+	if err := WritePng(*output, buf.Image(ColorChannel)); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,496 @@
+package lib
+
+import (
+	"math"
+)
+
+// BDPT is a bidirectional path tracer (Veach, "Robust Monte Carlo Methods for
+// Light Transport Simulation", chapter 10). For every camera sample it traces
+// a path from the camera and one from a light, joins every pair of their
+// vertices and weights each of the resulting paths with the balance
+// heuristic. Paths that reach the camera directly from the light path are
+// splatted onto the film.
+type BDPT struct {
+	MaxDepth int
+
+	lights       []Light
+	lightSampler *PowerLightSampler
+	background   *BackgroundLight
+	radius       float64
+}
+
+func NewBDPT(scene *Scene, maxDepth int) *BDPT {
+	b := &BDPT{MaxDepth: maxDepth}
+	var center Vector
+	center, b.radius = scene.BoundingSphere()
+	b.lights = append([]Light(nil), scene.Lights...)
+	if scene.Background != nil {
+		b.background = NewBackgroundLight(scene.Background, center, b.radius)
+		b.lights = append(b.lights, b.background)
+	}
+	b.lightSampler = NewPowerLightSampler(b.lights)
+	return b
+}
+
+type vertexKind uint8
+
+const (
+	cameraVertex vertexKind = iota
+	lightVertex
+	surfaceVertex
+)
+
+type pathVertex struct {
+	kind     vertexKind
+	p, n     Vector // n is zero away from surfaces
+	wo       Vector // towards the previous vertex of surface vertices
+	beta     RGB    // throughput of the subpath up to here
+	bsdf     BSDF
+	light    Light // of light vertices and of emitters hit by camera paths
+	infinite bool  // light at infinity, p only marks the direction to it
+	delta    bool  // scattered by a lobe the BSDF can only sample
+
+	// area densities of sampling this vertex from the previous one and, in
+	// reverse, from the next one
+	pdfFwd, pdfRev float64
+}
+
+func (v *pathVertex) onSurface() bool {
+	return v.n != (Vector{})
+}
+
+func (v *pathVertex) isLight() bool {
+	return v.kind == lightVertex || v.kind == surfaceVertex && v.light != nil
+}
+
+func (v *pathVertex) isDeltaLight() bool {
+	if v.kind != lightVertex {
+		return false
+	}
+	switch v.light.(type) {
+	case *PointLight, *SpotLight, *DirectionalLight:
+		return true
+	}
+	return false
+}
+
+func (v *pathVertex) connectable() bool {
+	switch v.kind {
+	case lightVertex:
+		_, directional := v.light.(*DirectionalLight)
+		return !directional
+	case surfaceVertex:
+		return v.bsdf.Connectable()
+	}
+	return true
+}
+
+// f is the BSDF for light arriving from next and leaving towards the
+// previous vertex.
+func (v *pathVertex) f(next *pathVertex) RGB {
+	if v.kind != surfaceVertex {
+		return RGB{}
+	}
+	return v.bsdf.F(v.wo, next.p.Subtract(v.p).Normalize())
+}
+
+// Le is the light a light vertex sends towards prev.
+func (v *pathVertex) Le(prev *pathVertex) RGB {
+	if !v.isLight() {
+		return RGB{}
+	}
+	w := prev.p.Subtract(v.p).Normalize()
+	if v.infinite {
+		if bg, ok := v.light.(*BackgroundLight); ok {
+			return bg.Background.Radiance(w.MultiplyScalar(-1))
+		}
+		return RGB{}
+	}
+	if l, ok := v.light.(*AreaLight); ok {
+		return l.L(v.n, w)
+	}
+	return RGB{}
+}
+
+// convertDensity turns a solid angle density at v into an area density at
+// next.
+func convertDensity(v *pathVertex, pdf float64, next *pathVertex) float64 {
+	if next.infinite {
+		return pdf
+	}
+	w := next.p.Subtract(v.p)
+	d2 := w.SquaredLength()
+	if d2 == 0 {
+		return 0
+	}
+	if next.onSurface() {
+		pdf *= math.Abs(next.n.Dot(w)) / math.Sqrt(d2)
+	}
+	return pdf / d2
+}
+
+// pdf is the area density with which v, reached from prev, samples next.
+func (b *BDPT) pdf(cam *Camera, v, prev, next *pathVertex) float64 {
+	if v.kind == lightVertex {
+		return b.pdfLight(v, next)
+	}
+	wn := next.p.Subtract(v.p)
+	if wn.SquaredLength() == 0 {
+		return 0
+	}
+	wn = wn.Normalize()
+	var pdf float64
+	if v.kind == cameraVertex {
+		pdf = cam.Pdf(wn)
+	} else {
+		pdf = v.bsdf.Pdf(prev.p.Subtract(v.p).Normalize(), wn)
+	}
+	return convertDensity(v, pdf, next)
+}
+
+// pdfLight is the area density with which the light at v emits towards next.
+func (b *BDPT) pdfLight(v, next *pathVertex) float64 {
+	w := next.p.Subtract(v.p)
+	d2 := w.SquaredLength()
+	if d2 == 0 {
+		return 0
+	}
+	w = w.DivideScalar(math.Sqrt(d2))
+	var pdf float64
+	if v.infinite {
+		pdf = 1 / (math.Pi * b.radius * b.radius)
+	} else {
+		_, pdfDir := v.light.PdfEmission(v.p, v.n, w)
+		pdf = pdfDir / d2
+	}
+	if next.onSurface() {
+		pdf *= math.Abs(next.n.Dot(w))
+	}
+	return pdf
+}
+
+// pdfLightOrigin is the density of choosing the light at v and the point v on
+// it when starting a light path towards next.
+func (b *BDPT) pdfLightOrigin(v, next *pathVertex) float64 {
+	w := next.p.Subtract(v.p).Normalize()
+	if v.infinite {
+		return b.infiniteDensity(w)
+	}
+	pdfPos, _ := v.light.PdfEmission(v.p, v.n, w)
+	return pdfPos * b.lightSampler.Pmf(v.p, v.n, v.light)
+}
+
+// infiniteDensity is the density of light paths from the lights at infinity
+// travelling along w.
+func (b *BDPT) infiniteDensity(w Vector) float64 {
+	if b.background == nil {
+		return 0
+	}
+	return b.background.Pdf(Vector{}, w.MultiplyScalar(-1)) * b.lightSampler.Pmf(Vector{}, Vector{}, b.background)
+}
+
+func (b *BDPT) Li(r Ray, ctx *SampleContext) RGB {
+	r.Direction = r.Direction.Normalize()
+	camera := make([]pathVertex, b.MaxDepth+2)
+	light := make([]pathVertex, b.MaxDepth+1)
+	nCamera := b.cameraSubpath(r, ctx, camera)
+	nLight := b.lightSubpath(ctx, light)
+
+	var L RGB
+	for t := 1; t <= nCamera; t++ {
+		for s := 0; s <= nLight; s++ {
+			depth := t + s - 2
+			if s == 1 && t == 1 || depth < 0 || depth > b.MaxDepth {
+				continue
+			}
+			c, fs, ft := b.connect(ctx, light, camera, s, t)
+			if t == 1 {
+				if c != (RGB{}) {
+					ctx.SplatFilm(fs, ft, c)
+				}
+			} else {
+				L = L.Add(c)
+			}
+		}
+	}
+	return L
+}
+
+func (b *BDPT) cameraSubpath(r Ray, ctx *SampleContext, path []pathVertex) int {
+	path[0] = pathVertex{kind: cameraVertex, p: ctx.Camera.Position(), beta: RGB{1, 1, 1}}
+	return b.randomWalk(ctx, r, RGB{1, 1, 1}, ctx.Camera.Pdf(r.Direction), true, path, 1) + 1
+}
+
+func (b *BDPT) lightSubpath(ctx *SampleContext, path []pathVertex) int {
+	rnd := ctx.Rand
+	l, pmf := b.lightSampler.Sample(Vector{}, Vector{}, rnd.Float64())
+	if l == nil || pmf == 0 {
+		return 0
+	}
+	e := l.SampleEmission(rnd)
+	if e.PdfPos == 0 || e.PdfDir == 0 || e.Radiance == (RGB{}) {
+		return 0
+	}
+	_, infinite := l.(*DirectionalLight)
+	if _, ok := l.(*BackgroundLight); ok {
+		infinite = true
+	}
+	path[0] = pathVertex{kind: lightVertex, p: e.Ray.Origin, beta: e.Radiance, light: l, infinite: infinite, pdfFwd: e.PdfPos * pmf}
+	cos := 1.0
+	if !infinite && e.Normal != (Vector{}) {
+		path[0].n = e.Normal
+		cos = math.Abs(e.Normal.Dot(e.Ray.Direction))
+	}
+	beta := e.Radiance.MultiplyScalar(cos / (pmf * e.PdfPos * e.PdfDir))
+	n := b.randomWalk(ctx, e.Ray, beta, e.PdfDir, false, path, 1)
+	if infinite {
+		// the origin was placed on a disc, whose density is the one that
+		// matters for the first hit
+		if n > 0 {
+			path[1].pdfFwd = e.PdfPos
+			if path[1].onSurface() {
+				path[1].pdfFwd *= math.Abs(e.Ray.Direction.Dot(path[1].n))
+			}
+		}
+		path[0].pdfFwd = b.infiniteDensity(e.Ray.Direction)
+	}
+	return n + 1
+}
+
+// randomWalk extends path from index start by sampling the BSDF at every hit,
+// and returns the number of vertices added. Camera paths that leave the scene
+// end on a vertex for the background.
+func (b *BDPT) randomWalk(ctx *SampleContext, r Ray, beta RGB, pdf float64, camera bool, path []pathVertex, start int) int {
+	pdfFwd := pdf
+	i := start
+	for ; i < len(path); i++ {
+		if beta == (RGB{}) {
+			break
+		}
+		prev := &path[i-1]
+		v := &path[i]
+		ok, hit := ctx.Scene.KDTree.Hit(r, RayEpsilon, math.MaxFloat64, ctx.Intersections)
+		if !ok {
+			if camera && b.background != nil {
+				*v = pathVertex{kind: lightVertex, p: r.Origin.Add(r.Direction), beta: beta, light: b.background, infinite: true, pdfFwd: pdfFwd}
+				i++
+			}
+			break
+		}
+		*v = pathVertex{kind: surfaceVertex, p: hit.Point, n: hit.Normal.Normalize(), wo: r.Direction.MultiplyScalar(-1), beta: beta, bsdf: NewBSDF(hit)}
+		if hit.Material != nil && hit.Material.Emittance > 0 {
+			if l := ctx.Scene.LightOf(hit.Object); l != nil {
+				v.light = l
+			}
+		}
+		v.pdfFwd = convertDensity(prev, pdfFwd, v)
+		if i == len(path)-1 {
+			i++
+			break
+		}
+
+		wi, weight, pdf, specular := v.bsdf.Sample(v.wo, ctx.Rand)
+		if pdf == 0 || weight == (RGB{}) {
+			i++
+			break
+		}
+		beta = beta.Multiply(weight)
+		pdfFwd = pdf
+		pdfRev := v.bsdf.Pdf(wi, v.wo)
+		if specular {
+			v.delta = true
+			pdfFwd, pdfRev = 0, 0
+		}
+		prev.pdfRev = convertDensity(v, pdfRev, prev)
+		r = Ray{hit.Point, wi}
+	}
+	return i - start
+}
+
+// connect joins the first s vertices of the light path to the first t of the
+// camera path. For t == 1 the result belongs at film position (fs, ft).
+func (b *BDPT) connect(ctx *SampleContext, light, camera []pathVertex, s, t int) (L RGB, fs, ft float64) {
+	if t > 1 && s != 0 && camera[t-1].kind == lightVertex {
+		return
+	}
+	var sampled pathVertex
+	switch {
+	case s == 0:
+		pt := &camera[t-1]
+		if pt.isLight() {
+			L = pt.Le(&camera[t-2]).Multiply(pt.beta)
+		}
+	case t == 1:
+		qs := &light[s-1]
+		if !qs.connectable() {
+			return
+		}
+		cam := ctx.Camera
+		var ok bool
+		if fs, ft, ok = cam.Project(qs.p); !ok {
+			return
+		}
+		d := qs.p.Subtract(cam.Position())
+		dist := d.Length()
+		d = d.DivideScalar(dist)
+		// Importance/Pdf is 1/cos at the camera, and the pinhole is picked
+		// from qs with solid angle density dist²/cos
+		we := cam.Importance(d)
+		pdf := dist * dist * we / cam.Pdf(d)
+		sampled = pathVertex{kind: cameraVertex, p: cam.Position(), beta: RGB{1, 1, 1}.MultiplyScalar(we / pdf)}
+		L = qs.beta.Multiply(qs.f(&sampled)).Multiply(sampled.beta)
+		if qs.onSurface() {
+			L = L.MultiplyScalar(math.Abs(d.Dot(qs.n)))
+		}
+		if L != (RGB{}) && !b.visible(ctx, qs.p, cam.Position()) {
+			L = RGB{}
+		}
+	case s == 1:
+		pt := &camera[t-1]
+		if !pt.connectable() {
+			return
+		}
+		l, pmf := b.lightSampler.Sample(pt.p, pt.n, ctx.Rand.Float64())
+		if l == nil || pmf == 0 {
+			return
+		}
+		ls := l.Sample(pt.p, ctx.Rand)
+		if ls.Pdf == 0 || ls.Radiance == (RGB{}) {
+			return
+		}
+		sampled = pathVertex{kind: lightVertex, n: ls.Normal, light: l, beta: ls.Radiance.DivScalar(ls.Pdf * pmf)}
+		if math.IsInf(ls.Distance, 1) {
+			sampled.infinite = true
+			sampled.n = Vector{}
+			sampled.p = pt.p.Add(ls.Direction.MultiplyScalar(2 * b.radius))
+		} else {
+			sampled.p = pt.p.Add(ls.Direction.MultiplyScalar(ls.Distance))
+		}
+		sampled.pdfFwd = b.pdfLightOrigin(&sampled, pt)
+		L = pt.beta.Multiply(pt.f(&sampled)).Multiply(sampled.beta)
+		if pt.onSurface() {
+			L = L.MultiplyScalar(math.Abs(ls.Direction.Dot(pt.n)))
+		}
+		if L != (RGB{}) {
+			tMax := ls.Distance * (1 - RayEpsilon)
+			if sampled.infinite {
+				tMax = math.MaxFloat64
+			}
+			if ctx.Scene.KDTree.Intersects(Ray{pt.p, ls.Direction}, RayEpsilon, tMax, ctx.Intersections) {
+				L = RGB{}
+			}
+		}
+	default:
+		qs, pt := &light[s-1], &camera[t-1]
+		if qs.connectable() && pt.connectable() {
+			L = qs.beta.Multiply(qs.f(pt)).Multiply(pt.f(qs)).Multiply(pt.beta)
+			if L != (RGB{}) {
+				L = L.MultiplyScalar(b.g(ctx, qs, pt))
+			}
+		}
+	}
+	if L == (RGB{}) {
+		return
+	}
+	return L.MultiplyScalar(b.misWeight(ctx, light, camera, &sampled, s, t)), fs, ft
+}
+
+// g is the geometry term between two vertices, including their visibility.
+func (b *BDPT) g(ctx *SampleContext, v0, v1 *pathVertex) float64 {
+	d := v0.p.Subtract(v1.p)
+	g := 1 / d.SquaredLength()
+	d = d.MultiplyScalar(math.Sqrt(g))
+	if v0.onSurface() {
+		g *= math.Abs(v0.n.Dot(d))
+	}
+	if v1.onSurface() {
+		g *= math.Abs(v1.n.Dot(d))
+	}
+	if !b.visible(ctx, v0.p, v1.p) {
+		return 0
+	}
+	return g
+}
+
+func (b *BDPT) visible(ctx *SampleContext, p0, p1 Vector) bool {
+	d := p1.Subtract(p0)
+	dist := d.Length()
+	return !ctx.Scene.KDTree.Intersects(Ray{p0, d.DivideScalar(dist)}, RayEpsilon, dist*(1-RayEpsilon), ctx.Intersections)
+}
+
+// misWeight is the balance heuristic weight of the path made of s light and t
+// camera vertices, found by comparing its density with the densities of all
+// other ways of sampling the same path.
+func (b *BDPT) misWeight(ctx *SampleContext, light, camera []pathVertex, sampled *pathVertex, s, t int) float64 {
+	if s+t == 2 {
+		return 1
+	}
+	// work on copies, since the vertex densities change with the connection
+	lv := append([]pathVertex(nil), light[:s]...)
+	cv := append([]pathVertex(nil), camera[:t]...)
+	if s == 1 {
+		lv[0] = *sampled
+	} else if t == 1 {
+		cv[0] = *sampled
+	}
+	var qs, pt, qsMinus, ptMinus *pathVertex
+	if s > 0 {
+		qs = &lv[s-1]
+		qs.delta = false
+	}
+	if s > 1 {
+		qsMinus = &lv[s-2]
+	}
+	pt = &cv[t-1]
+	pt.delta = false
+	if t > 1 {
+		ptMinus = &cv[t-2]
+	}
+
+	cam := ctx.Camera
+	if s > 0 {
+		pt.pdfRev = b.pdf(cam, qs, qsMinus, pt)
+	} else {
+		pt.pdfRev = b.pdfLightOrigin(pt, ptMinus)
+	}
+	if ptMinus != nil {
+		if s > 0 {
+			ptMinus.pdfRev = b.pdf(cam, pt, qs, ptMinus)
+		} else {
+			ptMinus.pdfRev = b.pdfLight(pt, ptMinus)
+		}
+	}
+	if qs != nil {
+		qs.pdfRev = b.pdf(cam, pt, ptMinus, qs)
+	}
+	if qsMinus != nil {
+		qsMinus.pdfRev = b.pdf(cam, qs, pt, qsMinus)
+	}
+
+	remap := func(f float64) float64 {
+		if f == 0 {
+			return 1
+		}
+		return f
+	}
+	var sum float64
+	ri := 1.0
+	for i := t - 1; i > 0; i-- {
+		ri *= remap(cv[i].pdfRev) / remap(cv[i].pdfFwd)
+		if !cv[i].delta && !cv[i-1].delta {
+			sum += ri
+		}
+	}
+	ri = 1
+	for i := s - 1; i >= 0; i-- {
+		ri *= remap(lv[i].pdfRev) / remap(lv[i].pdfFwd)
+		deltaLight := lv[0].isDeltaLight()
+		if i > 0 {
+			deltaLight = lv[i-1].delta
+		}
+		if !lv[i].delta && !deltaLight {
+			sum += ri
+		}
+	}
+	return 1 / (1 + sum)
+}
@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"math"
+	"math/rand"
+)
+
+// BSDF describes how a surface scatters light in terms of its Material: a
+// mirror lobe chosen with the material's Reflectivity, then refraction for
+// transparent materials and a Lambertian lobe for the rest. Only the
+// Lambertian lobe can be evaluated for a given pair of directions; the mirror
+// and refraction lobes, glossy or not, can only be sampled. Directions point
+// away from the surface.
+type BSDF struct {
+	Normal   Vector // unit
+	Material *Material
+	// in nanometres, refraction uses the index at this wavelength if it is
+	// set and the material is dispersive
+	Wavelength float64
+}
+
+func NewBSDF(hit Hit) BSDF {
+	return BSDF{Normal: hit.Normal.Normalize(), Material: hit.Surface()}
+}
+
+func (b BSDF) index() float64 {
+	if b.Wavelength > 0 && b.Material.Dispersive() {
+		return b.Material.IndexAt(b.Wavelength)
+	}
+	return b.Material.Index
+}
+
+// diffuse is the fraction of light scattered by the Lambertian lobe.
+func (b BSDF) diffuse() float64 {
+	m := b.Material
+	if m == nil || m.Transparency > 0 {
+		return 0
+	}
+	return 1 - m.Reflectivity
+}
+
+// Connectable reports whether F can be non-zero, so that paths can be joined
+// at the surface.
+func (b BSDF) Connectable() bool {
+	return b.diffuse() > 0
+}
+
+func (b BSDF) F(wo, wi Vector) RGB {
+	if b.Normal.Dot(wo)*b.Normal.Dot(wi) <= 0 {
+		return RGB{}
+	}
+	return b.Material.Color().MultiplyScalar(b.diffuse() / math.Pi)
+}
+
+// Pdf is the density with which Sample picks wi given wo, counting only the
+// Lambertian lobe.
+func (b BSDF) Pdf(wo, wi Vector) float64 {
+	if b.Normal.Dot(wo)*b.Normal.Dot(wi) <= 0 {
+		return 0
+	}
+	return b.diffuse() * math.Abs(b.Normal.Dot(wi.Normalize())) / math.Pi
+}
+
+// Sample picks an incident direction wi for the outgoing direction wo. weight
+// is F*cos/pdf, the factor a path's throughput changes by. specular is set
+// for the lobes that F and Pdf don't cover, and pdf is zero if nothing was
+// scattered.
+func (b BSDF) Sample(wo Vector, rnd *rand.Rand) (wi Vector, weight RGB, pdf float64, specular bool) {
+	m := b.Material
+	if m == nil {
+		return
+	}
+	if rnd.Float64() < m.Reflectivity {
+		wi = GlossCone(wo.MultiplyScalar(-1).Reflect(b.Normal), m.Gloss, rnd.Float64(), rnd.Float64(), rnd)
+		return wi, RGB{1, 1, 1}.Mix(m.Color(), m.Tint), m.Reflectivity, true
+	}
+	if m.Transparency > 0 {
+		wi = b.Normal.Refract(wo.MultiplyScalar(-1), b.index())
+		wi = GlossCone(wi.Normalize(), m.Gloss, rnd.Float64(), rnd.Float64(), rnd)
+		return wi, m.Color(), 1 - m.Reflectivity, true
+	}
+	n := b.Normal
+	if n.Dot(wo) < 0 {
+		n = n.MultiplyScalar(-1)
+	}
+	wi = CosineHemisphere(n, rnd.Float64(), rnd.Float64())
+	pdf = b.Pdf(wo, wi)
+	if pdf == 0 {
+		return
+	}
+	return wi, m.Color(), pdf, false
+}
@@ -3,6 +3,7 @@ package lib
 import (
 	"image"
 	"math"
+	"sync"
 )
 
 type Channel int
@@ -12,57 +13,244 @@ const (
 	VarianceChannel
 	StandardDeviationChannel
 	SamplesChannel
+	AlbedoChannel
+	NormalChannel
 )
 
+// Pixel keeps the filter weighted sum of its samples and the total filter
+// weight, whose ratio is the pixel colour. Filters with negative lobes give
+// negative weights, which can bring the total close to zero, so the variance
+// only counts the positive part of the weights: M and V are the weighted
+// running mean and sum of squared deviations of the samples (West's weighted
+// variant of Welford's algorithm), and Weight and Weight2 are the sums of
+// those weights and of their squares.
+//
+// Integrators that trace paths from the lights also splat onto pixels other
+// than the one being sampled. Splat sums those contributions and LightPaths
+// normalises them: it counts the light paths traced while sampling the pixel,
+// each weighted by the fraction of the image its splats were allowed to reach.
 type Pixel struct {
-	Samples int
-	M, V    RGB
+	Samples         int
+	Sum             RGB
+	FilterWeight    float64
+	Weight, Weight2 float64
+	M, V            RGB
+	Splat           RGB
+	LightPaths      float64
 }
 
 func (p *Pixel) AddSample(sample RGB) {
+	p.AddWeightedSample(sample, 1)
+}
+
+func (p *Pixel) AddWeightedSample(sample RGB, w float64) {
+	if w == 0 {
+		return
+	}
 	p.Samples++
-	if p.Samples == 1 {
-		p.M = sample
+	p.Sum = p.Sum.Add(sample.MultiplyScalar(w))
+	p.FilterWeight += w
+	if w < 0 {
 		return
 	}
+	p.Weight += w
+	p.Weight2 += w * w
 	m := p.M
-	p.M = p.M.Add(sample.Sub(p.M).DivScalar(float64(p.Samples)))
-	p.V = p.V.Add(sample.Sub(m).Multiply(sample.Sub(p.M)))
+	p.M = p.M.Add(sample.Sub(p.M).MultiplyScalar(w / p.Weight))
+	p.V = p.V.Add(sample.Sub(m).Multiply(sample.Sub(p.M)).MultiplyScalar(w))
+}
+
+// Merge combines the statistics of two independently accumulated pixels using
+// the parallel form of the variance update (Chan et al.).
+func (p *Pixel) Merge(o Pixel) {
+	if o.Samples == 0 && o.LightPaths == 0 {
+		return
+	}
+	if p.Samples == 0 && p.LightPaths == 0 {
+		*p = o
+		return
+	}
+	w := p.Weight + o.Weight
+	if w != 0 {
+		d := o.M.Sub(p.M)
+		p.V = p.V.Add(o.V).Add(d.Multiply(d).MultiplyScalar(p.Weight * o.Weight / w))
+		p.M = p.M.Add(d.MultiplyScalar(o.Weight / w))
+	}
+	p.Samples += o.Samples
+	p.Sum = p.Sum.Add(o.Sum)
+	p.FilterWeight += o.FilterWeight
+	p.Weight = w
+	p.Weight2 += o.Weight2
+	p.Splat = p.Splat.Add(o.Splat)
+	p.LightPaths += o.LightPaths
 }
 
 func (p *Pixel) Color() RGB {
-	return p.M
+	var c RGB
+	if p.FilterWeight > 0 {
+		c = p.Sum.DivScalar(p.FilterWeight)
+	}
+	if p.LightPaths > 0 {
+		c = c.Add(p.Splat.DivScalar(p.LightPaths))
+	}
+	return c
+}
+
+// SetColor replaces the colour of the pixel, splats included, and keeps its
+// statistics.
+func (p *Pixel) SetColor(c RGB) {
+	p.Sum, p.FilterWeight = c, 1
+	p.Splat, p.LightPaths = RGB{}, 0
 }
 
 func (p *Pixel) Variance() RGB {
-	if p.Samples < 2 {
+	if p.Samples < 2 || p.Weight == 0 {
 		return RGB{}
 	}
-	return p.V.DivScalar(float64(p.Samples - 1))
+	d := p.Weight - p.Weight2/p.Weight
+	if d <= 0 {
+		return RGB{}
+	}
+	return p.V.DivScalar(d)
+}
+
+// VarianceOfMean is the estimated variance of the pixel colour itself.
+func (p *Pixel) VarianceOfMean() RGB {
+	if p.Samples < 2 || p.Weight == 0 {
+		return RGB{}
+	}
+	return p.Variance().MultiplyScalar(p.Weight2 / (p.Weight * p.Weight))
 }
 
 func (p *Pixel) StandardDeviation() RGB {
 	return p.Variance().Sqrt()
 }
 
+// Feature holds the running mean of the first hit's albedo and normal, used
+// to guide the denoiser.
+type Feature struct {
+	Samples int
+	Albedo  RGB
+	Normal  Vector
+}
+
+func (f *Feature) AddSample(albedo RGB, normal Vector) {
+	f.Samples++
+	n := float64(f.Samples)
+	f.Albedo = f.Albedo.Add(albedo.Sub(f.Albedo).DivScalar(n))
+	f.Normal = f.Normal.Add(normal.Subtract(f.Normal).DivideScalar(n))
+}
+
+func (f *Feature) Merge(o Feature) {
+	if o.Samples == 0 {
+		return
+	}
+	n := float64(f.Samples + o.Samples)
+	t := float64(o.Samples) / n
+	f.Albedo = f.Albedo.Mix(o.Albedo, t)
+	f.Normal = f.Normal.MultiplyScalar(1 - t).Add(o.Normal.MultiplyScalar(t))
+	f.Samples += o.Samples
+}
+
 type Buffer struct {
-	W, H   int
-	Pixels []Pixel
+	W, H     int
+	Pixels   []Pixel
+	Features []Feature
+	Filter   Filter
+	rows     []sync.Mutex
 }
 
 func NewBuffer(w, h int) *Buffer {
 	pixels := make([]Pixel, w*h)
-	return &Buffer{w, h, pixels}
+	features := make([]Feature, w*h)
+	return &Buffer{w, h, pixels, features, BoxFilter{}, make([]sync.Mutex, h)}
 }
 
+// Copy takes a consistent snapshot of the buffer, so it is safe to call while
+// a render is still adding samples.
 func (b *Buffer) Copy() *Buffer {
 	pixels := make([]Pixel, b.W*b.H)
-	copy(pixels, b.Pixels)
-	return &Buffer{b.W, b.H, pixels}
+	features := make([]Feature, b.W*b.H)
+	for y := 0; y < b.H; y++ {
+		b.rows[y].Lock()
+		copy(pixels[y*b.W:(y+1)*b.W], b.Pixels[y*b.W:(y+1)*b.W])
+		copy(features[y*b.W:(y+1)*b.W], b.Features[y*b.W:(y+1)*b.W])
+		b.rows[y].Unlock()
+	}
+	return &Buffer{b.W, b.H, pixels, features, b.Filter, make([]sync.Mutex, b.H)}
 }
 
 func (b *Buffer) AddSample(x, y int, sample RGB) {
+	b.rows[y].Lock()
 	b.Pixels[y*b.W+x].AddSample(sample)
+	b.rows[y].Unlock()
+}
+
+// Splat adds a sample taken at film position (fx, fy), in pixels, to every
+// pixel the filter reaches. Rows are locked since neighbouring rows may be
+// rendered concurrently.
+func (b *Buffer) Splat(fx, fy float64, sample RGB) {
+	r := b.Filter.Radius()
+	x0 := int(math.Max(0, math.Ceil(fx-.5-r)))
+	x1 := int(math.Min(float64(b.W-1), math.Floor(fx-.5+r)))
+	y0 := int(math.Max(0, math.Ceil(fy-.5-r)))
+	y1 := int(math.Min(float64(b.H-1), math.Floor(fy-.5+r)))
+	for y := y0; y <= y1; y++ {
+		b.rows[y].Lock()
+		for x := x0; x <= x1; x++ {
+			w := b.Filter.Evaluate(float64(x)+.5-fx, float64(y)+.5-fy)
+			b.Pixels[y*b.W+x].AddWeightedSample(sample, w)
+		}
+		b.rows[y].Unlock()
+	}
+}
+
+// AddSplat adds light arriving at pixel (x, y) from a path traced from the
+// lights.
+func (b *Buffer) AddSplat(x, y int, c RGB) {
+	b.rows[y].Lock()
+	b.Pixels[y*b.W+x].Splat = b.Pixels[y*b.W+x].Splat.Add(c)
+	b.rows[y].Unlock()
+}
+
+// AddLightPath counts a light path traced while sampling pixel (x, y), whose
+// splats were restricted to the given fraction of the image.
+func (b *Buffer) AddLightPath(x, y int, fraction float64) {
+	b.rows[y].Lock()
+	b.Pixels[y*b.W+x].LightPaths += fraction
+	b.rows[y].Unlock()
+}
+
+// Merge adds the samples of another buffer of the same size.
+func (b *Buffer) Merge(o *Buffer) {
+	b.MergeAt(0, 0, o)
+}
+
+// MergeAt adds the samples of a smaller buffer whose top left pixel lies at
+// (x0, y0). Pixels falling outside the buffer are dropped.
+func (b *Buffer) MergeAt(x0, y0 int, o *Buffer) {
+	for y := 0; y < o.H; y++ {
+		by := y0 + y
+		if by < 0 || by >= b.H {
+			continue
+		}
+		b.rows[by].Lock()
+		for x := 0; x < o.W; x++ {
+			bx := x0 + x
+			if bx < 0 || bx >= b.W {
+				continue
+			}
+			b.Pixels[by*b.W+bx].Merge(o.Pixels[y*o.W+x])
+			b.Features[by*b.W+bx].Merge(o.Features[y*o.W+x])
+		}
+		b.rows[by].Unlock()
+	}
+}
+
+func (b *Buffer) AddFeature(x, y int, albedo RGB, normal Vector) {
+	b.rows[y].Lock()
+	b.Features[y*b.W+x].AddSample(albedo, normal)
+	b.rows[y].Unlock()
 }
 
 func (b *Buffer) Samples(x, y int) int {
@@ -103,6 +291,11 @@ func (b *Buffer) Image(channel Channel) image.Image {
 			case SamplesChannel:
 				p := float64(b.Pixels[y*b.W+x].Samples) / maxSamples
 				c = RGB{p, p, p}
+			case AlbedoChannel:
+				c = b.Features[y*b.W+x].Albedo
+			case NormalChannel:
+				n := b.Features[y*b.W+x].Normal
+				c = RGB{n.X*.5 + .5, n.Y*.5 + .5, n.Z*.5 + .5}
 			}
 			result.Set(b.W-1-x, b.H-1-y, c.RGBA())
 		}
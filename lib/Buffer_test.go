@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func finite(c RGB) bool {
+	for _, f := range []float64{c.R, c.G, c.B} {
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPixelNegativeWeights(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []float64
+		weights []float64
+	}{
+		{"positive", []float64{1, 3, 2}, []float64{1, .5, .25}},
+		{"near zero total", []float64{1, 3, 2, 5}, []float64{.5, -.3, -.2, 1e-9}},
+		{"zero total", []float64{1, 3, 2}, []float64{.5, -.75, .25}},
+		{"negative first", []float64{4, 1, 2}, []float64{-.1, .6, .3}},
+	}
+	for _, test := range tests {
+		var p Pixel
+		var sum, total float64
+		for i, s := range test.samples {
+			p.AddWeightedSample(RGB{s, s, s}, test.weights[i])
+			sum += s * test.weights[i]
+			total += test.weights[i]
+		}
+		c, v := p.Color(), p.Variance()
+		if !finite(c) || !finite(v) || !finite(p.VarianceOfMean()) {
+			t.Errorf("%s: colour %v, variance %v", test.name, c, v)
+			continue
+		}
+		if total > 0 && math.Abs(c.R-sum/total) > 1e-9*math.Abs(sum/total) {
+			t.Errorf("%s: colour %v, want %v", test.name, c.R, sum/total)
+		}
+		if v.R <= 0 {
+			t.Errorf("%s: variance %v of differing samples", test.name, v.R)
+		}
+	}
+}
+
+func TestSplatMitchellVariance(t *testing.T) {
+	filter, _ := FilterByName("mitchell")
+	buf := NewBuffer(8, 8)
+	buf.Filter = filter
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 64*16; i++ {
+		fx, fy := 8*rnd.Float64(), 8*rnd.Float64()
+		s := rnd.Float64()
+		buf.Splat(fx, fy, RGB{s, s, s})
+	}
+	for y := 0; y < buf.H; y++ {
+		for x := 0; x < buf.W; x++ {
+			c, v := buf.Color(x, y), buf.Variance(x, y)
+			if !finite(c) || c.R < -.5 || c.R > 1.5 {
+				t.Errorf("pixel %d,%d: colour %v", x, y, c)
+			}
+			// uniform samples have a variance of 1/12
+			if !finite(v) || v.R < .02 || v.R > .2 {
+				t.Errorf("pixel %d,%d: variance %v", x, y, v)
+			}
+		}
+	}
+}
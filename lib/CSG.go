@@ -0,0 +1,176 @@
+package lib
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Solid is a closed Hittable that can tell every point where a line crosses
+// its surface, which CSG needs to combine solids.
+type Solid interface {
+	Hittable
+	// Crossings gives the hits along the whole line through r, sorted by T,
+	// as the line enters and leaves the solid in turn. Normals point out.
+	Crossings(r Ray) []Hit
+}
+
+// convexCrossings gives where the line of r enters and leaves a convex shape,
+// from its nearest hits looking both ways.
+func convexCrossings(h Hittable, r Ray) []Hit {
+	inf := math.Inf(1)
+	ok, enter := h.Hit(r, -inf, inf)
+	if !ok {
+		return nil
+	}
+	ok, exit := h.Hit(Ray{r.Origin, r.Direction.MultiplyScalar(-1)}, -inf, inf)
+	if !ok {
+		return nil
+	}
+	exit.T, exit.Ray = -exit.T, r
+	return []Hit{enter, exit}
+}
+
+type CSGOperation int
+
+const (
+	CSGUnion CSGOperation = iota
+	CSGIntersection
+	CSGDifference // A with B cut out
+)
+
+// CSG combines two solids by a set operation. Its surfaces keep the materials
+// of the solids they come from, unless Mat is set. CSG nodes are solids
+// themselves, so they nest.
+type CSG struct {
+	Operation CSGOperation
+	A, B      Solid
+	Mat       *Material
+}
+
+func (c *CSG) inside(inA, inB bool) bool {
+	switch c.Operation {
+	case CSGIntersection:
+		return inA && inB
+	case CSGDifference:
+		return inA && !inB
+	}
+	return inA || inB
+}
+
+// Crossings walks the crossings of both solids in order, keeping those where
+// the result changes between inside and outside. The surfaces of B bound a
+// difference from the inside of B, so their normals are turned around.
+func (c *CSG) Crossings(r Ray) []Hit {
+	a, b := c.A.Crossings(r), c.B.Crossings(r)
+	var hits []Hit
+	inA, inB := false, false
+	for len(a) > 0 || len(b) > 0 {
+		var h Hit
+		fromB := len(a) == 0 || (len(b) > 0 && b[0].T < a[0].T)
+		was := c.inside(inA, inB)
+		if fromB {
+			h, b, inB = b[0], b[1:], !inB
+		} else {
+			h, a, inA = a[0], a[1:], !inA
+		}
+		if c.inside(inA, inB) == was {
+			continue
+		}
+		if fromB && c.Operation == CSGDifference {
+			h.Normal = h.Normal.MultiplyScalar(-1)
+		}
+		if c.Mat != nil {
+			h.Material = c.Mat
+		}
+		hits = append(hits, h)
+	}
+	return hits
+}
+
+func (c *CSG) Hit(r Ray, tMin, tMax float64) (bool, Hit) {
+	box := c.BoundingBox()
+	if !box.Intersects(r) {
+		return false, Hit{}
+	}
+	for _, h := range c.Crossings(r) {
+		if h.T > tMin && h.T < tMax {
+			return true, h
+		}
+	}
+	return false, Hit{}
+}
+
+func (c *CSG) BoundingBox() Box {
+	a, b := c.A.BoundingBox(), c.B.BoundingBox()
+	switch c.Operation {
+	case CSGIntersection:
+		return Box{a.Min.Max(b.Min), a.Max.Min(b.Max)}
+	case CSGDifference:
+		return a
+	}
+	a.Extend(b)
+	return a
+}
+
+func (c *CSG) MidPoint() Vector {
+	box := c.BoundingBox()
+	return box.MidPoint()
+}
+
+func (c *CSG) Material() *Material {
+	if c.Mat != nil {
+		return c.Mat
+	}
+	return c.A.Material()
+}
+
+// RandomPoint picks points of either solid until one lies on the surface of
+// the result. They aren't spread evenly by area.
+func (c *CSG) RandomPoint(rnd *rand.Rand, point Vector) Vector {
+	var p Vector
+	for i := 0; i < 100; i++ {
+		onA := rnd.Float64() < .5
+		if onA {
+			p = surfacePoint(c.A, rnd, point)
+		} else {
+			p = surfacePoint(c.B, rnd, point)
+		}
+		switch c.Operation {
+		case CSGUnion:
+			if onA && !contains(c.B, p) || !onA && !contains(c.A, p) {
+				return p
+			}
+		case CSGIntersection:
+			if onA && contains(c.B, p) || !onA && contains(c.A, p) {
+				return p
+			}
+		case CSGDifference:
+			if onA && !contains(c.B, p) || !onA && contains(c.A, p) {
+				return p
+			}
+		}
+	}
+	return p
+}
+
+// surfacePoint samples shapes evenly by area, and other solids as they
+// choose.
+func surfacePoint(s Solid, rnd *rand.Rand, point Vector) Vector {
+	if shape, ok := s.(Shape); ok {
+		p, _ := shape.SamplePoint(rnd)
+		return p
+	}
+	return s.RandomPoint(rnd, point)
+}
+
+// contains tells whether p is inside s, by counting the crossings ahead of it
+// along an arbitrary direction.
+func contains(s Solid, p Vector) bool {
+	n := 0
+	for _, h := range s.Crossings(Ray{p, Vector{.5773, .5774, .5775}}) {
+		if h.T > 0 {
+			n++
+		}
+	}
+	return n%2 == 1
+}
@@ -0,0 +1,161 @@
+package lib
+
+import (
+	"math"
+	"testing"
+)
+
+// crossing is where a line along x is expected to cross a surface, and the x
+// of the normal there.
+type crossing struct {
+	x, normal float64
+}
+
+func checkCrossings(t *testing.T, name string, s Solid, r Ray, want []crossing) {
+	hits := s.Crossings(r)
+	if len(hits) != len(want) {
+		t.Errorf("%s: %d crossings, want %d", name, len(hits), len(want))
+		return
+	}
+	for i, h := range hits {
+		if math.Abs(h.Point.X-want[i].x) > 1e-9 || math.Abs(h.Normal.Normalize().X-want[i].normal) > 1e-9 {
+			t.Errorf("%s: crossing %d at x %v with normal %v, want %v with %v", name, i, h.Point.X, h.Normal, want[i].x, want[i].normal)
+		}
+		if i > 0 && h.T < hits[i-1].T {
+			t.Errorf("%s: crossing %d at %v before %v", name, i, h.T, hits[i-1].T)
+		}
+	}
+}
+
+func TestCSGCrossings(t *testing.T) {
+	red, blue := Lambertian(RGB{1, 0, 0}), Lambertian(RGB{0, 0, 1})
+	// two spheres overlapping about the origin
+	a := &Sphere{Center: Vector{-.5, 0, 0}, Radius: 1, Mat: red}
+	b := &Sphere{Center: Vector{.5, 0, 0}, Radius: 1, Mat: blue}
+	r := Ray{Vector{-5, 0, 0}, Vector{1, 0, 0}}
+
+	checkCrossings(t, "union", &CSG{Operation: CSGUnion, A: a, B: b}, r,
+		[]crossing{{-1.5, -1}, {1.5, 1}})
+	checkCrossings(t, "lens", &CSG{Operation: CSGIntersection, A: a, B: b}, r,
+		[]crossing{{-.5, -1}, {.5, 1}})
+	// the surface of b that bounds the difference faces into b
+	checkCrossings(t, "difference", &CSG{Operation: CSGDifference, A: a, B: b}, r,
+		[]crossing{{-1.5, -1}, {-.5, 1}})
+	checkCrossings(t, "difference the other way", &CSG{Operation: CSGDifference, A: b, B: a}, r,
+		[]crossing{{.5, -1}, {1.5, 1}})
+	// a line missing one of the spheres
+	checkCrossings(t, "lens missed", &CSG{Operation: CSGIntersection, A: a, B: b}, Ray{Vector{-5, 0, 1.2}, Vector{1, 0, 0}}, nil)
+
+	// the lens keeps the material of the sphere each side comes from
+	lens := &CSG{Operation: CSGIntersection, A: a, B: b}
+	if _, hit := lens.Hit(r, 0, math.MaxFloat64); hit.Material != blue {
+		t.Errorf("lens: hit %v, want the material of b", hit.Material)
+	}
+	if _, hit := lens.Hit(Ray{Vector{5, 0, 0}, Vector{-1, 0, 0}}, 0, math.MaxFloat64); hit.Material != red {
+		t.Errorf("lens: hit %v from behind, want the material of a", hit.Material)
+	}
+	// unless it has one of its own
+	lens.Mat = Lambertian(RGB{0, 1, 0})
+	if _, hit := lens.Hit(r, 0, math.MaxFloat64); hit.Material != lens.Mat {
+		t.Errorf("lens: hit %v, want its own material", hit.Material)
+	}
+}
+
+func TestCSGHollowBox(t *testing.T) {
+	box := NewCuboid(Vector{-1, -1, -1}, Vector{1, 1, 1}, Lambertian(RGB{1, 1, 1}))
+	cavity := &Sphere{Radius: .8, Mat: Lambertian(RGB{.5, .5, .5})}
+	hollow := &CSG{Operation: CSGDifference, A: box, B: cavity}
+	r := Ray{Vector{-5, 0, 0}, Vector{1, 0, 0}}
+
+	checkCrossings(t, "hollow box", hollow, r,
+		[]crossing{{-1, -1}, {-.8, 1}, {.8, -1}, {1, 1}})
+	checkCrossings(t, "hollow box above the cavity", hollow, Ray{Vector{-5, .9, 0}, Vector{1, 0, 0}},
+		[]crossing{{-1, -1}, {1, 1}})
+
+	// a ray from inside the cavity meets its wall, facing back at it
+	ok, hit := hollow.Hit(Ray{Vector{}, Vector{1, 0, 0}}, RayEpsilon, math.MaxFloat64)
+	if !ok || math.Abs(hit.T-.8) > 1e-9 || hit.Normal.Normalize() != (Vector{-1, 0, 0}) || hit.Material != cavity.Mat {
+		t.Errorf("from inside: hit %v at %v with normal %v", ok, hit.T, hit.Normal)
+	}
+	// and rays stop at tMax
+	if ok, hit := hollow.Hit(r, RayEpsilon, 3); ok {
+		t.Errorf("hit at %v beyond tMax", hit.T)
+	}
+
+	// a ball in the cavity
+	ball := &Sphere{Radius: .3, Mat: Lambertian(RGB{1, 0, 0})}
+	nested := &CSG{Operation: CSGUnion, A: hollow, B: ball}
+	checkCrossings(t, "nested", nested, r,
+		[]crossing{{-1, -1}, {-.8, 1}, {-.3, -1}, {.3, 1}, {.8, -1}, {1, 1}})
+	// cutting the nested solid in half keeps both the shell and the ball
+	half := &CSG{Operation: CSGIntersection, A: nested, B: NewCuboid(Vector{0, -2, -2}, Vector{2, 2, 2}, nil)}
+	checkCrossings(t, "nested cut", half, r,
+		[]crossing{{0, -1}, {.3, 1}, {.8, -1}, {1, 1}})
+
+	tests := []struct {
+		p    Vector
+		want bool
+	}{
+		{Vector{}, true},
+		{Vector{.5, 0, 0}, false},
+		{Vector{.9, 0, 0}, true},
+		{Vector{.9, .9, .9}, true},
+		{Vector{1.5, 0, 0}, false},
+		{Vector{-.1, 0, 0}, true},
+	}
+	for _, test := range tests {
+		if got := contains(nested, test.p); got != test.want {
+			t.Errorf("nested contains %v: %v, want %v", test.p, got, test.want)
+		}
+		if got := contains(hollow, test.p); got != (test.want && test.p.Length() > .8) {
+			t.Errorf("hollow box contains %v: %v", test.p, got)
+		}
+	}
+}
+
+func TestTorusCrossings(t *testing.T) {
+	tr := &Torus{Axis: Vector{0, 1, 0}, MajorRadius: 2, MinorRadius: 1}
+	checkCrossings(t, "torus", tr, Ray{Vector{-5, 0, 0}, Vector{1, 0, 0}},
+		[]crossing{{-3, -1}, {-1, 1}, {1, -1}, {3, 1}})
+
+	// lines touching the surface have double roots, which rounding may split
+	// or lose; the crossings must still pair up
+	rays := []Ray{
+		{Vector{3, 0, -5}, Vector{0, 0, 1}},                         // the outer equator
+		{Vector{1, 0, -5}, Vector{0, 0, 1}},                         // the inner equator, from inside the tube
+		{Vector{-5, 1, 0}, Vector{1, 0, 0}},                         // the top, twice
+		{Vector{-5, 1, 1e-7}, Vector{1, 0, 0}},                      // just off it
+		{Vector{3 + 1e-9, -5, 0}, Vector{0, 1, 0}},                  // along the outside
+		{Vector{-5, 1 - 1e-12, 0}, Vector{1, 0, 1e-12}.Normalize()}, // nearly inside
+	}
+	for i, r := range rays {
+		hits := tr.Crossings(r)
+		if len(hits)%2 != 0 {
+			t.Errorf("ray %d: %d crossings", i, len(hits))
+		}
+		for _, h := range hits {
+			if math.IsNaN(h.T) || math.Abs(h.Point.Subtract(tr.Center).Length()) > 3+1e-6 {
+				t.Errorf("ray %d: crossing at %v", i, h.Point)
+			}
+		}
+		// a tangent line neither enters nor leaves the solid as a whole
+		if n := len(hits); n > 0 && hits[0].Normal.Dot(r.Direction) > 1e-6 {
+			t.Errorf("ray %d: leaves first", i)
+		}
+	}
+
+	for _, test := range []struct {
+		p    Vector
+		want bool
+	}{
+		{Vector{}, false},
+		{Vector{2, 0, 0}, true},
+		{Vector{0, .5, -2}, true},
+		{Vector{3.5, 0, 0}, false},
+		{Vector{2, 1.5, 0}, false},
+	} {
+		if got := contains(tr, test.p); got != test.want {
+			t.Errorf("torus contains %v: %v, want %v", test.p, got, test.want)
+		}
+	}
+}
@@ -63,3 +63,56 @@ func (c *Camera) RayAt(s, t float64, rnd *rand.Rand) Ray {
 	direction := c.lowerLeft.Add(horizontal).Add(vertical).Subtract(c.origin).Subtract(offset)
 	return Ray{origin, direction}
 }
+
+func (c *Camera) Position() Vector {
+	return c.origin
+}
+
+// Project finds where the line from the camera to p crosses the film, in the
+// coordinates RayAt takes. ok is false if it misses the film. The lens is
+// treated as a pinhole.
+func (c *Camera) Project(p Vector) (s, t float64, ok bool) {
+	d := p.Subtract(c.origin)
+	forward := c.w.MultiplyScalar(-1)
+	cos := d.Dot(forward)
+	if cos <= 0 {
+		return 0, 0, false
+	}
+	q := c.origin.Add(d.MultiplyScalar(c.focusDistance() / cos)).Subtract(c.lowerLeft)
+	s = q.Dot(c.horizontal) / c.horizontal.SquaredLength()
+	t = q.Dot(c.vertical) / c.vertical.SquaredLength()
+	return s, t, s >= 0 && s < 1 && t >= 0 && t < 1
+}
+
+// Importance is the importance the camera emits along direction, normalised
+// to integrate to one over the film for a pinhole camera.
+func (c *Camera) Importance(direction Vector) float64 {
+	d := direction.Normalize()
+	cos := d.Dot(c.w.MultiplyScalar(-1))
+	if _, _, ok := c.Project(c.origin.Add(d)); !ok {
+		return 0
+	}
+	return 1 / (c.filmArea() * cos * cos * cos * cos)
+}
+
+// Pdf is the solid angle density of camera rays along direction, for samples
+// spread uniformly over the film.
+func (c *Camera) Pdf(direction Vector) float64 {
+	d := direction.Normalize()
+	cos := d.Dot(c.w.MultiplyScalar(-1))
+	if _, _, ok := c.Project(c.origin.Add(d)); !ok {
+		return 0
+	}
+	return 1 / (c.filmArea() * cos * cos * cos)
+}
+
+func (c *Camera) focusDistance() float64 {
+	center := c.lowerLeft.Add(c.horizontal.MultiplyScalar(.5)).Add(c.vertical.MultiplyScalar(.5))
+	return center.Subtract(c.origin).Dot(c.w.MultiplyScalar(-1))
+}
+
+// filmArea is the area of the film scaled to unit distance from the camera.
+func (c *Camera) filmArea() float64 {
+	f := c.focusDistance()
+	return c.horizontal.Length() * c.vertical.Length() / (f * f)
+}
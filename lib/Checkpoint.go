@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+)
+
+const CheckpointVersion = 3
+
+// Checkpoint is the on-disk state of a render: the accumulated buffer, the
+// hash of the scene, camera, filter and integrator it was rendered with and
+// the sampler state needed to keep drawing fresh samples after a resume.
+type Checkpoint struct {
+	Version   int
+	SceneHash uint64
+	Seed      int64
+	Passes    int
+	W, H      int
+	Pixels    []Pixel
+	Features  []Feature
+}
+
+var ErrSceneChanged = errors.New("checkpoint was rendered from a different scene, camera, filter or integrator")
+
+// CheckpointHash folds the reconstruction filter, the integrator and its
+// options into the scene hash, since samples splatted through different
+// filters or estimated differently can't be mixed either.
+func CheckpointHash(sceneHash uint64, filter Filter, integrator string, o IntegratorOptions) uint64 {
+	h := fnv.New64a()
+	hashValue(h, sceneHash)
+	fmt.Fprintf(h, "%T%+v", filter, filter)
+	fmt.Fprintf(h, "%q%+v", integrator, o)
+	return h.Sum64()
+}
+
+// NewCheckpoint snapshots the buffer, with hash from CheckpointHash.
+func NewCheckpoint(buf *Buffer, hash uint64, seed int64, passes int) *Checkpoint {
+	snapshot := buf.Copy()
+	return &Checkpoint{
+		Version:   CheckpointVersion,
+		SceneHash: hash,
+		Seed:      seed,
+		Passes:    passes,
+		W:         snapshot.W,
+		H:         snapshot.H,
+		Pixels:    snapshot.Pixels,
+		Features:  snapshot.Features,
+	}
+}
+
+// Save writes the checkpoint next to path and renames it into place, so an
+// interrupted save never destroys the previous checkpoint.
+func (c *Checkpoint) Save(path string) (err error) {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return
+	}
+	if err = gob.NewEncoder(file).Encode(c); err != nil {
+		file.Close()
+		return
+	}
+	if err = file.Close(); err != nil {
+		return
+	}
+	return os.Rename(tmp, path)
+}
+
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	c := &Checkpoint{}
+	if err := gob.NewDecoder(file).Decode(c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if c.Version != CheckpointVersion {
+		return nil, fmt.Errorf("%s: unsupported checkpoint version %d", path, c.Version)
+	}
+	if len(c.Pixels) != c.W*c.H || len(c.Features) != c.W*c.H {
+		return nil, fmt.Errorf("%s: corrupt checkpoint", path)
+	}
+	return c, nil
+}
+
+// Check verifies that the checkpoint can be resumed with the given
+// CheckpointHash and image size.
+func (c *Checkpoint) Check(hash uint64, w, h int) error {
+	if c.SceneHash != hash {
+		return ErrSceneChanged
+	}
+	if c.W != w || c.H != h {
+		return fmt.Errorf("checkpoint is %dx%d, image is %dx%d", c.W, c.H, w, h)
+	}
+	return nil
+}
+
+// Merge adds the samples of another checkpoint of the same scene. All merged
+// checkpoints must have been rendered with different seeds, otherwise their
+// samples are not independent and the merged variance would be wrong. The
+// result keeps only the first seed, so callers merging several checkpoints
+// have to compare the seeds of all of them.
+func (c *Checkpoint) Merge(o *Checkpoint) error {
+	if c.SceneHash != o.SceneHash {
+		return errors.New("checkpoints were rendered from different scenes, cameras, filters or integrators")
+	}
+	if c.W != o.W || c.H != o.H {
+		return fmt.Errorf("cannot merge a %dx%d checkpoint into a %dx%d one", o.W, o.H, c.W, c.H)
+	}
+	if c.Seed == o.Seed {
+		return fmt.Errorf("checkpoints share the seed %d", c.Seed)
+	}
+	for i := range c.Pixels {
+		c.Pixels[i].Merge(o.Pixels[i])
+		c.Features[i].Merge(o.Features[i])
+	}
+	c.Passes += o.Passes
+	return nil
+}
+
+func (c *Checkpoint) Buffer() *Buffer {
+	buf := NewBuffer(c.W, c.H)
+	copy(buf.Pixels, c.Pixels)
+	copy(buf.Features, c.Features)
+	return buf
+}
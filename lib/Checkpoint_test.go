@@ -0,0 +1,41 @@
+package lib
+
+import "testing"
+
+func TestCheckpointHash(t *testing.T) {
+	scene := &Scene{}
+	scene.AddAll([]Hittable{
+		&Quad{Corner: Vector{0, 0, 0}, U: Vector{0, 0, 5}, V: Vector{5, 0, 0}, Mat: Lambertian(RGB{.5, .5, .5})},
+		&Sphere{Center: Vector{1, 1, 1}, Radius: 1, Mat: Emissive(RGB{1, 1, 1}, 6)},
+	})
+	scene.AddLight(&PointLight{Position: Vector{0, 5, 0}, Intensity: RGB{1, 1, 1}})
+	scene.AddLight(&SpotLight{Position: Vector{0, 5, 0}, Direction: Vector{0, -1, 0}, Intensity: RGB{1, 1, 1}, Angle: .5, Falloff: .1})
+	scene.AddLight(&DirectionalLight{Direction: Vector{0, -1, 0}, Irradiance: RGB{1, 1, 1}})
+	scene.Background = NewSky(.5, 1, 3, 1)
+	cam := NewCamera(Vector{0, 1, -5}, Vector{0, 1, 0}, 45, 1, 0)
+	sceneHash := scene.Hash(cam)
+
+	o := IntegratorOptions{MaxDepth: 5, MaxSpecularDepth: 10, MaxTransmissionDepth: 10, ShadowRays: 4}
+	base := CheckpointHash(sceneHash, BoxFilter{}, "path", o)
+	if CheckpointHash(sceneHash, BoxFilter{}, "path", o) != base {
+		t.Fatal("the same settings hash differently")
+	}
+	deeper, moreRays := o, o
+	deeper.MaxDepth++
+	moreRays.ShadowRays++
+	tests := []struct {
+		name string
+		hash uint64
+	}{
+		{"scene", CheckpointHash(sceneHash+1, BoxFilter{}, "path", o)},
+		{"filter", CheckpointHash(sceneHash, GaussianFilter{Alpha: 2}, "path", o)},
+		{"integrator", CheckpointHash(sceneHash, BoxFilter{}, "normals", o)},
+		{"depth", CheckpointHash(sceneHash, BoxFilter{}, "path", deeper)},
+		{"shadow rays", CheckpointHash(sceneHash, BoxFilter{}, "path", moreRays)},
+	}
+	for _, test := range tests {
+		if test.hash == base {
+			t.Errorf("changing the %s keeps the checkpoint hash", test.name)
+		}
+	}
+}
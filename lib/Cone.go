@@ -0,0 +1,134 @@
+package lib
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Cone has its apex at Base + Axis and is closed by a disc of the given radius
+// around Base.
+type Cone struct {
+	Base, Axis Vector
+	Radius     float64
+	Mat        *Material
+}
+
+func (c *Cone) Material() *Material {
+	return c.Mat
+}
+
+// Hit gives the angle around the axis as U. V is the height on the side, from
+// 0 at the base to 1 at the apex, and the distance from the axis on the base.
+func (c *Cone) Hit(r Ray, tMin, tMax float64) (bool, Hit) {
+	h := c.Axis.Length()
+	a := c.Axis.DivideScalar(h)
+	k := c.Radius / h
+	o := r.Origin.Subtract(c.Base)
+	oy, dy := o.Dot(a), r.Direction.Dot(a)
+	op := o.Subtract(a.MultiplyScalar(oy))
+	dp := r.Direction.Subtract(a.MultiplyScalar(dy))
+
+	hit := Hit{T: tMax, Ray: r, Material: c.Mat}
+	found := false
+	// the side, where the distance from the axis is k (h - y)
+	qa := dp.SquaredLength() - k*k*dy*dy
+	qb := op.Dot(dp) + k*k*(h-oy)*dy
+	qc := op.SquaredLength() - k*k*(h-oy)*(h-oy)
+	var roots []float64
+	if math.Abs(qa) < EPS {
+		if qb != 0 {
+			roots = []float64{-qc / (2 * qb)}
+		}
+	} else if disc := qb*qb - qa*qc; disc >= 0 {
+		sqrtDisc := math.Sqrt(disc)
+		t1, t2 := (-qb-sqrtDisc)/qa, (-qb+sqrtDisc)/qa
+		if t1 > t2 {
+			t1, t2 = t2, t1
+		}
+		roots = []float64{t1, t2}
+	}
+	for _, t := range roots {
+		y := oy + t*dy
+		if t > tMin && t < hit.T && y >= 0 && y <= h {
+			q := op.Add(dp.MultiplyScalar(t))
+			n := a
+			if l := q.Length(); l > 0 {
+				radial := q.DivideScalar(l)
+				n = radial.Add(a.MultiplyScalar(k)).Normalize()
+				hit.UV = Vector{polarUV(radial, a, 1).X, y / h, 0}
+			}
+			hit.T, hit.Normal = t, n
+			found = true
+			break
+		}
+	}
+	// the base
+	if math.Abs(dy) > EPS {
+		t := -oy / dy
+		q := op.Add(dp.MultiplyScalar(t))
+		if t > tMin && t < hit.T && q.SquaredLength() <= c.Radius*c.Radius {
+			hit.T, hit.Normal, hit.UV = t, a.MultiplyScalar(-1), polarUV(q, a, c.Radius)
+			found = true
+		}
+	}
+	if !found {
+		return false, Hit{}
+	}
+	hit.Point = r.Step(hit.T)
+	return true, hit
+}
+
+func (c *Cone) BoundingBox() Box {
+	e := circleExtent(c.Axis.Normalize(), c.Radius)
+	box := Box{c.Base.Subtract(e), c.Base.Add(e)}
+	apex := c.Base.Add(c.Axis)
+	box.Extend(Box{apex, apex})
+	return box
+}
+
+func (c *Cone) MidPoint() Vector {
+	return c.Base.Add(c.Axis.MultiplyScalar(.5))
+}
+
+func (c *Cone) RandomPoint(rnd *rand.Rand, point Vector) Vector {
+	p, _ := c.SamplePoint(rnd)
+	return p
+}
+
+func (c *Cone) slant() float64 {
+	return math.Hypot(c.Radius, c.Axis.Length())
+}
+
+func (c *Cone) SurfaceArea() float64 {
+	return math.Pi * c.Radius * (c.slant() + c.Radius)
+}
+
+func (c *Cone) SamplePoint(rnd *rand.Rand) (Vector, Vector) {
+	h := c.Axis.Length()
+	a := c.Axis.DivideScalar(h)
+	s, t := a.Basis()
+	phi := 2 * math.Pi * rnd.Float64()
+	radial := s.MultiplyScalar(math.Cos(phi)).Add(t.MultiplyScalar(math.Sin(phi)))
+	// the side has an area of pi r l against pi r r for the base
+	l := c.slant()
+	if rnd.Float64()*(l+c.Radius) < l {
+		// the side widens linearly from the apex, so the distance from it
+		// goes with the square root
+		f := math.Sqrt(rnd.Float64())
+		p := c.Base.Add(c.Axis.MultiplyScalar(1 - f)).Add(radial.MultiplyScalar(c.Radius * f))
+		return p, radial.Add(a.MultiplyScalar(c.Radius / h)).Normalize()
+	}
+	return c.Base.Add(radial.MultiplyScalar(c.Radius * math.Sqrt(rnd.Float64()))), a.MultiplyScalar(-1)
+}
+
+func (c *Cone) SampleFrom(p Vector, rnd *rand.Rand) (Vector, Vector, float64) {
+	return sampleByArea(c, p, rnd)
+}
+
+func (c *Cone) PdfFrom(p, direction Vector) float64 {
+	return pdfByArea(c, p, direction)
+}
+
+func (c *Cone) Crossings(r Ray) []Hit {
+	return convexCrossings(c, r)
+}
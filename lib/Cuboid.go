@@ -0,0 +1,145 @@
+package lib
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Cuboid is the box spanned by the edges U, V and W from Corner, which may
+// point any way to turn it. Its normals point outwards.
+type Cuboid struct {
+	Corner, U, V, W Vector
+	Mat             *Material
+}
+
+// NewCuboid makes the axis-aligned box from min to max.
+func NewCuboid(min, max Vector, mat *Material) *Cuboid {
+	d := max.Subtract(min)
+	return &Cuboid{Corner: min, U: Vector{d.X, 0, 0}, V: Vector{0, d.Y, 0}, W: Vector{0, 0, d.Z}, Mat: mat}
+}
+
+func (c *Cuboid) Material() *Material {
+	return c.Mat
+}
+
+// duals are the vectors whose dot products with a point relative to Corner
+// give its coordinates along U, V and W. Each is the outward normal of the
+// face at coordinate 1.
+func (c *Cuboid) duals() [3]Vector {
+	det := c.U.Dot(c.V.Cross(c.W))
+	return [3]Vector{
+		c.V.Cross(c.W).DivideScalar(det),
+		c.W.Cross(c.U).DivideScalar(det),
+		c.U.Cross(c.V).DivideScalar(det),
+	}
+}
+
+// Hit gives the coordinates along the two other edges of the face that was
+// hit as UV.
+func (c *Cuboid) Hit(r Ray, tMin, tMax float64) (bool, Hit) {
+	duals := c.duals()
+	o := r.Origin.Subtract(c.Corner)
+	near, far := math.Inf(-1), math.Inf(1)
+	nearAxis, farAxis := 0, 0
+	var nearSign, farSign float64
+	for i, d := range duals {
+		od, dd := d.Dot(o), d.Dot(r.Direction)
+		if math.Abs(dd) < EPS {
+			if od < 0 || od > 1 {
+				return false, Hit{}
+			}
+			continue
+		}
+		t0, t1 := -od/dd, (1-od)/dd
+		sign := -1.0
+		if t0 > t1 {
+			t0, t1 = t1, t0
+			sign = 1
+		}
+		if t0 > near {
+			near, nearAxis, nearSign = t0, i, sign
+		}
+		if t1 < far {
+			far, farAxis, farSign = t1, i, -sign
+		}
+	}
+	if near > far {
+		return false, Hit{}
+	}
+	t, axis, sign := near, nearAxis, nearSign
+	if t < tMin {
+		// inside the box
+		t, axis, sign = far, farAxis, farSign
+	}
+	if t < tMin || t > tMax {
+		return false, Hit{}
+	}
+	p := r.Step(t)
+	d := p.Subtract(c.Corner)
+	uv := Vector{d.Dot(duals[(axis+1)%3]), d.Dot(duals[(axis+2)%3]), 0}
+	return true, Hit{T: t, Point: p, Normal: duals[axis].Normalize().MultiplyScalar(sign), UV: uv, Ray: r, Material: c.Mat}
+}
+
+func (c *Cuboid) BoundingBox() Box {
+	box := Box{c.Corner, c.Corner}
+	for _, p := range []Vector{c.U, c.V, c.W, c.U.Add(c.V), c.V.Add(c.W), c.W.Add(c.U), c.U.Add(c.V).Add(c.W)} {
+		p = c.Corner.Add(p)
+		box.Extend(Box{p, p})
+	}
+	return box
+}
+
+func (c *Cuboid) MidPoint() Vector {
+	return c.Corner.Add(c.U.Add(c.V).Add(c.W).MultiplyScalar(.5))
+}
+
+func (c *Cuboid) RandomPoint(rnd *rand.Rand, point Vector) Vector {
+	p, _ := c.SamplePoint(rnd)
+	return p
+}
+
+// faces are the edges of the faces at coordinate 0 of U, V and W, and their
+// areas.
+func (c *Cuboid) faces() ([3][2]Vector, [3]float64) {
+	edges := [3][2]Vector{{c.V, c.W}, {c.W, c.U}, {c.U, c.V}}
+	var areas [3]float64
+	for i, e := range edges {
+		areas[i] = e[0].Cross(e[1]).Length()
+	}
+	return edges, areas
+}
+
+func (c *Cuboid) SurfaceArea() float64 {
+	_, areas := c.faces()
+	return 2 * (areas[0] + areas[1] + areas[2])
+}
+
+func (c *Cuboid) SamplePoint(rnd *rand.Rand) (Vector, Vector) {
+	edges, areas := c.faces()
+	u := rnd.Float64() * (areas[0] + areas[1] + areas[2])
+	i := 0
+	for i < 2 && u >= areas[i] {
+		u -= areas[i]
+		i++
+	}
+	duals := c.duals()
+	p := c.Corner.Add(edges[i][0].MultiplyScalar(rnd.Float64())).Add(edges[i][1].MultiplyScalar(rnd.Float64()))
+	n := duals[i].Normalize()
+	// either the face at 0 or the one opposite
+	if rnd.Float64() < .5 {
+		return p, n.MultiplyScalar(-1)
+	}
+	return p.Add([3]Vector{c.U, c.V, c.W}[i]), n
+}
+
+func (c *Cuboid) SampleFrom(p Vector, rnd *rand.Rand) (Vector, Vector, float64) {
+	return sampleByArea(c, p, rnd)
+}
+
+func (c *Cuboid) PdfFrom(p, direction Vector) float64 {
+	return pdfByArea(c, p, direction)
+}
+
+func (c *Cuboid) Crossings(r Ray) []Hit {
+	return convexCrossings(c, r)
+}
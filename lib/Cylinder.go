@@ -0,0 +1,117 @@
+package lib
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Cylinder is closed by discs at both ends, with the centre of one at Base and
+// the other at Base + Axis.
+type Cylinder struct {
+	Base, Axis Vector
+	Radius     float64
+	Mat        *Material
+}
+
+func (c *Cylinder) Material() *Material {
+	return c.Mat
+}
+
+// Hit gives the angle around the axis as U. V is the height on the side, from
+// 0 to 1, and the distance from the axis on the caps.
+func (c *Cylinder) Hit(r Ray, tMin, tMax float64) (bool, Hit) {
+	h := c.Axis.Length()
+	a := c.Axis.DivideScalar(h)
+	o := r.Origin.Subtract(c.Base)
+	oy, dy := o.Dot(a), r.Direction.Dot(a)
+	op := o.Subtract(a.MultiplyScalar(oy))
+	dp := r.Direction.Subtract(a.MultiplyScalar(dy))
+
+	hit := Hit{T: tMax, Ray: r, Material: c.Mat}
+	found := false
+	// the side
+	qa := dp.SquaredLength()
+	qb := op.Dot(dp)
+	qc := op.SquaredLength() - c.Radius*c.Radius
+	if disc := qb*qb - qa*qc; qa > EPS && disc > 0 {
+		sqrtDisc := math.Sqrt(disc)
+		for _, t := range [2]float64{(-qb - sqrtDisc) / qa, (-qb + sqrtDisc) / qa} {
+			y := oy + t*dy
+			if t > tMin && t < hit.T && y >= 0 && y <= h {
+				radial := op.Add(dp.MultiplyScalar(t)).DivideScalar(c.Radius)
+				hit.T, hit.Normal = t, radial
+				hit.UV = Vector{polarUV(radial, a, 1).X, y / h, 0}
+				found = true
+				break
+			}
+		}
+	}
+	// the caps
+	if math.Abs(dy) > EPS {
+		for _, y := range [2]float64{0, h} {
+			t := (y - oy) / dy
+			q := op.Add(dp.MultiplyScalar(t))
+			if t > tMin && t < hit.T && q.SquaredLength() <= c.Radius*c.Radius {
+				n := a
+				if y == 0 {
+					n = a.MultiplyScalar(-1)
+				}
+				hit.T, hit.Normal, hit.UV = t, n, polarUV(q, a, c.Radius)
+				found = true
+			}
+		}
+	}
+	if !found {
+		return false, Hit{}
+	}
+	hit.Point = r.Step(hit.T)
+	return true, hit
+}
+
+func (c *Cylinder) BoundingBox() Box {
+	e := circleExtent(c.Axis.Normalize(), c.Radius)
+	top := c.Base.Add(c.Axis)
+	return Box{c.Base.Min(top).Subtract(e), c.Base.Max(top).Add(e)}
+}
+
+func (c *Cylinder) MidPoint() Vector {
+	return c.Base.Add(c.Axis.MultiplyScalar(.5))
+}
+
+func (c *Cylinder) RandomPoint(rnd *rand.Rand, point Vector) Vector {
+	p, _ := c.SamplePoint(rnd)
+	return p
+}
+
+func (c *Cylinder) SurfaceArea() float64 {
+	return 2 * math.Pi * c.Radius * (c.Axis.Length() + c.Radius)
+}
+
+func (c *Cylinder) SamplePoint(rnd *rand.Rand) (Vector, Vector) {
+	h := c.Axis.Length()
+	a := c.Axis.DivideScalar(h)
+	s, t := a.Basis()
+	phi := 2 * math.Pi * rnd.Float64()
+	radial := s.MultiplyScalar(math.Cos(phi)).Add(t.MultiplyScalar(math.Sin(phi)))
+	// the side has an area of 2 pi r h against 2 pi r r for both caps
+	if u := rnd.Float64() * (h + c.Radius); u < h {
+		return c.Base.Add(a.MultiplyScalar(u)).Add(radial.MultiplyScalar(c.Radius)), radial
+	}
+	p := c.Base.Add(radial.MultiplyScalar(c.Radius * math.Sqrt(rnd.Float64())))
+	if rnd.Float64() < .5 {
+		return p, a.MultiplyScalar(-1)
+	}
+	return p.Add(c.Axis), a
+}
+
+func (c *Cylinder) SampleFrom(p Vector, rnd *rand.Rand) (Vector, Vector, float64) {
+	return sampleByArea(c, p, rnd)
+}
+
+func (c *Cylinder) PdfFrom(p, direction Vector) float64 {
+	return pdfByArea(c, p, direction)
+}
+
+func (c *Cylinder) Crossings(r Ray) []Hit {
+	return convexCrossings(c, r)
+}
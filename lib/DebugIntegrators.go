@@ -0,0 +1,169 @@
+package lib
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+)
+
+// The integrators in this file don't simulate light, they show properties of
+// the scene and of the KD-tree to find problems with either.
+
+// AmbientOcclusion shades surfaces by the fraction of the hemisphere above
+// them that is open up to Distance.
+type AmbientOcclusion struct {
+	Samples  int
+	Distance float64
+}
+
+func (a *AmbientOcclusion) Li(r Ray, ctx *SampleContext) RGB {
+	ok, hit := ctx.Scene.KDTree.Hit(r, RayEpsilon, math.MaxFloat64, ctx.Intersections)
+	if !ok {
+		return RGB{}
+	}
+	n := facing(hit)
+	var open int
+	for i := 0; i < a.Samples; i++ {
+		d := CosineHemisphere(n, ctx.Rand.Float64(), ctx.Rand.Float64())
+		if !ctx.Scene.KDTree.Intersects(Ray{hit.Point, d}, RayEpsilon, a.Distance, ctx.Intersections) {
+			open++
+		}
+	}
+	v := float64(open) / float64(a.Samples)
+	return RGB{v, v, v}
+}
+
+// Normals shows the shading normals, with each component mapped from [-1, 1]
+// to [0, 1]. Normals facing away from the camera are not flipped, so inverted
+// faces stand out.
+type Normals struct{}
+
+func (Normals) Li(r Ray, ctx *SampleContext) RGB {
+	ok, hit := ctx.Scene.KDTree.Hit(r, RayEpsilon, math.MaxFloat64, ctx.Intersections)
+	if !ok {
+		return RGB{}
+	}
+	n := hit.Normal.Normalize()
+	return RGB{n.X + 1, n.Y + 1, n.Z + 1}.MultiplyScalar(.5)
+}
+
+// Depth shows the distance to the first hit, fading from white to black over
+// roughly Scale.
+type Depth struct {
+	Scale float64
+}
+
+func (d *Depth) Li(r Ray, ctx *SampleContext) RGB {
+	ok, hit := ctx.Scene.KDTree.Hit(r, RayEpsilon, math.MaxFloat64, ctx.Intersections)
+	if !ok {
+		return RGB{}
+	}
+	v := math.Exp(-hit.T * r.Direction.Length() / d.Scale)
+	return RGB{v, v, v}
+}
+
+// PrimitiveID gives every primitive a colour of its own, shaded by the angle
+// it is seen at.
+type PrimitiveID struct{}
+
+func (PrimitiveID) Li(r Ray, ctx *SampleContext) RGB {
+	ok, hit := ctx.Scene.KDTree.Hit(r, RayEpsilon, math.MaxFloat64, ctx.Intersections)
+	if !ok || hit.Object == nil {
+		return RGB{}
+	}
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, hit.Object.BoundingBox())
+	binary.Write(h, binary.LittleEndian, hit.Object.MidPoint())
+	id := h.Sum64()
+	c := RGB{float64(id&0xff) / 255, float64(id>>8&0xff) / 255, float64(id>>16&0xff) / 255}
+	return c.MultiplyScalar(.2 + .8*shading(hit))
+}
+
+// KDCost shows the number of primitives tested for the camera ray as a
+// heatmap running from blue for none to red for Max or more.
+type KDCost struct {
+	Max int
+}
+
+func (k *KDCost) Li(r Ray, ctx *SampleContext) RGB {
+	var tests int
+	ctx.Scene.KDTree.Hit(r, RayEpsilon, math.MaxFloat64, &tests)
+	*ctx.Intersections += tests
+	return heat(float64(tests) / float64(k.Max))
+}
+
+// Wireframe draws the edges of triangles and quads over surfaces shaded by
+// the angle they are seen at. Width is the line width as a fraction of the
+// primitive.
+type Wireframe struct {
+	Width float64
+}
+
+func (w *Wireframe) Li(r Ray, ctx *SampleContext) RGB {
+	ok, hit := ctx.Scene.KDTree.Hit(r, RayEpsilon, math.MaxFloat64, ctx.Intersections)
+	if !ok {
+		return RGB{}
+	}
+	v := .2 + .6*shading(hit)
+	if edgeDistance(hit) < w.Width {
+		return RGB{1, .8, 0}
+	}
+	return RGB{v, v, v}
+}
+
+// edgeDistance is how close the hit point lies to an edge of the primitive,
+// relative to its size, or 1 for primitives without edges.
+func edgeDistance(hit Hit) float64 {
+	if t, ok := hit.Object.(MeshTriangle); ok {
+		tri := t.triangle()
+		hit.Object = &tri
+	}
+	switch o := hit.Object.(type) {
+	case *Triangle:
+		n := o.V2.Subtract(o.V1).Cross(o.V3.Subtract(o.V1))
+		area := n.Length()
+		if area == 0 {
+			return 1
+		}
+		n = n.DivideScalar(area)
+		b1 := o.V3.Subtract(o.V2).Cross(hit.Point.Subtract(o.V2)).Dot(n) / area
+		b2 := o.V1.Subtract(o.V3).Cross(hit.Point.Subtract(o.V3)).Dot(n) / area
+		return math.Min(math.Min(b1, b2), 1-b1-b2)
+	case *Quad:
+		n := o.U.Cross(o.V)
+		w := n.DivideScalar(n.SquaredLength())
+		d := hit.Point.Subtract(o.Corner)
+		alpha := w.Dot(d.Cross(o.V))
+		beta := w.Dot(o.U.Cross(d))
+		return math.Min(math.Min(alpha, 1-alpha), math.Min(beta, 1-beta))
+	}
+	return 1
+}
+
+// facing is the normal at hit turned towards the ray.
+func facing(hit Hit) Vector {
+	n := hit.Normal.Normalize()
+	if n.Dot(hit.Ray.Direction) > 0 {
+		n = n.MultiplyScalar(-1)
+	}
+	return n
+}
+
+// shading is the cosine between the surface and the ray.
+func shading(hit Hit) float64 {
+	return math.Abs(hit.Normal.Normalize().Dot(hit.Ray.Direction.Normalize()))
+}
+
+// heat maps v in [0, 1] to blue, cyan, green, yellow and red.
+func heat(v float64) RGB {
+	v = math.Max(0, math.Min(1, v)) * 4
+	switch {
+	case v < 1:
+		return RGB{0, v, 1}
+	case v < 2:
+		return RGB{0, 1, 2 - v}
+	case v < 3:
+		return RGB{v - 2, 1, 0}
+	}
+	return RGB{1, 4 - v, 0}
+}
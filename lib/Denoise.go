@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"math"
+	"runtime"
+	"sync"
+)
+
+// DenoiseOptions controls the joint non-local means filter. Colour distances
+// between patches are normalised by the per-pixel variance of the mean, so
+// noisy pixels are smoothed more than converged ones, while the albedo and
+// normal features keep edges and textures from bleeding into each other.
+type DenoiseOptions struct {
+	Radius      int     // half size of the search window
+	PatchRadius int     // half size of the compared patches
+	K           float64 // colour sensitivity, larger values blur more
+	AlbedoSigma float64
+	NormalSigma float64
+}
+
+var DefaultDenoiseOptions = DenoiseOptions{
+	Radius:      7,
+	PatchRadius: 1,
+	K:           .45,
+	AlbedoSigma: .1,
+	NormalSigma: .25,
+}
+
+// Denoise returns a copy of the buffer with the pixel colours filtered. The
+// sample counts and variances of the copy are left untouched so the buffer can
+// still be inspected through the other channels.
+func (b *Buffer) Denoise(opts DenoiseOptions) *Buffer {
+	result := b.Copy()
+	n := b.W * b.H
+	colors := make([]RGB, n)
+	variances := make([]RGB, n)
+	for i := range b.Pixels {
+		p := &b.Pixels[i]
+		colors[i] = p.Color()
+		variances[i] = p.VarianceOfMean()
+	}
+
+	rows := make(chan int, b.H)
+	for y := 0; y < b.H; y++ {
+		rows <- y
+	}
+	close(rows)
+
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for y := range rows {
+				for x := 0; x < b.W; x++ {
+					result.Pixels[y*b.W+x].SetColor(b.denoisePixel(x, y, colors, variances, opts))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return result
+}
+
+func (b *Buffer) denoisePixel(x, y int, colors, variances []RGB, opts DenoiseOptions) RGB {
+	p := y*b.W + x
+	fp := b.Features[p]
+	var sum RGB
+	var total float64
+	for dy := -opts.Radius; dy <= opts.Radius; dy++ {
+		for dx := -opts.Radius; dx <= opts.Radius; dx++ {
+			qx, qy := b.clamp(x+dx, y+dy)
+			q := qy*b.W + qx
+
+			// colour distance averaged over the patch
+			var d float64
+			var count int
+			for py := -opts.PatchRadius; py <= opts.PatchRadius; py++ {
+				for px := -opts.PatchRadius; px <= opts.PatchRadius; px++ {
+					ax, ay := b.clamp(x+px, y+py)
+					bx, by := b.clamp(qx+px, qy+py)
+					i := ay*b.W + ax
+					j := by*b.W + bx
+					d += patchDistance(colors[i].R, colors[j].R, variances[i].R, variances[j].R, opts.K)
+					d += patchDistance(colors[i].G, colors[j].G, variances[i].G, variances[j].G, opts.K)
+					d += patchDistance(colors[i].B, colors[j].B, variances[i].B, variances[j].B, opts.K)
+					count += 3
+				}
+			}
+			w := math.Exp(-math.Max(0, d/float64(count)))
+
+			// feature distance
+			fq := b.Features[q]
+			if fp.Samples > 0 && fq.Samples > 0 {
+				da := fp.Albedo.Sub(fq.Albedo)
+				dn := fp.Normal.Subtract(fq.Normal)
+				w *= math.Exp(-(da.R*da.R+da.G*da.G+da.B*da.B)/(opts.AlbedoSigma*opts.AlbedoSigma) -
+					dn.SquaredLength()/(opts.NormalSigma*opts.NormalSigma))
+			}
+
+			sum = sum.Add(colors[q].MultiplyScalar(w))
+			total += w
+		}
+	}
+	if total == 0 {
+		return colors[p]
+	}
+	return sum.DivScalar(total)
+}
+
+func (b *Buffer) clamp(x, y int) (int, int) {
+	if x < 0 {
+		x = 0
+	} else if x >= b.W {
+		x = b.W - 1
+	}
+	if y < 0 {
+		y = 0
+	} else if y >= b.H {
+		y = b.H - 1
+	}
+	return x, y
+}
+
+func patchDistance(a, b, varA, varB, k float64) float64 {
+	d := a - b
+	return (d*d - (varA + math.Min(varA, varB))) / (1e-10 + k*k*(varA+varB))
+}
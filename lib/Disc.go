@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"math"
+	"math/rand"
+)
+
+type Disc struct {
+	Center, Normal Vector
+	Radius         float64
+	Mat            *Material
+}
+
+func (d *Disc) Material() *Material {
+	return d.Mat
+}
+
+func (d *Disc) Hit(r Ray, tMin, tMax float64) (bool, Hit) {
+	n := d.Normal.Normalize()
+	denom := n.Dot(r.Direction)
+	if math.Abs(denom) < EPS {
+		return false, Hit{}
+	}
+	t := n.Dot(d.Center.Subtract(r.Origin)) / denom
+	if t < tMin || t > tMax {
+		return false, Hit{}
+	}
+	p := r.Step(t)
+	q := p.Subtract(d.Center)
+	if q.SquaredLength() > d.Radius*d.Radius {
+		return false, Hit{}
+	}
+	return true, Hit{T: t, Point: p, Normal: n, UV: polarUV(q, n, d.Radius), Ray: r, Material: d.Mat}
+}
+
+func (d *Disc) BoundingBox() Box {
+	e := circleExtent(d.Normal.Normalize(), d.Radius).AddScalar(RayEpsilon)
+	return Box{d.Center.Subtract(e), d.Center.Add(e)}
+}
+
+// circleExtent is how far a circle around the unit normal n reaches along each
+// axis.
+func circleExtent(n Vector, radius float64) Vector {
+	return Vector{
+		radius * math.Sqrt(math.Max(0, 1-n.X*n.X)),
+		radius * math.Sqrt(math.Max(0, 1-n.Y*n.Y)),
+		radius * math.Sqrt(math.Max(0, 1-n.Z*n.Z)),
+	}
+}
+
+// polarUV maps q, relative to the center of a circle around the unit normal n,
+// to its angle around n as U and its distance from the center as V, both
+// scaled to [0, 1].
+func polarUV(q, n Vector, radius float64) Vector {
+	s, t := n.Basis()
+	phi := math.Atan2(q.Dot(t), q.Dot(s))
+	if phi < 0 {
+		phi += 2 * math.Pi
+	}
+	q = q.Subtract(n.MultiplyScalar(q.Dot(n)))
+	return Vector{phi / (2 * math.Pi), q.Length() / radius, 0}
+}
+
+func (d *Disc) MidPoint() Vector {
+	return d.Center
+}
+
+func (d *Disc) RandomPoint(rnd *rand.Rand, point Vector) Vector {
+	p, _ := d.SamplePoint(rnd)
+	return p
+}
+
+func (d *Disc) SurfaceArea() float64 {
+	return math.Pi * d.Radius * d.Radius
+}
+
+func (d *Disc) SamplePoint(rnd *rand.Rand) (Vector, Vector) {
+	n := d.Normal.Normalize()
+	s, t := n.Basis()
+	r := d.Radius * math.Sqrt(rnd.Float64())
+	phi := 2 * math.Pi * rnd.Float64()
+	p := d.Center.Add(s.MultiplyScalar(r * math.Cos(phi))).Add(t.MultiplyScalar(r * math.Sin(phi)))
+	return p, n
+}
+
+func (d *Disc) SampleFrom(p Vector, rnd *rand.Rand) (Vector, Vector, float64) {
+	return sampleByArea(d, p, rnd)
+}
+
+func (d *Disc) PdfFrom(p, direction Vector) float64 {
+	return pdfByArea(d, p, direction)
+}
@@ -0,0 +1,194 @@
+package lib
+
+import (
+	"sort"
+)
+
+// Distribution1D is a piecewise constant distribution over [0, 1) proportional
+// to Func, sampled by inverting its cumulative distribution.
+type Distribution1D struct {
+	Func     []float64
+	CDF      []float64
+	Integral float64
+}
+
+func NewDistribution1D(f []float64) *Distribution1D {
+	n := len(f)
+	d := &Distribution1D{Func: append([]float64(nil), f...), CDF: make([]float64, n+1)}
+	for i := 1; i <= n; i++ {
+		d.CDF[i] = d.CDF[i-1] + d.Func[i-1]/float64(n)
+	}
+	d.Integral = d.CDF[n]
+	if d.Integral == 0 {
+		for i := 1; i <= n; i++ {
+			d.CDF[i] = float64(i) / float64(n)
+		}
+	} else {
+		for i := 1; i <= n; i++ {
+			d.CDF[i] /= d.Integral
+		}
+	}
+	return d
+}
+
+func (d *Distribution1D) Count() int {
+	return len(d.Func)
+}
+
+func (d *Distribution1D) offset(u float64) int {
+	i := sort.Search(len(d.CDF), func(i int) bool { return d.CDF[i] > u }) - 1
+	if i < 0 {
+		return 0
+	}
+	if i > len(d.Func)-1 {
+		return len(d.Func) - 1
+	}
+	return i
+}
+
+// SampleContinuous maps u in [0, 1) to a point in [0, 1) together with its
+// density and the index of the segment it lies in.
+func (d *Distribution1D) SampleContinuous(u float64) (x, pdf float64, offset int) {
+	offset = d.offset(u)
+	du := u - d.CDF[offset]
+	if w := d.CDF[offset+1] - d.CDF[offset]; w > 0 {
+		du /= w
+	}
+	if d.Integral > 0 {
+		pdf = d.Func[offset] / d.Integral
+	} else {
+		pdf = 1
+	}
+	x = (float64(offset) + du) / float64(d.Count())
+	return
+}
+
+// SampleDiscrete picks a segment with probability proportional to its value.
+func (d *Distribution1D) SampleDiscrete(u float64) (offset int, pmf float64) {
+	offset = d.offset(u)
+	return offset, d.DiscretePdf(offset)
+}
+
+func (d *Distribution1D) DiscretePdf(offset int) float64 {
+	if d.Integral == 0 {
+		return 1 / float64(d.Count())
+	}
+	return d.Func[offset] / (d.Integral * float64(d.Count()))
+}
+
+// Distribution2D is a piecewise constant distribution over [0, 1)^2, sampled
+// by first picking a row from the marginal and then a column within it.
+type Distribution2D struct {
+	conditional []*Distribution1D
+	marginal    *Distribution1D
+}
+
+// NewDistribution2D builds the distribution from a w by h grid of values
+// stored row by row.
+func NewDistribution2D(f []float64, w, h int) *Distribution2D {
+	d := &Distribution2D{conditional: make([]*Distribution1D, h)}
+	marginal := make([]float64, h)
+	for v := 0; v < h; v++ {
+		d.conditional[v] = NewDistribution1D(f[v*w : (v+1)*w])
+		marginal[v] = d.conditional[v].Integral
+	}
+	d.marginal = NewDistribution1D(marginal)
+	return d
+}
+
+func (d *Distribution2D) Sample(u0, u1 float64) (u, v, pdf float64) {
+	v, pdf1, row := d.marginal.SampleContinuous(u1)
+	u, pdf0, _ := d.conditional[row].SampleContinuous(u0)
+	return u, v, pdf0 * pdf1
+}
+
+func (d *Distribution2D) Pdf(u, v float64) float64 {
+	w := d.conditional[0].Count()
+	h := d.marginal.Count()
+	iu := clampIndex(int(u*float64(w)), w)
+	iv := clampIndex(int(v*float64(h)), h)
+	if d.marginal.Integral == 0 {
+		return 1
+	}
+	return d.conditional[iv].Func[iu] / d.marginal.Integral
+}
+
+func clampIndex(i, n int) int {
+	if i < 0 {
+		return 0
+	}
+	if i >= n {
+		return n - 1
+	}
+	return i
+}
+
+// AliasTable picks one of n outcomes with probability proportional to its
+// weight in constant time (Walker's alias method, built with Vose's algorithm).
+type AliasTable struct {
+	prob  []float64
+	alias []int
+	pmf   []float64
+}
+
+func NewAliasTable(weights []float64) *AliasTable {
+	n := len(weights)
+	t := &AliasTable{make([]float64, n), make([]int, n), make([]float64, n)}
+	var sum float64
+	for _, w := range weights {
+		sum += w
+	}
+	for i, w := range weights {
+		if sum > 0 {
+			t.pmf[i] = w / sum
+		} else {
+			t.pmf[i] = 1 / float64(n)
+		}
+	}
+	var small, large []int
+	scaled := make([]float64, n)
+	for i, p := range t.pmf {
+		scaled[i] = p * float64(n)
+		if scaled[i] < 1 {
+			small = append(small, i)
+		} else {
+			large = append(large, i)
+		}
+	}
+	for len(small) > 0 && len(large) > 0 {
+		s, l := small[len(small)-1], large[len(large)-1]
+		small = small[:len(small)-1]
+		t.prob[s] = scaled[s]
+		t.alias[s] = l
+		scaled[l] += scaled[s] - 1
+		if scaled[l] < 1 {
+			large = large[:len(large)-1]
+			small = append(small, l)
+		}
+	}
+	// whatever is left over is 1 up to rounding
+	for _, i := range append(small, large...) {
+		t.prob[i] = 1
+		t.alias[i] = i
+	}
+	return t
+}
+
+func (t *AliasTable) Count() int {
+	return len(t.pmf)
+}
+
+// Sample maps u in [0, 1) to an outcome and its probability.
+func (t *AliasTable) Sample(u float64) (int, float64) {
+	n := len(t.pmf)
+	i := clampIndex(int(u*float64(n)), n)
+	up := u*float64(n) - float64(i)
+	if up >= t.prob[i] {
+		i = t.alias[i]
+	}
+	return i, t.pmf[i]
+}
+
+func (t *AliasTable) Pmf(i int) float64 {
+	return t.pmf[i]
+}
@@ -0,0 +1,208 @@
+package lib
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+)
+
+// A Background gives the light arriving from outside the scene and can be
+// sampled for next event estimation.
+type Background interface {
+	Radiance(direction Vector) RGB
+	Sample(rnd *rand.Rand) (direction Vector, radiance RGB, pdf float64)
+	Pdf(direction Vector) float64
+}
+
+// EnvironmentLight surrounds the scene with an equirectangular image. The top
+// row of the image is straight up (+y), and the image wraps around the y axis
+// starting at +x. It is importance sampled by luminance.
+type EnvironmentLight struct {
+	W, H      int
+	Pixels    []RGB
+	Rotation  float64 // radians around the y axis
+	Intensity float64
+	dist      *Distribution2D
+}
+
+func NewEnvironmentLight(w, h int, pixels []RGB, rotation, intensity float64) *EnvironmentLight {
+	f := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		// rows near the poles cover less solid angle
+		sinTheta := math.Sin(math.Pi * (float64(y) + .5) / float64(h))
+		for x := 0; x < w; x++ {
+			f[y*w+x] = pixels[y*w+x].Luminance() * sinTheta
+		}
+	}
+	return &EnvironmentLight{w, h, pixels, rotation, intensity, NewDistribution2D(f, w, h)}
+}
+
+func LoadEnvironmentLight(path string, rotation, intensity float64) (*EnvironmentLight, error) {
+	fmt.Printf("Loading HDR: %s\n", path)
+	w, h, pixels, err := LoadHDR(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewEnvironmentLight(w, h, pixels, rotation, intensity), nil
+}
+
+func (e *EnvironmentLight) uv(direction Vector) (float64, float64) {
+	d := direction.Normalize().RotateY(-e.Rotation)
+	theta := math.Acos(math.Max(-1, math.Min(1, d.Y)))
+	phi := math.Atan2(d.Z, d.X)
+	if phi < 0 {
+		phi += 2 * math.Pi
+	}
+	return phi / (2 * math.Pi), theta / math.Pi
+}
+
+func (e *EnvironmentLight) Radiance(direction Vector) RGB {
+	u, v := e.uv(direction)
+	x := clampIndex(int(u*float64(e.W)), e.W)
+	y := clampIndex(int(v*float64(e.H)), e.H)
+	return e.Pixels[y*e.W+x].MultiplyScalar(e.Intensity)
+}
+
+// Sample picks a direction proportionally to the luminance of the map and
+// returns it with its radiance and solid angle density.
+func (e *EnvironmentLight) Sample(rnd *rand.Rand) (Vector, RGB, float64) {
+	u, v, pdf := e.dist.Sample(rnd.Float64(), rnd.Float64())
+	theta := v * math.Pi
+	phi := u * 2 * math.Pi
+	sinTheta := math.Sin(theta)
+	if pdf == 0 || sinTheta == 0 {
+		return Vector{}, RGB{}, 0
+	}
+	d := Vector{sinTheta * math.Cos(phi), math.Cos(theta), sinTheta * math.Sin(phi)}.RotateY(e.Rotation)
+	return d, e.Radiance(d), pdf / (2 * math.Pi * math.Pi * sinTheta)
+}
+
+func (e *EnvironmentLight) Pdf(direction Vector) float64 {
+	u, v := e.uv(direction)
+	sinTheta := math.Sin(v * math.Pi)
+	if sinTheta == 0 {
+		return 0
+	}
+	return e.dist.Pdf(u, v) / (2 * math.Pi * math.Pi * sinTheta)
+}
+
+// LoadHDR reads a Radiance RGBE (.hdr) image, with or without run length
+// encoded scanlines.
+func LoadHDR(path string) (w, h int, pixels []RGB, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	if !strings.HasPrefix(line, "#?") {
+		err = fmt.Errorf("%s: not a Radiance HDR file", path)
+		return
+	}
+	for {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "FORMAT=") && line != "FORMAT=32-bit_rle_rgbe" {
+			err = fmt.Errorf("%s: unsupported format %s", path, line[7:])
+			return
+		}
+	}
+	line, err = r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	if _, err = fmt.Sscanf(line, "-Y %d +X %d", &h, &w); err != nil {
+		err = fmt.Errorf("%s: unsupported resolution line %q", path, strings.TrimSpace(line))
+		return
+	}
+
+	pixels = make([]RGB, w*h)
+	scanline := make([]byte, 4*w)
+	for y := 0; y < h; y++ {
+		if err = readScanline(r, scanline, w); err != nil {
+			err = fmt.Errorf("%s: scanline %d: %v", path, y, err)
+			return
+		}
+		for x := 0; x < w; x++ {
+			pixels[y*w+x] = rgbe(scanline[4*x], scanline[4*x+1], scanline[4*x+2], scanline[4*x+3])
+		}
+	}
+	return
+}
+
+func readScanline(r *bufio.Reader, scanline []byte, w int) error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if w < 8 || w > 0x7fff || header[0] != 2 || header[1] != 2 || header[2]&0x80 != 0 {
+		// flat scanline
+		copy(scanline, header)
+		_, err := io.ReadFull(r, scanline[4:])
+		return err
+	}
+	if int(header[2])<<8|int(header[3]) != w {
+		return errors.New("scanline width mismatch")
+	}
+	// the four components are stored one after the other, run length encoded
+	for c := 0; c < 4; c++ {
+		for x := 0; x < w; {
+			count, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			if count > 128 {
+				n := int(count) - 128
+				if x+n > w {
+					return errors.New("run overflows scanline")
+				}
+				v, err := r.ReadByte()
+				if err != nil {
+					return err
+				}
+				for ; n > 0; n-- {
+					scanline[4*x+c] = v
+					x++
+				}
+			} else {
+				n := int(count)
+				if n == 0 || x+n > w {
+					return errors.New("bad run length")
+				}
+				for ; n > 0; n-- {
+					v, err := r.ReadByte()
+					if err != nil {
+						return err
+					}
+					scanline[4*x+c] = v
+					x++
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func rgbe(r, g, b, e byte) RGB {
+	if e == 0 {
+		return RGB{}
+	}
+	f := math.Ldexp(1, int(e)-(128+8))
+	return RGB{(float64(r) + .5) * f, (float64(g) + .5) * f, (float64(b) + .5) * f}
+}
@@ -0,0 +1,101 @@
+package lib
+
+import (
+	"math"
+)
+
+// A Filter gives the weight of a sample at offset (x, y) from a pixel center,
+// measured in pixels. Samples splat into every pixel within Radius.
+type Filter interface {
+	Radius() float64
+	Evaluate(x, y float64) float64
+}
+
+type BoxFilter struct{}
+
+func (f BoxFilter) Radius() float64 {
+	return .5
+}
+
+func (f BoxFilter) Evaluate(x, y float64) float64 {
+	// half open so that a sample never lands in two pixels
+	if x > -.5 && x <= .5 && y > -.5 && y <= .5 {
+		return 1
+	}
+	return 0
+}
+
+type GaussianFilter struct {
+	R, Alpha float64
+}
+
+func (f GaussianFilter) Radius() float64 {
+	return f.R
+}
+
+func (f GaussianFilter) Evaluate(x, y float64) float64 {
+	return f.gaussian(x) * f.gaussian(y)
+}
+
+func (f GaussianFilter) gaussian(d float64) float64 {
+	return math.Max(0, math.Exp(-f.Alpha*d*d)-math.Exp(-f.Alpha*f.R*f.R))
+}
+
+type MitchellFilter struct {
+	R, B, C float64
+}
+
+func (f MitchellFilter) Radius() float64 {
+	return f.R
+}
+
+func (f MitchellFilter) Evaluate(x, y float64) float64 {
+	return f.mitchell(2*x/f.R) * f.mitchell(2*y/f.R)
+}
+
+func (f MitchellFilter) mitchell(x float64) float64 {
+	x = math.Abs(x)
+	b, c := f.B, f.C
+	if x > 2 {
+		return 0
+	}
+	if x > 1 {
+		return ((-b-6*c)*x*x*x + (6*b+30*c)*x*x + (-12*b-48*c)*x + (8*b + 24*c)) / 6
+	}
+	return ((12-9*b-6*c)*x*x*x + (-18+12*b+6*c)*x*x + (6 - 2*b)) / 6
+}
+
+type BlackmanHarrisFilter struct {
+	R float64
+}
+
+func (f BlackmanHarrisFilter) Radius() float64 {
+	return f.R
+}
+
+func (f BlackmanHarrisFilter) Evaluate(x, y float64) float64 {
+	return f.blackmanHarris(x) * f.blackmanHarris(y)
+}
+
+func (f BlackmanHarrisFilter) blackmanHarris(d float64) float64 {
+	if math.Abs(d) >= f.R {
+		return 0
+	}
+	t := 2 * math.Pi * (d/(2*f.R) + .5)
+	return .35875 - .48829*math.Cos(t) + .14128*math.Cos(2*t) - .01168*math.Cos(3*t)
+}
+
+// FilterByName returns the filter with the given name and default parameters.
+func FilterByName(name string) (Filter, bool) {
+	switch name {
+	case "box":
+		return BoxFilter{}, true
+	case "gaussian":
+		return GaussianFilter{R: 1.5, Alpha: 2}, true
+	case "mitchell":
+		return MitchellFilter{R: 2, B: 1.0 / 3, C: 1.0 / 3}, true
+	case "blackman-harris":
+		return BlackmanHarrisFilter{R: 2}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,924 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"image"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"strings"
+)
+
+// GLTF is the content of a glTF 2.0 file, placed in world space by the node
+// hierarchy of its default scene.
+type GLTF struct {
+	Mesh    *Mesh // every triangle, with a group per node; nil if there are none
+	Lights  []Light
+	Cameras []GLTFCamera
+}
+
+// GLTFCamera is a perspective camera of a glTF file. Cameras are always kept
+// upright, as NewCamera makes them.
+type GLTFCamera struct {
+	Name             string
+	Position, LookAt Vector
+	VFov             float64 // degrees
+}
+
+// Camera is a pinhole camera for an image of the given aspect ratio.
+func (c GLTFCamera) Camera(aspect float64) *Camera {
+	return NewCamera(c.Position, c.LookAt, c.VFov, aspect, 0)
+}
+
+// AddTo adds the mesh and lights to the scene.
+func (g *GLTF) AddTo(scene *Scene) {
+	if g.Mesh != nil {
+		scene.AddAll([]Hittable{g.Mesh})
+	}
+	for _, l := range g.Lights {
+		scene.AddLight(l)
+	}
+}
+
+// LoadGLTF reads a .gltf file, with its buffers and images in other files or
+// embedded as data URIs, or a binary .glb file. Materials are mapped onto the
+// material model like those of MTL files. Their textures are sampled at hits,
+// except emissive ones, which are averaged so that lights keep one power.
+func LoadGLTF(path string) (*GLTF, error) {
+	fmt.Printf("Loading glTF: %s\n", path)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &gltfLoader{path: path, result: &GLTF{}, warned: make(map[string]bool)}
+	if bytes.HasPrefix(data, []byte("glTF")) {
+		if data, err = l.readGLB(data); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if err := json.Unmarshal(data, &l.doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := l.load(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return l.result, nil
+}
+
+// gltfExtensions are the extensions that are understood, others are ignored or
+// refused if the file requires them.
+var gltfExtensions = map[string]bool{
+	"KHR_lights_punctual":             true,
+	"KHR_materials_emissive_strength": true,
+	"KHR_materials_ior":               true,
+	"KHR_materials_transmission":      true,
+	"KHR_mesh_quantization":           true,
+}
+
+type gltfDoc struct {
+	Asset struct {
+		Version string
+	}
+	ExtensionsRequired []string
+	Scene              *int
+	Scenes             []struct {
+		Nodes []int
+	}
+	Nodes  []gltfNode
+	Meshes []struct {
+		Name       string
+		Primitives []gltfPrimitive
+	}
+	Materials []gltfMaterial
+	Textures  []struct {
+		Source *int
+	}
+	Images []struct {
+		URI        string
+		BufferView *int
+	}
+	Accessors   []gltfAccessor
+	BufferViews []struct {
+		Buffer     int
+		ByteOffset int
+		ByteLength int
+		ByteStride int
+	}
+	Buffers []struct {
+		URI        string
+		ByteLength int
+	}
+	Cameras []struct {
+		Name        string
+		Type        string
+		Perspective *struct {
+			Yfov float64
+		}
+	}
+	Extensions struct {
+		Lights *struct {
+			Lights []gltfLight
+		} `json:"KHR_lights_punctual"`
+	}
+}
+
+type gltfNode struct {
+	Name                         string
+	Children                     []int
+	Mesh, Camera                 *int
+	Matrix                       []float64
+	Translation, Rotation, Scale []float64
+	Extensions                   struct {
+		Light *struct {
+			Light int
+		} `json:"KHR_lights_punctual"`
+	}
+}
+
+type gltfPrimitive struct {
+	Attributes map[string]int
+	Indices    *int
+	Material   *int
+	Mode       *int
+}
+
+type gltfTextureRef struct {
+	Index int
+}
+
+type gltfMaterial struct {
+	Name string
+	PBR  *struct {
+		BaseColorFactor          []float64
+		BaseColorTexture         *gltfTextureRef
+		MetallicFactor           *float64
+		RoughnessFactor          *float64
+		MetallicRoughnessTexture *gltfTextureRef
+	} `json:"pbrMetallicRoughness"`
+	EmissiveFactor  []float64
+	EmissiveTexture *gltfTextureRef
+	AlphaMode       string
+	DoubleSided     bool
+	Extensions      struct {
+		EmissiveStrength *struct {
+			EmissiveStrength float64
+		} `json:"KHR_materials_emissive_strength"`
+		IOR *struct {
+			IOR *float64
+		} `json:"KHR_materials_ior"`
+		Transmission *struct {
+			TransmissionFactor  float64
+			TransmissionTexture *gltfTextureRef
+		} `json:"KHR_materials_transmission"`
+	}
+}
+
+type gltfAccessor struct {
+	BufferView    *int
+	ByteOffset    int
+	ComponentType int
+	Normalized    bool
+	Count         int
+	Type          string
+	Sparse        json.RawMessage
+}
+
+type gltfLight struct {
+	Type      string
+	Color     []float64
+	Intensity *float64
+	Spot      *struct {
+		InnerConeAngle float64
+		OuterConeAngle *float64
+	}
+}
+
+var gltfComponents = map[string]int{"SCALAR": 1, "VEC2": 2, "VEC3": 3, "VEC4": 4}
+
+var gltfComponentSizes = map[int]int{5120: 1, 5121: 1, 5122: 2, 5123: 2, 5125: 4, 5126: 4}
+
+type gltfLoader struct {
+	path      string
+	doc       gltfDoc
+	glb       []byte // the binary chunk of a .glb file
+	buffers   [][]byte
+	images    map[int]image.Image
+	materials map[int]*Material
+	result    *GLTF
+	builder   meshBuilder
+	warned    map[string]bool
+}
+
+func (l *gltfLoader) warn(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if !l.warned[msg] {
+		l.warned[msg] = true
+		fmt.Printf("%s: %s\n", l.path, msg)
+	}
+}
+
+// readGLB splits a .glb file into its JSON and binary chunks and returns the
+// JSON.
+func (l *gltfLoader) readGLB(data []byte) ([]byte, error) {
+	if len(data) < 12 {
+		return nil, errors.New("truncated header")
+	}
+	if version := binary.LittleEndian.Uint32(data[4:]); version != 2 {
+		return nil, fmt.Errorf("glb version %d is not supported", version)
+	}
+	if length := binary.LittleEndian.Uint32(data[8:]); int(length) < len(data) {
+		data = data[:length]
+	}
+	var doc []byte
+	for rest := data[12:]; len(rest) > 0; {
+		if len(rest) < 8 {
+			return nil, errors.New("truncated chunk")
+		}
+		length := binary.LittleEndian.Uint32(rest)
+		kind := binary.LittleEndian.Uint32(rest[4:])
+		if uint64(length) > uint64(len(rest)-8) {
+			return nil, errors.New("truncated chunk")
+		}
+		chunk := rest[8 : 8+length]
+		switch kind {
+		case 0x4e4f534a: // JSON
+			doc = chunk
+		case 0x004e4942: // BIN
+			l.glb = chunk
+		}
+		rest = rest[8+length:]
+	}
+	if doc == nil {
+		return nil, errors.New("missing JSON chunk")
+	}
+	return doc, nil
+}
+
+func (l *gltfLoader) load() error {
+	if !strings.HasPrefix(l.doc.Asset.Version, "2.") {
+		return fmt.Errorf("glTF version %q is not supported", l.doc.Asset.Version)
+	}
+	for _, e := range l.doc.ExtensionsRequired {
+		if !gltfExtensions[e] {
+			return fmt.Errorf("required extension %s is not supported", e)
+		}
+	}
+	for i, b := range l.doc.Buffers {
+		// the buffer without a URI is the binary chunk of a .glb
+		data := l.glb
+		var err error
+		if b.URI != "" {
+			data, err = l.readURI(b.URI)
+		}
+		if err != nil {
+			return fmt.Errorf("buffer %d: %v", i, err)
+		}
+		if b.ByteLength < 0 || len(data) < b.ByteLength {
+			return fmt.Errorf("buffer %d: %d bytes, expected %d", i, len(data), b.ByteLength)
+		}
+		l.buffers = append(l.buffers, data[:b.ByteLength])
+	}
+	l.images = make(map[int]image.Image)
+	l.materials = make(map[int]*Material)
+
+	var roots []int
+	switch {
+	case l.doc.Scene != nil && *l.doc.Scene >= 0 && *l.doc.Scene < len(l.doc.Scenes):
+		roots = l.doc.Scenes[*l.doc.Scene].Nodes
+	case len(l.doc.Scenes) > 0:
+		roots = l.doc.Scenes[0].Nodes
+	default:
+		// without scenes, every node that is nobody's child is a root
+		child := make(map[int]bool)
+		for _, n := range l.doc.Nodes {
+			for _, c := range n.Children {
+				child[c] = true
+			}
+		}
+		for i := range l.doc.Nodes {
+			if !child[i] {
+				roots = append(roots, i)
+			}
+		}
+	}
+	visited := make(map[int]bool)
+	for _, n := range roots {
+		if err := l.node(n, identityMatrix(), visited); err != nil {
+			return err
+		}
+	}
+	if l.builder.count() > 0 {
+		mesh := l.builder.build(Vector{}, 1)
+		mesh.Center = mesh.Box.MidPoint()
+		l.result.Mesh = mesh
+	}
+	return nil
+}
+
+// readURI reads a file relative to the glTF file, or decodes a data URI.
+func (l *gltfLoader) readURI(uri string) ([]byte, error) {
+	if strings.HasPrefix(uri, "data:") {
+		i := strings.Index(uri, ";base64,")
+		if i < 0 {
+			return nil, errors.New("data URIs must be base64 encoded")
+		}
+		return base64.StdEncoding.DecodeString(uri[i+len(";base64,"):])
+	}
+	name, err := url.PathUnescape(uri)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(RelativePath(l.path, name))
+}
+
+func (l *gltfLoader) node(i int, parent gltfMatrix, visited map[int]bool) error {
+	if i < 0 || i >= len(l.doc.Nodes) {
+		return fmt.Errorf("node %d does not exist", i)
+	}
+	if visited[i] {
+		return fmt.Errorf("node %d appears twice in the hierarchy", i)
+	}
+	visited[i] = true
+	n := &l.doc.Nodes[i]
+	m, err := n.transform()
+	if err != nil {
+		return fmt.Errorf("node %d: %v", i, err)
+	}
+	m = parent.Multiply(m)
+
+	if n.Mesh != nil {
+		if err := l.mesh(*n.Mesh, n.Name, m); err != nil {
+			return fmt.Errorf("node %d: %v", i, err)
+		}
+	}
+	if n.Camera != nil {
+		if err := l.camera(*n.Camera, m); err != nil {
+			return fmt.Errorf("node %d: %v", i, err)
+		}
+	}
+	if n.Extensions.Light != nil {
+		if err := l.light(n.Extensions.Light.Light, m); err != nil {
+			return fmt.Errorf("node %d: %v", i, err)
+		}
+	}
+	for _, c := range n.Children {
+		if err := l.node(c, m, visited); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *gltfLoader) mesh(i int, node string, m gltfMatrix) error {
+	if i < 0 || i >= len(l.doc.Meshes) {
+		return fmt.Errorf("mesh %d does not exist", i)
+	}
+	mesh := l.doc.Meshes[i]
+	group := &MeshGroup{Object: node, Group: mesh.Name}
+	for j, p := range mesh.Primitives {
+		tris, err := l.primitive(p, m)
+		if err != nil {
+			return fmt.Errorf("mesh %d, primitive %d: %v", i, j, err)
+		}
+		group.Triangles = append(group.Triangles, tris...)
+	}
+	if len(group.Triangles) == 0 {
+		return nil
+	}
+	l.builder.mesh.Groups = append(l.builder.mesh.Groups, group)
+	return nil
+}
+
+func (l *gltfLoader) primitive(p gltfPrimitive, m gltfMatrix) ([]uint32, error) {
+	mode := 4
+	if p.Mode != nil {
+		mode = *p.Mode
+	}
+	if mode < 4 || mode > 6 {
+		l.warn("points and lines are not supported")
+		return nil, nil
+	}
+	position, ok := p.Attributes["POSITION"]
+	if !ok {
+		return nil, errors.New("no positions")
+	}
+	vs, n, err := l.accessor(position)
+	if err != nil {
+		return nil, err
+	}
+	if n != 3 {
+		return nil, errors.New("positions must be VEC3")
+	}
+	count := len(vs) / 3
+	attribute := func(name string, components int) ([]float64, error) {
+		i, ok := p.Attributes[name]
+		if !ok {
+			return nil, nil
+		}
+		values, n, err := l.accessor(i)
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("%s: %v", name, err)
+		case n != components || len(values) != count*n:
+			return nil, fmt.Errorf("%s does not match the positions", name)
+		}
+		return values, nil
+	}
+	ns, err := attribute("NORMAL", 3)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := attribute("TEXCOORD_0", 2)
+	if err != nil {
+		return nil, err
+	}
+	tangents, err := attribute("TANGENT", 4)
+	if err != nil {
+		return nil, err
+	}
+
+	var indices []int
+	if p.Indices != nil {
+		values, n, err := l.accessor(*p.Indices)
+		if err != nil {
+			return nil, fmt.Errorf("indices: %v", err)
+		}
+		if n != 1 {
+			return nil, errors.New("indices must be SCALAR")
+		}
+		indices = make([]int, len(values))
+		for i, v := range values {
+			if v < 0 || int(v) >= count {
+				return nil, fmt.Errorf("index %d out of range, %d vertices", int(v), count)
+			}
+			indices[i] = int(v)
+		}
+	} else {
+		indices = make([]int, count)
+		for i := range indices {
+			indices[i] = i
+		}
+	}
+
+	var faces [][3]int
+	switch mode {
+	case 4:
+		for i := 0; i+2 < len(indices); i += 3 {
+			faces = append(faces, [3]int{indices[i], indices[i+1], indices[i+2]})
+		}
+	case 5:
+		// every other triangle of a strip is wound the other way
+		for i := 0; i+2 < len(indices); i++ {
+			if i%2 == 0 {
+				faces = append(faces, [3]int{indices[i], indices[i+1], indices[i+2]})
+			} else {
+				faces = append(faces, [3]int{indices[i+1], indices[i], indices[i+2]})
+			}
+		}
+	case 6:
+		for i := 1; i+1 < len(indices); i++ {
+			faces = append(faces, [3]int{indices[0], indices[i], indices[i+1]})
+		}
+	}
+
+	material, err := l.material(p.Material)
+	if err != nil {
+		return nil, err
+	}
+	// mirroring transforms turn the winding around
+	mirrored := m.Determinant() < 0
+	base := uint32(len(l.builder.mesh.Positions))
+	for i := 0; i < count; i++ {
+		var n, t Vector
+		if ns != nil {
+			n = m.Normal(Vector{ns[3*i], ns[3*i+1], ns[3*i+2]})
+		}
+		if ts != nil {
+			// glTF puts the origin of textures at the top, OBJ at the bottom
+			t = Vector{ts[2*i], 1 - ts[2*i+1], 0}
+		}
+		v := l.builder.vertex(m.Point(Vector{vs[3*i], vs[3*i+1], vs[3*i+2]}), n, t)
+		if tangents != nil && ns != nil {
+			// the bitangent is given by the handedness w, and transformed
+			// as a direction like the tangent
+			tangent := Vector{tangents[4*i], tangents[4*i+1], tangents[4*i+2]}
+			normal := Vector{ns[3*i], ns[3*i+1], ns[3*i+2]}
+			bitangent := normal.Cross(tangent).MultiplyScalar(tangents[4*i+3])
+			l.builder.tangents(v, m.Direction(tangent).Normalize(), m.Direction(bitangent).Normalize())
+		}
+	}
+	var tris []uint32
+	for _, f := range faces {
+		if mirrored {
+			f[1], f[2] = f[2], f[1]
+		}
+		tris = append(tris, l.builder.triangle(base+uint32(f[0]), base+uint32(f[1]), base+uint32(f[2]), material))
+	}
+	return tris, nil
+}
+
+// accessor reads the elements of an accessor as floats, along with the number
+// of components of each.
+func (l *gltfLoader) accessor(i int) ([]float64, int, error) {
+	if i < 0 || i >= len(l.doc.Accessors) {
+		return nil, 0, fmt.Errorf("accessor %d does not exist", i)
+	}
+	a := l.doc.Accessors[i]
+	n, ok := gltfComponents[a.Type]
+	if !ok {
+		return nil, 0, fmt.Errorf("accessor %d: type %s is not supported", i, a.Type)
+	}
+	size, ok := gltfComponentSizes[a.ComponentType]
+	if !ok {
+		return nil, 0, fmt.Errorf("accessor %d: component type %d is not supported", i, a.ComponentType)
+	}
+	if a.Sparse != nil {
+		return nil, 0, fmt.Errorf("accessor %d: sparse accessors are not supported", i)
+	}
+	if a.Count < 0 {
+		return nil, 0, fmt.Errorf("accessor %d: negative count", i)
+	}
+	if a.BufferView == nil {
+		return make([]float64, a.Count*n), n, nil
+	}
+	data, stride, err := l.bufferView(*a.BufferView)
+	if err != nil {
+		return nil, 0, fmt.Errorf("accessor %d: %v", i, err)
+	}
+	if stride == 0 {
+		stride = n * size
+	}
+	if a.Count > 0 && (a.ByteOffset < 0 || a.ByteOffset+(a.Count-1)*stride+n*size > len(data)) {
+		return nil, 0, fmt.Errorf("accessor %d runs past its buffer view", i)
+	}
+	values := make([]float64, a.Count*n)
+	for j := 0; j < a.Count; j++ {
+		for k := 0; k < n; k++ {
+			values[j*n+k] = gltfComponent(data[a.ByteOffset+j*stride+k*size:], a.ComponentType, a.Normalized)
+		}
+	}
+	return values, n, nil
+}
+
+func (l *gltfLoader) bufferView(i int) ([]byte, int, error) {
+	if i < 0 || i >= len(l.doc.BufferViews) {
+		return nil, 0, fmt.Errorf("buffer view %d does not exist", i)
+	}
+	v := l.doc.BufferViews[i]
+	if v.Buffer < 0 || v.Buffer >= len(l.buffers) {
+		return nil, 0, fmt.Errorf("buffer %d does not exist", v.Buffer)
+	}
+	b := l.buffers[v.Buffer]
+	if v.ByteOffset < 0 || v.ByteLength < 0 || v.ByteOffset+v.ByteLength > len(b) {
+		return nil, 0, fmt.Errorf("buffer view %d runs past its buffer", i)
+	}
+	return b[v.ByteOffset : v.ByteOffset+v.ByteLength], v.ByteStride, nil
+}
+
+// gltfComponent decodes one component, mapping normalized integers to [0, 1]
+// or [-1, 1].
+func gltfComponent(b []byte, componentType int, normalized bool) float64 {
+	var v, max float64
+	switch componentType {
+	case 5120:
+		v, max = float64(int8(b[0])), 127
+	case 5121:
+		v, max = float64(b[0]), 255
+	case 5122:
+		v, max = float64(int16(binary.LittleEndian.Uint16(b))), 32767
+	case 5123:
+		v, max = float64(binary.LittleEndian.Uint16(b)), 65535
+	case 5125:
+		return float64(binary.LittleEndian.Uint32(b))
+	case 5126:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	}
+	if normalized {
+		return math.Max(v/max, -1)
+	}
+	return v
+}
+
+// material maps a glTF material onto the material model, as MTL files with
+// PBR factors are: metals reflect their colour, dielectrics about 4% of the
+// light, and the roughness widens the reflection cone.
+func (l *gltfLoader) material(index *int) (*Material, error) {
+	i := -1
+	if index != nil {
+		i = *index
+	}
+	if m, ok := l.materials[i]; ok {
+		return m, nil
+	}
+	// without a material, the defaults of all properties apply
+	var g gltfMaterial
+	if index != nil {
+		if i < 0 || i >= len(l.doc.Materials) {
+			return nil, fmt.Errorf("material %d does not exist", i)
+		}
+		g = l.doc.Materials[i]
+	}
+	fail := func(err error) (*Material, error) {
+		return nil, fmt.Errorf("material %d: %v", i, err)
+	}
+
+	base := RGB{1, 1, 1}
+	metallic, roughness := 1.0, 1.0
+	var textures gltfTextures
+	if pbr := g.PBR; pbr != nil {
+		if len(pbr.BaseColorFactor) >= 3 {
+			base = RGB{pbr.BaseColorFactor[0], pbr.BaseColorFactor[1], pbr.BaseColorFactor[2]}
+		}
+		if pbr.MetallicFactor != nil {
+			metallic = *pbr.MetallicFactor
+		}
+		if pbr.RoughnessFactor != nil {
+			roughness = *pbr.RoughnessFactor
+		}
+		if pbr.BaseColorTexture != nil {
+			t, err := l.texture(*pbr.BaseColorTexture, true)
+			if err != nil {
+				return fail(err)
+			}
+			textures.baseColor = t
+		}
+		if pbr.MetallicRoughnessTexture != nil {
+			t, err := l.texture(*pbr.MetallicRoughnessTexture, false)
+			if err != nil {
+				return fail(err)
+			}
+			textures.metallicRoughness = t
+		}
+	}
+	m := &Material{Col: base, Index: 1.5}
+	setMetallicRoughness(m, metallic, roughness)
+	if e := g.Extensions.IOR; e != nil && e.IOR != nil {
+		m.Index = *e.IOR
+	}
+	if e := g.Extensions.Transmission; e != nil {
+		m.Transparency = e.TransmissionFactor
+		if e.TransmissionTexture != nil {
+			t, err := l.texture(*e.TransmissionTexture, false)
+			if err != nil {
+				return fail(err)
+			}
+			textures.transmission = t
+		}
+	}
+	if textures != (gltfTextures{}) {
+		textures.metallic, textures.roughness, textures.transmissionFactor = metallic, roughness, m.Transparency
+		m.Textures = &textures
+	}
+	if g.AlphaMode != "" && g.AlphaMode != "OPAQUE" {
+		l.warn("alpha mode %s is not supported", g.AlphaMode)
+	}
+
+	var emissive RGB
+	if len(g.EmissiveFactor) >= 3 {
+		emissive = RGB{g.EmissiveFactor[0], g.EmissiveFactor[1], g.EmissiveFactor[2]}
+	}
+	if g.EmissiveTexture != nil {
+		t, err := l.texture(*g.EmissiveTexture, true)
+		if err != nil {
+			return fail(err)
+		}
+		l.warn("emissive textures are not supported, using their average")
+		emissive = emissive.Multiply(t.Average())
+	}
+	if e := g.Extensions.EmissiveStrength; e != nil {
+		emissive = emissive.MultiplyScalar(e.EmissiveStrength)
+	}
+	if max := emissive.MaxComponent(); max > 0 {
+		m.Emission = emissive.DivScalar(max)
+		m.Emittance = max
+		m.TwoSided = g.DoubleSided
+	}
+	l.materials[i] = m
+	return m, nil
+}
+
+// texture reads the image of a texture, in linear RGB if colour is set.
+func (l *gltfLoader) texture(ref gltfTextureRef, colour bool) (*Texture, error) {
+	if ref.Index < 0 || ref.Index >= len(l.doc.Textures) {
+		return nil, fmt.Errorf("texture %d does not exist", ref.Index)
+	}
+	source := l.doc.Textures[ref.Index].Source
+	if source == nil {
+		return nil, fmt.Errorf("texture %d has no image", ref.Index)
+	}
+	i := *source
+	img, ok := l.images[i]
+	if !ok {
+		if i < 0 || i >= len(l.doc.Images) {
+			return nil, fmt.Errorf("image %d does not exist", i)
+		}
+		var data []byte
+		var err error
+		if v := l.doc.Images[i].BufferView; v != nil {
+			data, _, err = l.bufferView(*v)
+		} else {
+			data, err = l.readURI(l.doc.Images[i].URI)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("image %d: %v", i, err)
+		}
+		if img, _, err = image.Decode(bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("image %d: %v", i, err)
+		}
+		l.images[i] = img
+	}
+	return NewTexture(img, colour), nil
+}
+
+// setMetallicRoughness sets the properties of m that the metallic and
+// roughness factors of glTF materials stand for.
+func setMetallicRoughness(m *Material, metallic, roughness float64) {
+	m.Reflectivity = .04 + .96*metallic
+	m.Tint = metallic
+	m.Gloss = roughness * math.Pi / 2
+}
+
+// gltfTextures are the textures of a glTF material, with the factors they
+// multiply, applied at hits as the factors alone are when it is loaded.
+type gltfTextures struct {
+	baseColor, metallicRoughness, transmission *Texture
+	metallic, roughness, transmissionFactor    float64
+}
+
+func (t *gltfTextures) Apply(m *Material, uv Vector) {
+	if t.baseColor != nil {
+		m.Col = m.Col.Multiply(t.baseColor.At(uv))
+	}
+	if t.metallicRoughness != nil {
+		c := t.metallicRoughness.At(uv)
+		setMetallicRoughness(m, t.metallic*c.B, t.roughness*c.G)
+	}
+	if t.transmission != nil {
+		m.Transparency = t.transmissionFactor * t.transmission.At(uv).R
+	}
+}
+
+func (t *gltfTextures) Hash(h hash.Hash64) {
+	for _, tex := range []*Texture{t.baseColor, t.metallicRoughness, t.transmission} {
+		if tex != nil {
+			tex.hash(h)
+		}
+	}
+	hashValue(h, [...]float64{t.metallic, t.roughness, t.transmissionFactor})
+}
+
+// camera adds a camera looking down the negative z axis of the node.
+func (l *gltfLoader) camera(i int, m gltfMatrix) error {
+	if i < 0 || i >= len(l.doc.Cameras) {
+		return fmt.Errorf("camera %d does not exist", i)
+	}
+	c := l.doc.Cameras[i]
+	if c.Type != "perspective" || c.Perspective == nil {
+		l.warn("%s cameras are not supported", c.Type)
+		return nil
+	}
+	position := m.Point(Vector{})
+	forward := m.Direction(Vector{0, 0, -1}).Normalize()
+	l.result.Cameras = append(l.result.Cameras, GLTFCamera{
+		Name:     c.Name,
+		Position: position,
+		LookAt:   position.Add(forward),
+		VFov:     c.Perspective.Yfov * 180 / math.Pi,
+	})
+	return nil
+}
+
+// light adds a KHR_lights_punctual light shining down the negative z axis of
+// the node. The photometric units are taken as they are, as the renderer has
+// no absolute scale.
+func (l *gltfLoader) light(i int, m gltfMatrix) error {
+	var lights []gltfLight
+	if l.doc.Extensions.Lights != nil {
+		lights = l.doc.Extensions.Lights.Lights
+	}
+	if i < 0 || i >= len(lights) {
+		return fmt.Errorf("light %d does not exist", i)
+	}
+	g := lights[i]
+	c := RGB{1, 1, 1}
+	if len(g.Color) >= 3 {
+		c = RGB{g.Color[0], g.Color[1], g.Color[2]}
+	}
+	if g.Intensity != nil {
+		c = c.MultiplyScalar(*g.Intensity)
+	}
+	position := m.Point(Vector{})
+	direction := m.Direction(Vector{0, 0, -1}).Normalize()
+	switch g.Type {
+	case "point":
+		l.result.Lights = append(l.result.Lights, &PointLight{Position: position, Intensity: c})
+	case "spot":
+		outer := math.Pi / 4
+		var inner float64
+		if g.Spot != nil {
+			inner = g.Spot.InnerConeAngle
+			if g.Spot.OuterConeAngle != nil {
+				outer = *g.Spot.OuterConeAngle
+			}
+		}
+		l.result.Lights = append(l.result.Lights, &SpotLight{Position: position, Direction: direction, Intensity: c, Angle: outer, Falloff: inner})
+	case "directional":
+		l.result.Lights = append(l.result.Lights, &DirectionalLight{Direction: direction, Irradiance: c})
+	default:
+		return fmt.Errorf("light %d: unknown type %q", i, g.Type)
+	}
+	return nil
+}
+
+// gltfMatrix is a 4x4 matrix in column-major order, as glTF stores them.
+type gltfMatrix [16]float64
+
+func identityMatrix() gltfMatrix {
+	return gltfMatrix{0: 1, 5: 1, 10: 1, 15: 1}
+}
+
+// transform is the local transform of the node, either its matrix or its
+// translation, rotation and scale applied in reverse order.
+func (n *gltfNode) transform() (gltfMatrix, error) {
+	if n.Matrix != nil {
+		var m gltfMatrix
+		if len(n.Matrix) != 16 {
+			return m, errors.New("matrix must have 16 elements")
+		}
+		copy(m[:], n.Matrix)
+		return m, nil
+	}
+	m := identityMatrix()
+	if n.Scale != nil {
+		if len(n.Scale) != 3 {
+			return m, errors.New("scale must have 3 elements")
+		}
+		m[0], m[5], m[10] = n.Scale[0], n.Scale[1], n.Scale[2]
+	}
+	if n.Rotation != nil {
+		if len(n.Rotation) != 4 {
+			return m, errors.New("rotation must have 4 elements")
+		}
+		x, y, z, w := n.Rotation[0], n.Rotation[1], n.Rotation[2], n.Rotation[3]
+		r := gltfMatrix{
+			1 - 2*(y*y+z*z), 2 * (x*y + z*w), 2 * (x*z - y*w), 0,
+			2 * (x*y - z*w), 1 - 2*(x*x+z*z), 2 * (y*z + x*w), 0,
+			2 * (x*z + y*w), 2 * (y*z - x*w), 1 - 2*(x*x+y*y), 0,
+			0, 0, 0, 1,
+		}
+		m = r.Multiply(m)
+	}
+	if n.Translation != nil {
+		if len(n.Translation) != 3 {
+			return m, errors.New("translation must have 3 elements")
+		}
+		m[12], m[13], m[14] = n.Translation[0], n.Translation[1], n.Translation[2]
+	}
+	return m, nil
+}
+
+func (a gltfMatrix) Multiply(b gltfMatrix) gltfMatrix {
+	var m gltfMatrix
+	for c := 0; c < 4; c++ {
+		for r := 0; r < 4; r++ {
+			for k := 0; k < 4; k++ {
+				m[c*4+r] += a[k*4+r] * b[c*4+k]
+			}
+		}
+	}
+	return m
+}
+
+func (m gltfMatrix) Point(v Vector) Vector {
+	return m.Direction(v).Add(Vector{m[12], m[13], m[14]})
+}
+
+func (m gltfMatrix) Direction(v Vector) Vector {
+	return m.column(0).MultiplyScalar(v.X).Add(m.column(1).MultiplyScalar(v.Y)).Add(m.column(2).MultiplyScalar(v.Z))
+}
+
+// Normal transforms a normal by the inverse transpose, whose columns are the
+// cross products of the columns, divided by the determinant.
+func (m gltfMatrix) Normal(n Vector) Vector {
+	a, b, c := m.column(0), m.column(1), m.column(2)
+	v := b.Cross(c).MultiplyScalar(n.X).Add(c.Cross(a).MultiplyScalar(n.Y)).Add(a.Cross(b).MultiplyScalar(n.Z))
+	if m.Determinant() < 0 {
+		v = v.MultiplyScalar(-1)
+	}
+	return v.Normalize()
+}
+
+// Determinant is that of the upper left 3x3 part.
+func (m gltfMatrix) Determinant() float64 {
+	return m.column(0).Dot(m.column(1).Cross(m.column(2)))
+}
+
+func (m gltfMatrix) column(i int) Vector {
+	return Vector{m[4*i], m[4*i+1], m[4*i+2]}
+}
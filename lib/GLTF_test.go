@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func dataURI(data []byte) string {
+	return "data:application/octet-stream;base64," + base64.StdEncoding.EncodeToString(data)
+}
+
+// writeTexturedQuad writes a glTF file of the unit square in the xy plane,
+// facing +z, with tangents and a 2x2 texture.
+func writeTexturedQuad(t *testing.T, texels [4]color.Gray) string {
+	var buf bytes.Buffer
+	floats := []float32{
+		0, 0, 0, 1, 0, 0, 1, 1, 0, 0, 1, 0, // POSITION
+		0, 0, 1, 0, 0, 1, 0, 0, 1, 0, 0, 1, // NORMAL
+		0, 1, 1, 1, 1, 0, 0, 0, // TEXCOORD_0, from the top left
+		1, 0, 0, -1, 1, 0, 0, -1, 1, 0, 0, -1, 1, 0, 0, -1, // TANGENT
+	}
+	binary.Write(&buf, binary.LittleEndian, floats)
+	binary.Write(&buf, binary.LittleEndian, []uint16{0, 1, 2, 0, 2, 3})
+
+	img := image.NewGray(image.Rect(0, 0, 2, 2))
+	for i, c := range texels {
+		img.SetGray(i%2, i/2, c)
+	}
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, img); err != nil {
+		t.Fatal(err)
+	}
+
+	view := func(offset, length int) map[string]int {
+		return map[string]int{"buffer": 0, "byteOffset": offset, "byteLength": length}
+	}
+	accessor := func(view, count int, typ string, componentType int) map[string]interface{} {
+		return map[string]interface{}{"bufferView": view, "count": count, "type": typ, "componentType": componentType}
+	}
+	doc := map[string]interface{}{
+		"asset": map[string]string{"version": "2.0"},
+		"nodes": []interface{}{map[string]int{"mesh": 0}},
+		"meshes": []interface{}{map[string]interface{}{
+			"primitives": []interface{}{map[string]interface{}{
+				"attributes": map[string]int{"POSITION": 0, "NORMAL": 1, "TEXCOORD_0": 2, "TANGENT": 3},
+				"indices":    4,
+				"material":   0,
+			}},
+		}},
+		"materials": []interface{}{map[string]interface{}{
+			"pbrMetallicRoughness": map[string]interface{}{
+				"baseColorFactor":  []float64{1, .5, 1, 1},
+				"baseColorTexture": map[string]int{"index": 0},
+				"metallicFactor":   0,
+			},
+		}},
+		"textures": []interface{}{map[string]int{"source": 0}},
+		"images":   []interface{}{map[string]string{"uri": dataURI(pngData.Bytes())}},
+		"accessors": []interface{}{
+			accessor(0, 4, "VEC3", 5126),
+			accessor(1, 4, "VEC3", 5126),
+			accessor(2, 4, "VEC2", 5126),
+			accessor(3, 4, "VEC4", 5126),
+			accessor(4, 6, "SCALAR", 5123),
+		},
+		"bufferViews": []interface{}{view(0, 48), view(48, 48), view(96, 32), view(128, 64), view(192, 12)},
+		"buffers":     []interface{}{map[string]interface{}{"uri": dataURI(buf.Bytes()), "byteLength": buf.Len()}},
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "quad.gltf")
+	if err := ioutil.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGLTFTextures(t *testing.T) {
+	// the rows of the image from the top, so the top left is black
+	texels := [4]color.Gray{{0}, {255}, {128}, {64}}
+	g, err := LoadGLTF(writeTexturedQuad(t, texels))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := g.Mesh
+	for i := range m.Positions {
+		if m.Tangents[i] != (Vector{1, 0, 0}) || m.Bitangents[i] != (Vector{0, -1, 0}) {
+			t.Fatalf("vertex %d has tangents %v and %v", i, m.Tangents[i], m.Bitangents[i])
+		}
+	}
+
+	tests := []struct {
+		x, y  float64
+		texel color.Gray
+	}{
+		{.25, .75, texels[0]},
+		{.75, .75, texels[1]},
+		{.25, .25, texels[2]},
+		{.75, .25, texels[3]},
+	}
+	for _, test := range tests {
+		ok, hit := m.Hit(Ray{Vector{test.x, test.y, 1}, Vector{0, 0, -1}}, 0, math.MaxFloat64)
+		if !ok {
+			t.Fatalf("missed the quad at %v, %v", test.x, test.y)
+		}
+		v := math.Pow(float64(test.texel.Y)/255, 2.2)
+		want := RGB{v, .5 * v, v}
+		got := hit.Surface().Color()
+		if math.Abs(got.R-want.R) > 1e-9 || math.Abs(got.G-want.G) > 1e-9 || math.Abs(got.B-want.B) > 1e-9 {
+			t.Errorf("colour at %v, %v is %v, want %v", test.x, test.y, got, want)
+		}
+		if hit.Material.Col != (RGB{1, .5, 1}) {
+			t.Errorf("the texture changed the shared material to %v", hit.Material.Col)
+		}
+	}
+}
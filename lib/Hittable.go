@@ -8,8 +8,34 @@ import (
 type Hit struct {
 	T             float64
 	Point, Normal Vector
+	UV            Vector // surface coordinates, zero for primitives that have none
 	Ray           Ray
 	*Material
+	Object Hittable // the innermost object that was hit, set by the KD-tree
+}
+
+// Surface is the material as it is at the hit, with its textures and the
+// vertex colours of meshes applied.
+func (h *Hit) Surface() *Material {
+	m := h.Material.At(h.UV)
+	if t, ok := h.Object.(MeshTriangle); ok && t.Mesh.Colors != nil && m != nil {
+		coloured := *m
+		coloured.Col = t.colorAt(h.Point)
+		m = &coloured
+	}
+	return m
+}
+
+// Emitted is the radiance an emissive surface sends back along the ray. Only
+// the side the normal points to emits, unless the material is TwoSided.
+func (h *Hit) Emitted() RGB {
+	if h.Material == nil || h.Material.Emittance <= 0 {
+		return RGB{}
+	}
+	if !h.Material.TwoSided && h.Normal.Dot(h.Ray.Direction) >= 0 {
+		return RGB{}
+	}
+	return h.Material.Emission.MultiplyScalar(h.Material.Emittance)
 }
 
 type Hittable interface {
@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"image"
+	"math/rand"
+)
+
+// An Integrator computes the light arriving at the camera along a camera ray.
+// Li is called concurrently, each goroutine with its own SampleContext.
+type Integrator interface {
+	Li(r Ray, ctx *SampleContext) RGB
+}
+
+// SampleContext is what an integrator needs besides the ray: the scene, the
+// camera, a random source and, for integrators that trace paths from the
+// lights, the film to splat onto.
+type SampleContext struct {
+	Scene         *Scene
+	Camera        *Camera
+	Rand          *rand.Rand
+	Intersections *int
+
+	Film          *Buffer
+	Width, Height int             // of the whole image
+	Region        image.Rectangle // of the image being rendered, splats outside it are dropped
+	Offset        image.Point     // image position of the film's top left pixel
+}
+
+// SplatFilm adds light arriving at the camera at film position (s, t), as
+// returned by Camera.Project.
+func (ctx *SampleContext) SplatFilm(s, t float64, c RGB) {
+	if ctx.Film == nil {
+		return
+	}
+	p := image.Point{int(s * float64(ctx.Width)), int(t * float64(ctx.Height))}
+	if !p.In(ctx.Region) {
+		return
+	}
+	ctx.Film.AddSplat(p.X-ctx.Offset.X, p.Y-ctx.Offset.Y, c)
+}
+
+// IntegratorOptions are the settings IntegratorByName passes on.
+type IntegratorOptions struct {
+	MaxDepth             int // bounces, or diffuse bounces for the path tracer
+	MaxSpecularDepth     int
+	MaxTransmissionDepth int
+	ShadowRays           int
+}
+
+// IntegratorByName returns the integrator for a -integrator flag value.
+func IntegratorByName(name string, scene *Scene, o IntegratorOptions) (Integrator, bool) {
+	_, radius := scene.BoundingSphere()
+	switch name {
+	case "path":
+		return &PathTracer{
+			MaxDepth:             o.MaxDepth,
+			MaxSpecularDepth:     o.MaxSpecularDepth,
+			MaxTransmissionDepth: o.MaxTransmissionDepth,
+			RouletteDepth:        3,
+			ShadowRays:           o.ShadowRays,
+		}, true
+	case "spectral":
+		return &SpectralPathTracer{PathTracer{
+			MaxDepth:             o.MaxDepth,
+			MaxSpecularDepth:     o.MaxSpecularDepth,
+			MaxTransmissionDepth: o.MaxTransmissionDepth,
+			RouletteDepth:        3,
+			ShadowRays:           o.ShadowRays,
+		}}, true
+	case "bdpt":
+		return NewBDPT(scene, o.MaxDepth), true
+	case "ao":
+		return &AmbientOcclusion{Samples: 16, Distance: radius / 4}, true
+	case "normals":
+		return Normals{}, true
+	case "depth":
+		return &Depth{Scale: radius}, true
+	case "primitives":
+		return PrimitiveID{}, true
+	case "kd-cost":
+		return &KDCost{Max: 32}, true
+	case "wireframe":
+		return &Wireframe{Width: .02}, true
+	}
+	return nil, false
+}
@@ -11,15 +11,30 @@ type KDNode struct {
 	Axis        Axis
 	Left, Right *KDNode
 	objects     []Hittable
+	unbounded   []Hittable // only set at the root
 }
 
+// MakeKDTree builds the tree over the objects. Objects without a finite
+// bounding box, such as planes, can't be split, so the root tests them apart
+// from the tree and they don't count towards its bounding box.
 func MakeKDTree(objects []Hittable) *KDNode {
-	return build(objects, 0)
+	var bounded, unbounded []Hittable
+	for _, o := range objects {
+		box := o.BoundingBox()
+		if math.IsInf(box.Min.X+box.Min.Y+box.Min.Z, 0) || math.IsInf(box.Max.X+box.Max.Y+box.Max.Z, 0) {
+			unbounded = append(unbounded, o)
+		} else {
+			bounded = append(bounded, o)
+		}
+	}
+	root := build(bounded, 0)
+	root.unbounded = unbounded
+	return root
 }
 
 func build(objects []Hittable, depth int) *KDNode {
 	if len(objects) == 0 {
-		return &KDNode{}
+		return &KDNode{Left: &KDNode{}, Right: &KDNode{}}
 	}
 
 	parent := KDNode{BoundingBox: objects[0].BoundingBox(), objects: objects}
@@ -127,6 +142,23 @@ func (node *KDNode) Intersects(r Ray, tMin, tMax float64, intersections *int) bo
 }
 
 func (node *KDNode) FindHit(r Ray, tMin, tMax float64, intersections *int, lookForClosest bool) (bool, Hit) {
+	if len(node.unbounded) > 0 {
+		b, h := intersectShapes(node.unbounded, r, tMin, tMax, intersections, lookForClosest)
+		if b {
+			if !lookForClosest {
+				return true, h
+			}
+			tMax = h.T
+		}
+		if bb, hb := node.findHit(r, tMin, tMax, intersections, lookForClosest); bb {
+			return true, hb
+		}
+		return b, h
+	}
+	return node.findHit(r, tMin, tMax, intersections, lookForClosest)
+}
+
+func (node *KDNode) findHit(r Ray, tMin, tMax float64, intersections *int, lookForClosest bool) (bool, Hit) {
 	if !node.BoundingBox.Intersects(r) {
 		return false, Hit{}
 	}
@@ -154,12 +186,25 @@ func (node *KDNode) FindHit(r Ray, tMin, tMax float64, intersections *int, lookF
 }
 
 func (node *KDNode) IntersectShapes(r Ray, tMin, tMax float64, intersections *int, lookForClosest bool) (bool, Hit) {
+	return intersectShapes(node.objects, r, tMin, tMax, intersections, lookForClosest)
+}
+
+func intersectShapes(objects []Hittable, r Ray, tMin, tMax float64, intersections *int, lookForClosest bool) (bool, Hit) {
 	hit := Hit{}
 	intersected := false
-	for _, shape := range node.objects {
-		b, h := shape.Hit(r, tMin, tMax)
-
-		(*intersections)++
+	for _, shape := range objects {
+		var b bool
+		var h Hit
+		if m, ok := shape.(*Mesh); ok {
+			// count the tests inside meshes too
+			b, h = m.hit(r, tMin, tMax, lookForClosest, intersections)
+		} else {
+			b, h = shape.Hit(r, tMin, tMax)
+			(*intersections)++
+		}
+		if b && h.Object == nil {
+			h.Object = shape
+		}
 		if b && (!intersected || h.T < hit.T) {
 			if !lookForClosest {
 				return true, h
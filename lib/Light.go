@@ -0,0 +1,316 @@
+package lib
+
+import (
+	"math"
+	"math/rand"
+)
+
+// LightSample is the light arriving at a point from one sample of a light.
+type LightSample struct {
+	Direction Vector  // unit vector from the point towards the light
+	Distance  float64 // to the sampled point, infinite for lights at infinity
+	Radiance  RGB     // incident radiance, already divided by the squared distance for point lights
+	Pdf       float64 // solid angle density of Direction, 1 for delta lights
+	Delta     bool    // the light can't be hit by rays, only sampled
+	Normal    Vector  // of the light's surface at the sampled point, if it has one
+}
+
+// EmissionSample is a ray leaving a light, for tracing paths from the lights.
+type EmissionSample struct {
+	Ray      Ray
+	Normal   Vector // of the surface the ray leaves, zero for point lights
+	Radiance RGB
+	PdfPos   float64 // area density of the origin
+	PdfDir   float64 // solid angle density of the direction
+}
+
+type Light interface {
+	Sample(p Vector, rnd *rand.Rand) LightSample
+	// Pdf is the density with which Sample picks direction from p.
+	Pdf(p, direction Vector) float64
+	// Power is the total emitted power, used to choose between lights.
+	Power() float64
+	SampleEmission(rnd *rand.Rand) EmissionSample
+	// PdfEmission gives the densities with which SampleEmission picks a ray
+	// leaving origin, where the light has the given normal, along direction.
+	PdfEmission(origin, normal, direction Vector) (pdfPos, pdfDir float64)
+}
+
+// A Shape is geometry that can be sampled, so that it can carry an AreaLight.
+type Shape interface {
+	Hittable
+	SurfaceArea() float64
+	// SamplePoint picks a point uniformly by area.
+	SamplePoint(rnd *rand.Rand) (point, normal Vector)
+	// SampleFrom picks a point on the shape as seen from p, with the density
+	// of the direction towards it.
+	SampleFrom(p Vector, rnd *rand.Rand) (point, normal Vector, pdf float64)
+	PdfFrom(p, direction Vector) float64
+}
+
+type PointLight struct {
+	Position  Vector
+	Intensity RGB
+}
+
+func (l *PointLight) Sample(p Vector, rnd *rand.Rand) LightSample {
+	d := l.Position.Subtract(p)
+	dist2 := d.SquaredLength()
+	dist := math.Sqrt(dist2)
+	return LightSample{d.DivideScalar(dist), dist, l.Intensity.DivScalar(dist2), 1, true, Vector{}}
+}
+
+func (l *PointLight) Pdf(p, direction Vector) float64 {
+	return 0
+}
+
+func (l *PointLight) Power() float64 {
+	return 4 * math.Pi * l.Intensity.Luminance()
+}
+
+func (l *PointLight) SampleEmission(rnd *rand.Rand) EmissionSample {
+	d := UniformCone(Vector{0, 0, 1}, -1, rnd.Float64(), rnd.Float64())
+	return EmissionSample{Ray{l.Position, d}, Vector{}, l.Intensity, 1, 1 / (4 * math.Pi)}
+}
+
+func (l *PointLight) PdfEmission(origin, normal, direction Vector) (float64, float64) {
+	return 0, 1 / (4 * math.Pi)
+}
+
+// SpotLight is a point light restricted to a cone. The intensity falls off
+// smoothly between the Falloff and Angle half angles, given in radians.
+type SpotLight struct {
+	Position, Direction Vector
+	Intensity           RGB
+	Angle, Falloff      float64
+}
+
+func (l *SpotLight) Sample(p Vector, rnd *rand.Rand) LightSample {
+	d := l.Position.Subtract(p)
+	dist2 := d.SquaredLength()
+	dist := math.Sqrt(dist2)
+	d = d.DivideScalar(dist)
+	i := l.Intensity.MultiplyScalar(l.falloff(d.MultiplyScalar(-1)))
+	return LightSample{d, dist, i.DivScalar(dist2), 1, true, Vector{}}
+}
+
+func (l *SpotLight) falloff(w Vector) float64 {
+	cosTheta := w.Dot(l.Direction.Normalize())
+	cosTotal := math.Cos(l.Angle)
+	cosFalloff := math.Cos(l.Falloff)
+	if cosTheta < cosTotal {
+		return 0
+	}
+	if cosTheta >= cosFalloff {
+		return 1
+	}
+	t := (cosTheta - cosTotal) / (cosFalloff - cosTotal)
+	return t * t * (3 - 2*t)
+}
+
+func (l *SpotLight) Pdf(p, direction Vector) float64 {
+	return 0
+}
+
+func (l *SpotLight) Power() float64 {
+	return 2 * math.Pi * l.Intensity.Luminance() * (1 - .5*(math.Cos(l.Falloff)+math.Cos(l.Angle)))
+}
+
+func (l *SpotLight) SampleEmission(rnd *rand.Rand) EmissionSample {
+	cosTotal := math.Cos(l.Angle)
+	d := UniformCone(l.Direction.Normalize(), cosTotal, rnd.Float64(), rnd.Float64())
+	i := l.Intensity.MultiplyScalar(l.falloff(d))
+	return EmissionSample{Ray{l.Position, d}, Vector{}, i, 1, 1 / (2 * math.Pi * (1 - cosTotal))}
+}
+
+func (l *SpotLight) PdfEmission(origin, normal, direction Vector) (float64, float64) {
+	cosTotal := math.Cos(l.Angle)
+	if direction.Normalize().Dot(l.Direction.Normalize()) < cosTotal {
+		return 0, 0
+	}
+	return 0, 1 / (2 * math.Pi * (1 - cosTotal))
+}
+
+// DirectionalLight is light from infinitely far away travelling along
+// Direction, like sunlight. Irradiance is measured perpendicular to it.
+type DirectionalLight struct {
+	Direction  Vector
+	Irradiance RGB
+	center     Vector // of the scene's bounding sphere
+	radius     float64
+}
+
+func (l *DirectionalLight) Sample(p Vector, rnd *rand.Rand) LightSample {
+	return LightSample{l.Direction.Normalize().MultiplyScalar(-1), math.Inf(1), l.Irradiance, 1, true, Vector{}}
+}
+
+func (l *DirectionalLight) Pdf(p, direction Vector) float64 {
+	return 0
+}
+
+func (l *DirectionalLight) Power() float64 {
+	return math.Pi * l.radius * l.radius * l.Irradiance.Luminance()
+}
+
+// SampleEmission starts rays on a disc covering the scene, facing along the
+// light.
+func (l *DirectionalLight) SampleEmission(rnd *rand.Rand) EmissionSample {
+	d := l.Direction.Normalize()
+	origin := sceneDisc(d.MultiplyScalar(-1), l.center, l.radius, rnd)
+	return EmissionSample{Ray{origin, d}, d, l.Irradiance, 1 / (math.Pi * l.radius * l.radius), 1}
+}
+
+func (l *DirectionalLight) PdfEmission(origin, normal, direction Vector) (float64, float64) {
+	return 1 / (math.Pi * l.radius * l.radius), 0
+}
+
+// sceneDisc picks a point on the disc of the given radius perpendicular to w,
+// placed outside the scene's bounding sphere in direction w.
+func sceneDisc(w, center Vector, radius float64, rnd *rand.Rand) Vector {
+	s, t := w.Basis()
+	x, y := UniformDisc(rnd.Float64(), rnd.Float64())
+	return center.Add(w.MultiplyScalar(radius)).Add(s.MultiplyScalar(x * radius)).Add(t.MultiplyScalar(y * radius))
+}
+
+// AreaLight emits light from the surface of a shape, on the side its normal
+// points to unless it is TwoSided.
+type AreaLight struct {
+	Shape    Shape
+	Emission RGB
+	TwoSided bool
+}
+
+func NewAreaLight(shape Shape) *AreaLight {
+	m := shape.Material()
+	return &AreaLight{shape, m.Emission.MultiplyScalar(m.Emittance), m.TwoSided}
+}
+
+func (l *AreaLight) Sample(p Vector, rnd *rand.Rand) LightSample {
+	q, n, pdf := l.Shape.SampleFrom(p, rnd)
+	d := q.Subtract(p)
+	dist := d.Length()
+	if pdf == 0 || dist == 0 {
+		return LightSample{}
+	}
+	d = d.DivideScalar(dist)
+	return LightSample{d, dist, l.L(n, d.MultiplyScalar(-1)), pdf, false, n}
+}
+
+// L is the radiance leaving the light in direction w from a point with normal n.
+func (l *AreaLight) L(n, w Vector) RGB {
+	if !l.TwoSided && n.Dot(w) <= 0 {
+		return RGB{}
+	}
+	return l.Emission
+}
+
+func (l *AreaLight) Pdf(p, direction Vector) float64 {
+	return l.Shape.PdfFrom(p, direction)
+}
+
+func (l *AreaLight) Power() float64 {
+	power := math.Pi * l.Shape.SurfaceArea() * l.Emission.Luminance()
+	if l.TwoSided {
+		power *= 2
+	}
+	return power
+}
+
+// SampleEmission leaves a uniformly chosen point of the shape in a cosine
+// distributed direction.
+func (l *AreaLight) SampleEmission(rnd *rand.Rand) EmissionSample {
+	q, n := l.Shape.SamplePoint(rnd)
+	side := n
+	pdfDir := 1 / math.Pi
+	if l.TwoSided {
+		if rnd.Float64() < .5 {
+			side = n.MultiplyScalar(-1)
+		}
+		pdfDir /= 2
+	}
+	d := CosineHemisphere(side, rnd.Float64(), rnd.Float64())
+	return EmissionSample{Ray{q, d}, n, l.L(n, d), 1 / l.Shape.SurfaceArea(), pdfDir * side.Dot(d)}
+}
+
+func (l *AreaLight) PdfEmission(origin, normal, direction Vector) (float64, float64) {
+	cos := normal.Dot(direction.Normalize())
+	if l.TwoSided {
+		return 1 / l.Shape.SurfaceArea(), math.Abs(cos) / (2 * math.Pi)
+	}
+	return 1 / l.Shape.SurfaceArea(), math.Max(0, cos) / math.Pi
+}
+
+// BackgroundLight makes a Background usable as a light, for integrators that
+// trace paths from the lights. Its emission starts outside the scene's
+// bounding sphere.
+type BackgroundLight struct {
+	Background Background
+	center     Vector
+	radius     float64
+	power      float64
+}
+
+func NewBackgroundLight(b Background, center Vector, radius float64) *BackgroundLight {
+	l := &BackgroundLight{b, center, radius, 0}
+	// average the radiance over the sphere of directions
+	const n = 32
+	var sum float64
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			d := UniformCone(Vector{0, 1, 0}, -1, (float64(i)+.5)/n, (float64(j)+.5)/n)
+			sum += b.Radiance(d).Luminance()
+		}
+	}
+	l.power = math.Pi * radius * radius * 4 * math.Pi * sum / (n * n)
+	return l
+}
+
+func (l *BackgroundLight) Sample(p Vector, rnd *rand.Rand) LightSample {
+	d, radiance, pdf := l.Background.Sample(rnd)
+	return LightSample{d, math.Inf(1), radiance, pdf, false, Vector{}}
+}
+
+func (l *BackgroundLight) Pdf(p, direction Vector) float64 {
+	return l.Background.Pdf(direction)
+}
+
+func (l *BackgroundLight) Power() float64 {
+	return l.power
+}
+
+func (l *BackgroundLight) SampleEmission(rnd *rand.Rand) EmissionSample {
+	w, radiance, pdf := l.Background.Sample(rnd)
+	d := w.MultiplyScalar(-1)
+	origin := sceneDisc(w, l.center, l.radius, rnd)
+	return EmissionSample{Ray{origin, d}, d, radiance, 1 / (math.Pi * l.radius * l.radius), pdf}
+}
+
+func (l *BackgroundLight) PdfEmission(origin, normal, direction Vector) (float64, float64) {
+	return 1 / (math.Pi * l.radius * l.radius), l.Background.Pdf(direction.MultiplyScalar(-1))
+}
+
+// sampleByArea implements SampleFrom for shapes that are sampled uniformly by
+// area, converting the density to solid angle.
+func sampleByArea(s Shape, p Vector, rnd *rand.Rand) (Vector, Vector, float64) {
+	q, n := s.SamplePoint(rnd)
+	d := q.Subtract(p)
+	dist2 := d.SquaredLength()
+	cos := math.Abs(n.Dot(d)) / math.Sqrt(dist2)
+	if cos == 0 {
+		return q, n, 0
+	}
+	return q, n, dist2 / (cos * s.SurfaceArea())
+}
+
+func pdfByArea(s Shape, p, direction Vector) float64 {
+	direction = direction.Normalize()
+	ok, hit := s.Hit(Ray{p, direction}, RayEpsilon, math.Inf(1))
+	if !ok {
+		return 0
+	}
+	cos := math.Abs(hit.Normal.Normalize().Dot(direction))
+	if cos == 0 {
+		return 0
+	}
+	return hit.T * hit.T / (cos * s.SurfaceArea())
+}
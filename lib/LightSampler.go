@@ -0,0 +1,450 @@
+package lib
+
+import (
+	"math"
+	"sort"
+)
+
+// A LightSampler chooses which light to sample for a shading point, so that
+// the cost of direct lighting does not grow with the number of lights.
+type LightSampler interface {
+	// Sample picks a light for the point p with normal n, returning nil if no
+	// light can contribute.
+	Sample(p, n Vector, u float64) (light Light, pmf float64)
+	Pmf(p, n Vector, light Light) float64
+}
+
+// NewLightSampler builds the sampler called name for lights: "uniform",
+// "power" or "bvh".
+func NewLightSampler(name string, lights []Light) (LightSampler, bool) {
+	switch name {
+	case "uniform":
+		return NewUniformLightSampler(lights), true
+	case "power":
+		return NewPowerLightSampler(lights), true
+	case "bvh":
+		return NewBVHLightSampler(lights), true
+	}
+	return nil, false
+}
+
+type UniformLightSampler struct {
+	lights []Light
+}
+
+func NewUniformLightSampler(lights []Light) *UniformLightSampler {
+	return &UniformLightSampler{lights}
+}
+
+func (s *UniformLightSampler) Sample(p, n Vector, u float64) (Light, float64) {
+	if len(s.lights) == 0 {
+		return nil, 0
+	}
+	i := clampIndex(int(u*float64(len(s.lights))), len(s.lights))
+	return s.lights[i], 1 / float64(len(s.lights))
+}
+
+func (s *UniformLightSampler) Pmf(p, n Vector, light Light) float64 {
+	if len(s.lights) == 0 {
+		return 0
+	}
+	return 1 / float64(len(s.lights))
+}
+
+// PowerLightSampler picks lights in proportion to their emitted power.
+type PowerLightSampler struct {
+	lights []Light
+	table  *AliasTable
+	index  map[Light]int
+}
+
+func NewPowerLightSampler(lights []Light) *PowerLightSampler {
+	s := &PowerLightSampler{lights: lights, index: make(map[Light]int)}
+	power := make([]float64, len(lights))
+	for i, l := range lights {
+		power[i] = l.Power()
+		s.index[l] = i
+	}
+	s.table = NewAliasTable(power)
+	return s
+}
+
+func (s *PowerLightSampler) Sample(p, n Vector, u float64) (Light, float64) {
+	if len(s.lights) == 0 {
+		return nil, 0
+	}
+	i, pmf := s.table.Sample(u)
+	return s.lights[i], pmf
+}
+
+func (s *PowerLightSampler) Pmf(p, n Vector, light Light) float64 {
+	i, ok := s.index[light]
+	if !ok {
+		return 0
+	}
+	return s.table.Pmf(i)
+}
+
+// LightBounds bounds the position, emission directions and power of one or
+// more lights. Light leaves in directions within ThetaO of W, spreading a
+// further ThetaE around them.
+type LightBounds struct {
+	Bounds    Box
+	W         Vector
+	Phi       float64
+	CosThetaO float64
+	CosThetaE float64
+	TwoSided  bool
+}
+
+// lightBounds returns the bounds of a light, or false for lights at infinity.
+func lightBounds(l Light) (LightBounds, bool) {
+	switch l := l.(type) {
+	case *PointLight:
+		return LightBounds{Box{l.Position, l.Position}, Vector{0, 0, 1}, l.Power(), -1, 0, false}, true
+	case *SpotLight:
+		cosThetaE := math.Cos(math.Max(0, l.Angle-l.Falloff))
+		return LightBounds{Box{l.Position, l.Position}, l.Direction.Normalize(), l.Power(), math.Cos(l.Falloff), cosThetaE, false}, true
+	case *AreaLight:
+		w, cosThetaO := Vector{0, 0, 1}, -1.0
+		switch s := l.Shape.(type) {
+		case *Quad:
+			w, cosThetaO = s.Normal(), 1
+		case *Disc:
+			w, cosThetaO = s.Normal.Normalize(), 1
+		case *Triangle:
+			w, cosThetaO = s.GeometricNormal(), 1
+		case MeshTriangle:
+			w, cosThetaO = s.GeometricNormal(), 1
+		}
+		return LightBounds{l.Shape.BoundingBox(), w, l.Power(), cosThetaO, 0, l.TwoSided}, true
+	}
+	return LightBounds{}, false
+}
+
+func (b LightBounds) Centroid() Vector {
+	return b.Bounds.MidPoint()
+}
+
+// Union is bounds enclosing both b and o.
+func (b LightBounds) Union(o LightBounds) LightBounds {
+	if b.Phi == 0 {
+		return o
+	}
+	if o.Phi == 0 {
+		return b
+	}
+	box := b.Bounds
+	box.Extend(o.Bounds)
+	w, cosTheta := unionCones(b.W, b.CosThetaO, o.W, o.CosThetaO)
+	return LightBounds{box, w, b.Phi + o.Phi, cosTheta, math.Min(b.CosThetaE, o.CosThetaE), b.TwoSided || o.TwoSided}
+}
+
+// Importance estimates how much the lights could contribute at p, with an
+// upper bound on the angles involved. The normal n may be zero for points in
+// media.
+func (b LightBounds) Importance(p, n Vector) float64 {
+	pc := b.Centroid()
+	d := b.Bounds.Max.Subtract(b.Bounds.Min)
+	d2 := math.Max(p.Subtract(pc).SquaredLength(), d.Length()/2)
+
+	wi := p.Subtract(pc).Normalize()
+	cosThetaW := b.W.Dot(wi)
+	if b.TwoSided {
+		cosThetaW = math.Abs(cosThetaW)
+	}
+	sinThetaW := safeSqrt(1 - cosThetaW*cosThetaW)
+
+	// the directions from p to anywhere within the bounds
+	cosThetaB := boundSubtendedCos(b.Bounds, p)
+	sinThetaB := safeSqrt(1 - cosThetaB*cosThetaB)
+
+	// smallest angle between the emission cone and the direction to p
+	sinThetaO := safeSqrt(1 - b.CosThetaO*b.CosThetaO)
+	cosThetaX := cosSubClamped(sinThetaW, cosThetaW, sinThetaO, b.CosThetaO)
+	sinThetaX := sinSubClamped(sinThetaW, cosThetaW, sinThetaO, b.CosThetaO)
+	cosThetaP := cosSubClamped(sinThetaX, cosThetaX, sinThetaB, cosThetaB)
+	if cosThetaP <= b.CosThetaE {
+		return 0
+	}
+	importance := b.Phi * cosThetaP / d2
+
+	if n != (Vector{}) {
+		cosThetaI := math.Abs(wi.Dot(n.Normalize()))
+		sinThetaI := safeSqrt(1 - cosThetaI*cosThetaI)
+		importance *= cosSubClamped(sinThetaI, cosThetaI, sinThetaB, cosThetaB)
+	}
+	return math.Max(importance, 0)
+}
+
+// cosSubClamped is cos(max(0, a - b)) given the sines and cosines of a and b.
+func cosSubClamped(sinA, cosA, sinB, cosB float64) float64 {
+	if cosA > cosB {
+		return 1
+	}
+	return cosA*cosB + sinA*sinB
+}
+
+func sinSubClamped(sinA, cosA, sinB, cosB float64) float64 {
+	if cosA > cosB {
+		return 0
+	}
+	return sinA*cosB - cosA*sinB
+}
+
+func safeSqrt(x float64) float64 {
+	return math.Sqrt(math.Max(0, x))
+}
+
+// boundSubtendedCos is the cosine of the half angle of the cone from p that
+// contains the bounding sphere of b, -1 if p is inside it.
+func boundSubtendedCos(b Box, p Vector) float64 {
+	center := b.MidPoint()
+	r2 := b.Max.Subtract(center).SquaredLength()
+	d2 := p.Subtract(center).SquaredLength()
+	if d2 < r2 {
+		return -1
+	}
+	return safeSqrt(1 - r2/d2)
+}
+
+// unionCones returns the smallest cone containing two cones of directions.
+func unionCones(wa Vector, cosA float64, wb Vector, cosB float64) (Vector, float64) {
+	thetaA := math.Acos(math.Max(-1, math.Min(1, cosA)))
+	thetaB := math.Acos(math.Max(-1, math.Min(1, cosB)))
+	thetaD := math.Acos(math.Max(-1, math.Min(1, wa.Dot(wb))))
+	if math.Min(thetaD+thetaB, math.Pi) <= thetaA {
+		return wa, cosA
+	}
+	if math.Min(thetaD+thetaA, math.Pi) <= thetaB {
+		return wb, cosB
+	}
+	thetaO := (thetaA + thetaD + thetaB) / 2
+	if thetaO >= math.Pi {
+		return wa, -1
+	}
+	axis := wa.Cross(wb)
+	if axis.SquaredLength() == 0 {
+		return wa, -1
+	}
+	return rotateAround(wa, axis.Normalize(), thetaO-thetaA), math.Cos(thetaO)
+}
+
+// rotateAround rotates v by angle radians around the unit vector axis.
+func rotateAround(v, axis Vector, angle float64) Vector {
+	sin, cos := math.Sincos(angle)
+	return v.MultiplyScalar(cos).
+		Add(axis.Cross(v).MultiplyScalar(sin)).
+		Add(axis.MultiplyScalar(axis.Dot(v) * (1 - cos)))
+}
+
+// coneMeasure is the orientation term of the surface area orientation
+// heuristic: the solid angle a cone of emission directions reaches, weighted
+// by cosine.
+func coneMeasure(cosThetaO, cosThetaE float64) float64 {
+	thetaO := math.Acos(math.Max(-1, math.Min(1, cosThetaO)))
+	thetaE := math.Acos(math.Max(-1, math.Min(1, cosThetaE)))
+	thetaW := math.Min(thetaO+thetaE, math.Pi)
+	sinThetaO := math.Sin(thetaO)
+	return 2*math.Pi*(1-cosThetaO) +
+		math.Pi/2*(2*thetaW*sinThetaO-math.Cos(thetaO-2*thetaW)-2*thetaO*sinThetaO+cosThetaO)
+}
+
+type lightNode struct {
+	bounds LightBounds
+	// children are at the next index and at child, leaves hold light
+	child int
+	light int
+	leaf  bool
+}
+
+// BVHLightSampler organises the lights in a bounding volume hierarchy of
+// LightBounds (Conty Estevez and Kulla, "Importance Sampling of Many Lights
+// with Adaptive Tree Splitting") and descends it towards the lights that are
+// likely to matter for the shading point. Lights at infinity are picked
+// uniformly alongside the tree.
+type BVHLightSampler struct {
+	lights   []Light
+	infinite []Light
+	nodes    []lightNode
+	// bit trails from the root to each light, for Pmf
+	trails map[Light]uint64
+}
+
+func NewBVHLightSampler(lights []Light) *BVHLightSampler {
+	s := &BVHLightSampler{lights: lights, trails: make(map[Light]uint64)}
+	type entry struct {
+		index  int
+		bounds LightBounds
+	}
+	var bounded []entry
+	for i, l := range lights {
+		b, ok := lightBounds(l)
+		if !ok {
+			s.infinite = append(s.infinite, l)
+		} else if b.Phi > 0 {
+			bounded = append(bounded, entry{i, b})
+		}
+	}
+	if len(bounded) == 0 {
+		return s
+	}
+
+	var build func(entries []entry, trail uint64, depth int) LightBounds
+	build = func(entries []entry, trail uint64, depth int) LightBounds {
+		if len(entries) == 1 {
+			s.nodes = append(s.nodes, lightNode{bounds: entries[0].bounds, light: entries[0].index, leaf: true})
+			s.trails[lights[entries[0].index]] = trail
+			return entries[0].bounds
+		}
+		centroids := Box{Vector{math.Inf(1), math.Inf(1), math.Inf(1)}, Vector{math.Inf(-1), math.Inf(-1), math.Inf(-1)}}
+		for _, e := range entries {
+			c := e.bounds.Centroid()
+			centroids.Extend(Box{c, c})
+		}
+		axis, split := s.split(len(entries), func(i int) LightBounds { return entries[i].bounds }, centroids)
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].bounds.Centroid().Get(axis) < entries[j].bounds.Centroid().Get(axis)
+		})
+		// keep the bit trails within 64 bits by halving deep trees
+		if split <= 0 || split >= len(entries) || depth >= 32 {
+			split = len(entries) / 2
+		}
+
+		node := len(s.nodes)
+		s.nodes = append(s.nodes, lightNode{})
+		left := build(entries[:split], trail, depth+1)
+		s.nodes[node].child = len(s.nodes)
+		right := build(entries[split:], trail|1<<uint(depth), depth+1)
+		s.nodes[node].bounds = left.Union(right)
+		return s.nodes[node].bounds
+	}
+	build(bounded, 0, 0)
+	return s
+}
+
+// split chooses the axis and position that minimise the surface area
+// orientation heuristic, evaluated over buckets of centroids. The position is
+// the number of entries that go to the left once sorted along the axis.
+func (s *BVHLightSampler) split(n int, bounds func(int) LightBounds, centroids Box) (Axis, int) {
+	const buckets = 12
+	extent := centroids.Max.Subtract(centroids.Min)
+	bestAxis, bestSplit, bestCost := AxisX, n/2, math.Inf(1)
+	for _, axis := range []Axis{AxisX, AxisY, AxisZ} {
+		if extent.Get(axis) == 0 {
+			continue
+		}
+		var bucketBounds [buckets]LightBounds
+		var counts [buckets]int
+		for i := 0; i < n; i++ {
+			b := bounds(i)
+			k := int(buckets * (b.Centroid().Get(axis) - centroids.Min.Get(axis)) / extent.Get(axis))
+			k = clampIndex(k, buckets)
+			bucketBounds[k] = bucketBounds[k].Union(b)
+			counts[k]++
+		}
+		for k := 0; k < buckets-1; k++ {
+			var left, right LightBounds
+			var nLeft int
+			for i := 0; i <= k; i++ {
+				left = left.Union(bucketBounds[i])
+				nLeft += counts[i]
+			}
+			for i := k + 1; i < buckets; i++ {
+				right = right.Union(bucketBounds[i])
+			}
+			if nLeft == 0 || nLeft == n {
+				continue
+			}
+			cost := lightCost(left, extent, axis) + lightCost(right, extent, axis)
+			if cost < bestCost {
+				bestAxis, bestSplit, bestCost = axis, nLeft, cost
+			}
+		}
+	}
+	return bestAxis, bestSplit
+}
+
+func lightCost(b LightBounds, extent Vector, axis Axis) float64 {
+	d := b.Bounds.Max.Subtract(b.Bounds.Min)
+	area := 2 * (d.X*d.Y + d.X*d.Z + d.Y*d.Z)
+	// penalise thin boxes, which the area alone undervalues
+	maxExtent := math.Max(extent.X, math.Max(extent.Y, extent.Z))
+	regularity := 1.0
+	if e := extent.Get(axis); e > 0 {
+		regularity = maxExtent / e
+	}
+	return b.Phi * coneMeasure(b.CosThetaO, b.CosThetaE) * area * regularity
+}
+
+func (s *BVHLightSampler) pInfinite() float64 {
+	n := float64(len(s.infinite))
+	if len(s.nodes) > 0 {
+		return n / (n + 1)
+	}
+	if n > 0 {
+		return 1
+	}
+	return 0
+}
+
+func (s *BVHLightSampler) Sample(p, n Vector, u float64) (Light, float64) {
+	pInf := s.pInfinite()
+	if u < pInf {
+		i := clampIndex(int(u/pInf*float64(len(s.infinite))), len(s.infinite))
+		return s.infinite[i], pInf / float64(len(s.infinite))
+	}
+	if len(s.nodes) == 0 {
+		return nil, 0
+	}
+	u = math.Min((u-pInf)/(1-pInf), 1-EPS)
+	pmf := 1 - pInf
+	i := 0
+	for !s.nodes[i].leaf {
+		c0, c1 := i+1, s.nodes[i].child
+		i0 := s.nodes[c0].bounds.Importance(p, n)
+		i1 := s.nodes[c1].bounds.Importance(p, n)
+		if i0 == 0 && i1 == 0 {
+			return nil, 0
+		}
+		p0 := i0 / (i0 + i1)
+		if u < p0 {
+			i, pmf, u = c0, pmf*p0, math.Min(u/p0, 1-EPS)
+		} else {
+			i, pmf, u = c1, pmf*(1-p0), math.Min((u-p0)/(1-p0), 1-EPS)
+		}
+	}
+	if s.nodes[i].bounds.Importance(p, n) == 0 {
+		return nil, 0
+	}
+	return s.lights[s.nodes[i].light], pmf
+}
+
+func (s *BVHLightSampler) Pmf(p, n Vector, light Light) float64 {
+	trail, ok := s.trails[light]
+	pInf := s.pInfinite()
+	if !ok {
+		for _, l := range s.infinite {
+			if l == light {
+				return pInf / float64(len(s.infinite))
+			}
+		}
+		return 0
+	}
+	pmf := 1 - pInf
+	i := 0
+	for depth := 0; !s.nodes[i].leaf; depth++ {
+		c0, c1 := i+1, s.nodes[i].child
+		i0 := s.nodes[c0].bounds.Importance(p, n)
+		i1 := s.nodes[c1].bounds.Importance(p, n)
+		if i0 == 0 && i1 == 0 {
+			return 0
+		}
+		if trail&(1<<uint(depth)) == 0 {
+			i, pmf = c0, pmf*i0/(i0+i1)
+		} else {
+			i, pmf = c1, pmf*i1/(i0+i1)
+		}
+	}
+	return pmf
+}
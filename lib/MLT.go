@@ -0,0 +1,276 @@
+package lib
+
+import (
+	"image"
+	"math"
+	"math/rand"
+	"sync"
+)
+
+// MLT is primary sample space Metropolis light transport (Kelemen et al., "A
+// Simple and Robust Mutation Strategy for the Metropolis Light Transport
+// Algorithm"). Paths are generated by the bidirectional path tracer from a
+// vector of random numbers, and Markov chains explore the space of these
+// vectors, mixing small perturbations with fresh random vectors. Each chain
+// sticks to one path depth and picks one BDPT strategy per path.
+//
+// The chains spend their time in proportion to the brightness of the image,
+// whose total is estimated beforehand from Bootstrap random paths per depth.
+type MLT struct {
+	MaxDepth             int
+	Bootstrap            int
+	Chains               int
+	SigmaSmall           float64 // standard deviation of small step perturbations
+	LargeStepProbability float64
+
+	bdpt *BDPT
+}
+
+func NewMLT(scene *Scene, maxDepth int) *MLT {
+	return &MLT{
+		MaxDepth:             maxDepth,
+		Bootstrap:            100000,
+		Chains:               1000,
+		SigmaSmall:           .01,
+		LargeStepProbability: .3,
+		bdpt:                 NewBDPT(scene, maxDepth),
+	}
+}
+
+// the random numbers for each part of a path come from their own stream, so
+// that the numbers used by one part don't shift when another uses more
+const (
+	cameraStream = iota
+	lightStream
+	connectionStream
+	streamCount
+)
+
+type primarySample struct {
+	value, backup                    float64
+	lastModified, lastModifiedBackup int64
+}
+
+// mltSampler is a rand.Source handing out the numbers of a primary sample
+// vector, which it mutates lazily as they are asked for.
+type mltSampler struct {
+	rnd                  *rand.Rand
+	sigma                float64
+	largeStepProbability float64
+
+	x                        []primarySample
+	iteration, lastLargeStep int64
+	largeStep                bool
+	stream, index            int
+}
+
+func newMLTSampler(seed int64, sigma, largeStepProbability float64) *mltSampler {
+	return &mltSampler{
+		rnd:                  rand.New(rand.NewSource(seed)),
+		sigma:                sigma,
+		largeStepProbability: largeStepProbability,
+		largeStep:            true,
+	}
+}
+
+func (s *mltSampler) Int63() int64 {
+	// 53 bits, as many as rand.Float64 keeps
+	return int64(s.next()*(1<<53)) << 10
+}
+
+func (s *mltSampler) Seed(int64) {}
+
+func (s *mltSampler) startStream(stream int) {
+	s.stream = stream
+	s.index = 0
+}
+
+func (s *mltSampler) startIteration() {
+	s.iteration++
+	s.largeStep = s.rnd.Float64() < s.largeStepProbability
+	s.startStream(cameraStream)
+}
+
+func (s *mltSampler) next() float64 {
+	i := s.index*streamCount + s.stream
+	s.index++
+	for i >= len(s.x) {
+		s.x = append(s.x, primarySample{})
+	}
+	x := &s.x[i]
+	if x.lastModified < s.lastLargeStep {
+		// not asked for since the last large step, which replaced it
+		x.value = s.rnd.Float64()
+		x.lastModified = s.lastLargeStep
+	}
+	x.backup, x.lastModifiedBackup = x.value, x.lastModified
+	if s.largeStep {
+		x.value = s.rnd.Float64()
+	} else {
+		// all the small steps it missed at once
+		sigma := s.sigma * math.Sqrt(float64(s.iteration-x.lastModified))
+		x.value += s.rnd.NormFloat64() * sigma
+		x.value -= math.Floor(x.value)
+	}
+	x.lastModified = s.iteration
+	return x.value
+}
+
+func (s *mltSampler) accept() {
+	if s.largeStep {
+		s.lastLargeStep = s.iteration
+	}
+}
+
+func (s *mltSampler) reject() {
+	for i := range s.x {
+		if x := &s.x[i]; x.lastModified == s.iteration {
+			x.value, x.lastModified = x.backup, x.lastModifiedBackup
+		}
+	}
+	s.iteration--
+}
+
+// l is the contribution of the path of the given depth made from the
+// sampler's primary sample vector, and its film position.
+func (m *MLT) l(ctx *SampleContext, sampler *mltSampler, depth int) (L RGB, fs, ft float64) {
+	sampler.startStream(cameraStream)
+	strategies := depth + 2
+	s, t := 0, 2
+	if depth > 0 {
+		s = int(sampler.next() * float64(strategies))
+		if s >= strategies {
+			s = strategies - 1
+		}
+		t = strategies - s
+	} else {
+		strategies = 1
+	}
+	fs, ft = sampler.next(), sampler.next()
+	r := ctx.Camera.RayAt(fs, ft, ctx.Rand)
+	r.Direction = r.Direction.Normalize()
+	camera := make([]pathVertex, t)
+	if m.bdpt.cameraSubpath(r, ctx, camera) != t {
+		return
+	}
+	sampler.startStream(lightStream)
+	light := make([]pathVertex, s)
+	if s > 0 && m.bdpt.lightSubpath(ctx, light) != s {
+		return
+	}
+	sampler.startStream(connectionStream)
+	c, ps, pt := m.bdpt.connect(ctx, light, camera, s, t)
+	if t == 1 {
+		fs, ft = ps, pt
+	}
+	return c.MultiplyScalar(float64(strategies)), fs, ft
+}
+
+// Render adds an image to film made with mutationsPerPixel mutations per
+// pixel on average, spread over all chains and run on the given number of
+// goroutines. film covers the whole width by height image.
+func (m *MLT) Render(scene *Scene, cam *Camera, film *Buffer, width, height, mutationsPerPixel int, seed int64, threads int) {
+	var intersections int
+	newContext := func(sampler *mltSampler) *SampleContext {
+		return &SampleContext{
+			Scene:         scene,
+			Camera:        cam,
+			Rand:          rand.New(sampler),
+			Intersections: &intersections,
+			Width:         width,
+			Height:        height,
+			Region:        image.Rect(0, 0, width, height),
+		}
+	}
+	depths := m.MaxDepth + 1
+
+	// the brightness of random paths, which the chains start from
+	weights := make([]float64, m.Bootstrap*depths)
+	parallel(len(weights), threads, func(i int) {
+		sampler := newMLTSampler(seed+int64(i), m.SigmaSmall, m.LargeStepProbability)
+		L, _, _ := m.l(newContext(sampler), sampler, i%depths)
+		weights[i] = L.Luminance()
+	})
+	var sum float64
+	for _, w := range weights {
+		sum += w
+	}
+	if sum == 0 {
+		return
+	}
+	b := sum / float64(m.Bootstrap)
+	bootstrap := NewDistribution1D(weights)
+	rnd := rand.New(rand.NewSource(seed))
+	starts := make([]int, m.Chains)
+	for i := range starts {
+		starts[i], _ = bootstrap.SampleDiscrete(rnd.Float64())
+	}
+
+	splat := func(fs, ft float64, c RGB) {
+		x, y := int(fs*float64(width)), int(ft*float64(height))
+		if x >= 0 && x < width && y >= 0 && y < height {
+			film.AddSplat(x, y, c.MultiplyScalar(b))
+		}
+	}
+	total := int64(mutationsPerPixel) * int64(width) * int64(height)
+	parallel(m.Chains, threads, func(chain int) {
+		mutations := (int64(chain)+1)*total/int64(m.Chains) - int64(chain)*total/int64(m.Chains)
+		start := starts[chain]
+		depth := start % depths
+		// replay the bootstrap path to start from
+		sampler := newMLTSampler(seed+int64(start), m.SigmaSmall, m.LargeStepProbability)
+		ctx := newContext(sampler)
+		L, fs, ft := m.l(ctx, sampler, depth)
+		sampler.rnd.Seed(seed ^ int64(chain+1)<<32)
+		for i := int64(0); i < mutations; i++ {
+			sampler.startIteration()
+			proposed, ps, pt := m.l(ctx, sampler, depth)
+			accept := 0.0
+			if I := proposed.Luminance(); I > 0 {
+				accept = math.Min(1, I/L.Luminance())
+			}
+			// splat both paths by their expected share of the next state
+			if accept > 0 {
+				splat(ps, pt, proposed.MultiplyScalar(accept/proposed.Luminance()))
+			}
+			if accept < 1 {
+				splat(fs, ft, L.MultiplyScalar((1-accept)/L.Luminance()))
+			}
+			if sampler.rnd.Float64() < accept {
+				L, fs, ft = proposed, ps, pt
+				sampler.accept()
+			} else {
+				sampler.reject()
+			}
+		}
+	})
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			film.AddLightPath(x, y, float64(mutationsPerPixel))
+		}
+	}
+}
+
+// parallel calls f for 0 <= i < n on the given number of goroutines.
+func parallel(n, threads int, f func(i int)) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	next := 0
+	for t := 0; t < threads; t++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				i := next
+				next++
+				mu.Unlock()
+				if i >= n {
+					return
+				}
+				f(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,348 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"hash"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// mtl collects the statements of one MTL material, which may come in any
+// order, until they can be mapped onto a Material. Its fields are exported
+// for the mesh cache, which keeps them for textured materials.
+type mtl struct {
+	Kd, Ks, Ke, Tf RGB
+	Ns, Ni         float64
+	D              float64 // dissolve, 1 is opaque
+	Pr, Pm         float64 // roughness and metallic
+	Illum          int
+	Has            map[string]bool
+	Maps           map[string]*Texture // by statement, such as map_Kd
+}
+
+// mtlTextures are the texture maps of an MTL material. At each hit they
+// replace the values they set and map the statements onto the parent again,
+// as LoadMTL did with their averages.
+type mtlTextures struct {
+	Parent Material
+	MTL    mtl
+}
+
+func init() {
+	// materials with textures go into mesh caches
+	gob.Register(&mtlTextures{})
+}
+
+func (t *mtlTextures) Apply(m *Material, uv Vector) {
+	v := t.MTL
+	for keyword, tex := range v.Maps {
+		v.set(keyword, tex.At(uv))
+	}
+	at := t.Parent
+	v.apply(&at)
+	at.Textures = m.Textures
+	*m = at
+}
+
+func (t *mtlTextures) Hash(h hash.Hash64) {
+	hashMaterial(h, &t.Parent)
+	v := &t.MTL
+	hashValue(h, [...]RGB{v.Kd, v.Ks, v.Ke, v.Tf})
+	hashValue(h, [...]float64{v.Ns, v.Ni, v.D, v.Pr, v.Pm, float64(v.Illum)})
+	keywords := make([]string, 0, len(v.Has))
+	for k := range v.Has {
+		keywords = append(keywords, k)
+	}
+	sort.Strings(keywords)
+	for _, k := range keywords {
+		fmt.Fprintf(h, "%q", k)
+		if tex := v.Maps[k]; tex != nil {
+			tex.hash(h)
+		}
+	}
+}
+
+// LoadMTL reads the materials of an MTL file into materials, starting each
+// from parent. Texture maps are looked up at every hit; the materials hold
+// their averages for whatever needs a single value, such as lights. It
+// returns the files it refers to, the MTL file and the images of its texture
+// maps, whether they could be read or not. A missing MTL file has no
+// materials.
+func LoadMTL(path string, parent Material, materials map[string]*Material) ([]string, error) {
+	fmt.Printf("Loading MTL: %s\n", path)
+	files := []string{path}
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return files, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	var name string
+	var m *mtl
+	warned := make(map[string]bool)
+	warn := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		if !warned[msg] {
+			warned[msg] = true
+			fmt.Printf("%s: %s\n", path, msg)
+		}
+	}
+	finish := func() {
+		if m != nil {
+			material := parent
+			m.apply(&material)
+			if len(m.Maps) > 0 {
+				material.Textures = &mtlTextures{parent, *m}
+			}
+			materials[name] = &material
+		}
+	}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		keyword, args := splitStatement(scanner.Text())
+		if keyword == "" {
+			continue
+		}
+		if keyword == "newmtl" {
+			finish()
+			name = joinArgs(args)
+			m = &mtl{D: 1, Ni: parent.Index, Has: make(map[string]bool)}
+			continue
+		}
+		if m == nil {
+			warn("line %d: %s before newmtl", line, keyword)
+			continue
+		}
+		var err error
+		switch keyword {
+		case "Kd", "Ks", "Ke", "Tf":
+			var c RGB
+			if c, err = parseColor(args); err == nil {
+				m.set(keyword, c)
+			}
+		case "Ns", "Ni", "d", "Tr", "Pr", "Pm":
+			var f float64
+			if f, err = parseFactor(args); err == nil {
+				m.set(keyword, RGB{f, f, f})
+			}
+		case "illum":
+			if len(args) == 0 {
+				err = fmt.Errorf("missing value")
+			} else {
+				m.Illum, err = strconv.Atoi(args[0])
+			}
+		case "map_Kd", "map_Ks", "map_Ke", "map_d", "map_Pr", "map_Pm":
+			if len(args) == 0 {
+				err = fmt.Errorf("missing file name")
+				break
+			}
+			// options come before the file name
+			var tex *Texture
+			colour := keyword == "map_Kd" || keyword == "map_Ks" || keyword == "map_Ke"
+			texture := RelativePath(path, args[len(args)-1])
+			files = append(files, texture)
+			if tex, err = loadTexture(texture, colour); err != nil {
+				break
+			}
+			if m.Maps == nil {
+				m.Maps = make(map[string]*Texture)
+			}
+			m.Maps[keyword] = tex
+			m.set(keyword, tex.Average())
+		case "Ka", "map_Ka":
+			// there is no ambient light to reflect
+			continue
+		default:
+			warn("%s is not supported", keyword)
+			continue
+		}
+		if err != nil {
+			warn("line %d: %s: %v", line, keyword, err)
+			continue
+		}
+		m.Has[keyword] = true
+	}
+	finish()
+	return files, scanner.Err()
+}
+
+// set gives the value of a statement or texture map, factors as grey.
+func (m *mtl) set(keyword string, c RGB) {
+	switch keyword {
+	case "Kd", "map_Kd":
+		m.Kd = c
+	case "Ks", "map_Ks":
+		m.Ks = c
+	case "Ke", "map_Ke":
+		m.Ke = c
+	case "Tf":
+		m.Tf = c
+	case "Ns":
+		m.Ns = c.R
+	case "Ni":
+		m.Ni = c.R
+	case "d", "map_d":
+		m.D = c.R
+	case "Tr":
+		m.D = 1 - c.R
+	case "Pr", "map_Pr":
+		m.Pr = c.R
+	case "Pm", "map_Pm":
+		m.Pm = c.R
+	}
+}
+
+// apply maps the statements onto the material model: Kd is the colour, Ks
+// and Ns a glossy reflection unless the PBR roughness and metallic factors are
+// given, d, Tr and illum make glass, and Ke makes an emitter.
+func (m *mtl) apply(material *Material) {
+	has := func(keys ...string) bool {
+		for _, k := range keys {
+			if m.Has[k] {
+				return true
+			}
+		}
+		return false
+	}
+	if has("Kd", "map_Kd") {
+		material.Col = m.Kd
+	}
+	if has("Ni") {
+		material.Index = m.Ni
+	}
+
+	// reflection
+	switch {
+	case has("Pr", "Pm", "map_Pr", "map_Pm"):
+		// dielectrics reflect about 4% of the light, metals their colour
+		material.Reflectivity = .04 + .96*m.Pm
+		material.Tint = m.Pm
+		material.Gloss = m.Pr * math.Pi / 2
+	case has("Ks", "map_Ks") && m.Illum != 0 && m.Illum != 1:
+		material.Reflectivity = m.Ks.MaxComponent()
+		if has("Ns") {
+			// the angle at which a Phong lobe falls to half its peak
+			material.Gloss = math.Acos(math.Pow(.5, 1/math.Max(m.Ns, 1)))
+		}
+	}
+	switch m.Illum {
+	case 3, 5, 8:
+		// reflections are on, with a mirror if no specular colour is given
+		if !has("Ks", "map_Ks", "Pm", "map_Pm") {
+			material.Reflectivity = 1
+		}
+	}
+
+	// transmission
+	transparency := 1 - m.D
+	switch m.Illum {
+	case 4, 6, 7, 9:
+		if transparency == 0 {
+			transparency = 1
+		}
+	}
+	if transparency > 0 {
+		material.Transparency = transparency
+		if has("Tf") {
+			material.Col = m.Tf
+		}
+	}
+
+	// emission
+	if max := m.Ke.MaxComponent(); max > 0 {
+		material.Emission = m.Ke.DivScalar(max)
+		material.Emittance = max
+	}
+}
+
+func parseColor(args []string) (RGB, error) {
+	if len(args) > 0 && (args[0] == "spectral" || args[0] == "xyz") {
+		return RGB{}, fmt.Errorf("%s colours are not supported", args[0])
+	}
+	f, err := parseNumbers(args)
+	switch {
+	case err != nil:
+		return RGB{}, err
+	case len(f) == 0:
+		return RGB{}, fmt.Errorf("missing value")
+	case len(f) < 3:
+		// a single value is grey
+		return RGB{f[0], f[0], f[0]}, nil
+	}
+	return RGB{f[0], f[1], f[2]}, nil
+}
+
+func parseFactor(args []string) (float64, error) {
+	// d may be preceded by -halo
+	if len(args) > 1 && args[0] == "-halo" {
+		args = args[1:]
+	}
+	f, err := parseNumbers(args)
+	if err != nil {
+		return 0, err
+	}
+	if len(f) == 0 {
+		return 0, fmt.Errorf("missing value")
+	}
+	return f[0], nil
+}
+
+// parseNumbers parses finite numbers. NaN and infinities are refused, as
+// nothing can be built from them.
+func parseNumbers(args []string) ([]float64, error) {
+	result := make([]float64, len(args))
+	for i, a := range args {
+		f, err := strconv.ParseFloat(a, 64)
+		if err != nil {
+			return nil, err
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("%s is not a finite number", a)
+		}
+		result[i] = f
+	}
+	return result, nil
+}
+
+// loadTexture reads an image as a texture, in linear RGB if colour is set,
+// which undoes the sRGB gamma of colour textures.
+func loadTexture(path string, colour bool) (*Texture, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+	return NewTexture(img, colour), nil
+}
+
+// splitStatement splits a line of an OBJ or MTL file into its keyword and
+// arguments, dropping comments.
+func splitStatement(line string) (string, []string) {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return fields[0], fields[1:]
+}
+
+// joinArgs gives back names containing spaces.
+func joinArgs(args []string) string {
+	return strings.Join(args, " ")
+}
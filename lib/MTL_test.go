@@ -0,0 +1,120 @@
+package lib
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTexels writes a 2x2 image, given by rows from the top.
+func writeTexels(t *testing.T, path string, texels [4]color.Gray) {
+	img := image.NewGray(image.Rect(0, 0, 2, 2))
+	for i, c := range texels {
+		img.SetGray(i%2, i/2, c)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := png.Encode(file, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMTLTextures(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	// the unit square in the xy plane, with texture coordinates to match
+	obj := write("quad.obj", `mtllib quad.mtl
+v 0 0 0
+v 1 0 0
+v 1 1 0
+v 0 1 0
+vt 0 0
+vt 1 0
+vt 1 1
+vt 0 1
+usemtl m
+f 1/1 2/2 3/3
+f 1/1 3/3 4/4
+`)
+	write("quad.mtl", "newmtl m\nKd .5 .5 .5\nmap_Kd kd.png\nmap_d -blendu on d.png\n")
+	kd := [4]color.Gray{{0}, {255}, {128}, {64}}
+	writeTexels(t, filepath.Join(dir, "kd.png"), kd)
+	// opaque at the top, clear at the bottom
+	writeTexels(t, filepath.Join(dir, "d.png"), [4]color.Gray{{255}, {255}, {0}, {0}})
+
+	tests := []struct {
+		x, y         float64
+		texel        color.Gray
+		transparency float64
+	}{
+		{.25, .75, kd[0], 0},
+		{.75, .75, kd[1], 0},
+		{.25, .25, kd[2], 1},
+		{.75, .25, kd[3], 1},
+	}
+	// the second time from the cache
+	for _, cached := range []bool{false, true} {
+		m, err := LoadCachedMesh(obj, Vector{}, 1, Material{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readMeshCache(obj+MeshCacheExt, Material{}); err != nil {
+			t.Fatalf("cache not written: %v", err)
+		}
+		// the material itself has the averages
+		average := RGB{1, 1, 1}.MultiplyScalar((math.Pow(128./255, 2.2) + math.Pow(64./255, 2.2) + 1) / 4)
+		if mat := m.Materials[0]; math.Abs(mat.Col.R-average.R) > 1e-9 || mat.Transparency != .5 {
+			t.Errorf("cached %v: colour %v and transparency %v, want the averages %v and .5", cached, mat.Col, mat.Transparency, average)
+		}
+		for _, test := range tests {
+			ok, hit := m.Hit(Ray{Vector{test.x, test.y, 1}, Vector{0, 0, -1}}, 0, math.MaxFloat64)
+			if !ok {
+				t.Fatalf("missed the quad at %v, %v", test.x, test.y)
+			}
+			v := math.Pow(float64(test.texel.Y)/255, 2.2)
+			s := hit.Surface()
+			if math.Abs(s.Col.R-v) > 1e-9 || math.Abs(s.Col.G-v) > 1e-9 || math.Abs(s.Col.B-v) > 1e-9 {
+				t.Errorf("cached %v: colour at %v, %v is %v, want %v", cached, test.x, test.y, s.Col, v)
+			}
+			if s.Transparency != test.transparency {
+				t.Errorf("cached %v: transparency at %v, %v is %v, want %v", cached, test.x, test.y, s.Transparency, test.transparency)
+			}
+		}
+	}
+}
+
+func TestMTLTexturesHash(t *testing.T) {
+	dir := t.TempDir()
+	mtl := filepath.Join(dir, "m.mtl")
+	if err := ioutil.WriteFile(mtl, []byte("newmtl m\nmap_Kd kd.png\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	hash := func(texels [4]color.Gray) uint64 {
+		writeTexels(t, filepath.Join(dir, "kd.png"), texels)
+		materials := make(map[string]*Material)
+		if _, err := LoadMTL(mtl, Material{}, materials); err != nil {
+			t.Fatal(err)
+		}
+		scene := &Scene{}
+		scene.Add(&Sphere{Radius: 1, Mat: materials["m"]})
+		return scene.Hash(NewCamera(Vector{0, 0, -5}, Vector{}, 45, 1, 0))
+	}
+	// the same average, arranged differently
+	if hash([4]color.Gray{{0}, {255}, {0}, {255}}) == hash([4]color.Gray{{255}, {0}, {255}, {0}}) {
+		t.Error("materials with different textures hash the same")
+	}
+}
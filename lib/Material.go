@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"hash"
 	"math"
 	"math/rand"
 )
@@ -11,52 +12,79 @@ type Material struct {
 	Reflectivity float64
 	Transparency float64 // the amount of light to let through
 	Gloss        float64 // reflection cone angle in radians
+	Emission     RGB     // colour of the emitted light, scaled by Emittance
 	Emittance    float64
 	Tint         float64
+	TwoSided     bool // emit from the back of surfaces as well
+
+	// Dispersion, only seen in spectral renders. The refractive index at a
+	// wavelength of l micrometres is Index + CauchyB/l² + CauchyC/l⁴, unless
+	// Sellmeier coefficients are given.
+	CauchyB, CauchyC float64
+	Sellmeier        Sellmeier
+
+	// Textures vary the material over surfaces, nil if it is uniform
+	Textures Textures
 }
-type BounceType uint8
 
-const (
-	BounceTypeAny BounceType = iota
-	BounceTypeSpecular
-	BounceTypeDiffuse
-)
+// Textures vary a material by the texture coordinates of hits.
+type Textures interface {
+	// Apply changes m, a copy of the material, to how it is at uv.
+	Apply(m *Material, uv Vector)
+	Hash(h hash.Hash64)
+}
 
-func (m *Material) Color() RGB {
-	return m.Col
+// Sellmeier holds the coefficients of the Sellmeier equation
+// n² = 1 + sum of B[i]*l²/(l²-C[i]), with l in micrometres.
+type Sellmeier struct {
+	B, C [3]float64
 }
 
-func (m *Material) Bounce(r Ray, fu, fv float64, bounceType BounceType, hit Hit, rnd *rand.Rand) (reflectedRay Ray, reflected bool, weight float64) {
+// SellmeierBK7 describes Schott N-BK7 crown glass.
+var SellmeierBK7 = Sellmeier{
+	B: [3]float64{1.03961212, 0.231792344, 1.01046945},
+	C: [3]float64{0.00600069867, 0.0200179144, 103.560653},
+}
 
-	var direction Vector
+// SellmeierSF11 describes Schott SF11 dense flint glass, which disperses
+// light much more strongly.
+var SellmeierSF11 = Sellmeier{
+	B: [3]float64{1.73759695, 0.313747346, 1.89878101},
+	C: [3]float64{0.013188707, 0.0623068142, 155.23629},
+}
 
-	p := m.Reflectivity
-	switch bounceType {
-	case BounceTypeAny:
-		reflected = rnd.Float64() < p
-	case BounceTypeSpecular:
-		reflected = true
-	case BounceTypeDiffuse:
-		reflected = false
-	}
+func (m *Material) Color() RGB {
+	return m.Col
+}
 
-	if reflected {
-		// we should reflect
-		reflectDirection := r.Direction.Reflect(hit.Normal)
-		direction = Cone(reflectDirection, m.Gloss, fu, fv, rnd)
-		weight = p
-	} else if m.Transparency > 0 {
-		direction = hit.Normal.Refract(r.Direction, m.Index)
-		direction = Cone(direction, m.Gloss, fu, fv, rnd)
-		hit.Point = hit.Point.Add(direction.MultiplyScalar(1e-4))
-		weight = 1 - p
-	} else {
-		direction = hit.Normal.Add(VectorInUnitSphere(rnd))
-		weight = 1 - p
+// At is the material at the texture coordinates uv: m itself if it has no
+// textures, otherwise a copy with them applied.
+func (m *Material) At(uv Vector) *Material {
+	if m == nil || m.Textures == nil {
+		return m
 	}
+	at := *m
+	m.Textures.Apply(&at, uv)
+	return &at
+}
 
-	reflectedRay = Ray{hit.Point, direction.Normalize()}
-	return
+// Dispersive reports whether the refractive index depends on the wavelength.
+func (m *Material) Dispersive() bool {
+	return m.CauchyB != 0 || m.CauchyC != 0 || m.Sellmeier != (Sellmeier{})
+}
+
+// IndexAt is the refractive index at a wavelength given in nanometres.
+func (m *Material) IndexAt(wavelength float64) float64 {
+	l := wavelength / 1000
+	l2 := l * l
+	if m.Sellmeier != (Sellmeier{}) {
+		n2 := 1.0
+		for i, b := range m.Sellmeier.B {
+			n2 += b * l2 / (l2 - m.Sellmeier.C[i])
+		}
+		return math.Sqrt(n2)
+	}
+	return m.Index + m.CauchyB/l2 + m.CauchyC/(l2*l2)
 }
 
 func Lambertian(c RGB) *Material {
@@ -68,11 +96,13 @@ func Metal(c RGB, gloss, reflectivity, tint float64) *Material {
 func Transparent(c RGB, index, gloss, reflectivity, transparency float64) *Material {
 	return &Material{Col: c, Index: index, Gloss: gloss, Reflectivity: reflectivity, Transparency: transparency}
 }
-func Light(c RGB, emittance float64) *Material {
-	return &Material{Col: c, Emittance: emittance, Reflectivity: -1}
+
+// Emissive makes a material that emits light and reflects none.
+func Emissive(c RGB, emittance float64) *Material {
+	return &Material{Emission: c, Emittance: emittance}
 }
 
-func Cone(direction Vector, theta, u, v float64, rnd *rand.Rand) Vector {
+func GlossCone(direction Vector, theta, u, v float64, rnd *rand.Rand) Vector {
 	if theta < EPS {
 		return direction
 	}
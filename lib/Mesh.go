@@ -1,190 +1,614 @@
 package lib
 
 import (
-	"bufio"
-	"fmt"
 	"math"
 	"math/rand"
-	"os"
 	"path"
-	"strconv"
-	"strings"
 )
 
+// Mesh is a triangle mesh with shared vertices: every triangle is three
+// indices into the vertex arrays. The mesh has a tree of its own over the
+// triangles, which refers to them by index, so they need no objects of their
+// own.
 type Mesh struct {
-	Triangles []*Triangle
+	Positions []Vector
+	Normals   []Vector // zero for vertices of flat faces, nil if all are
+	UVs       []Vector // nil if the mesh has no texture coordinates
+	Colors    []RGB    // replace the colour of the materials, nil if they don't
+	Indices   []uint32 // three vertices per triangle
+	Materials []*Material
 	Box       *Box
-	Tree      *KDNode
 	Center    Vector
+	Groups    []*MeshGroup
+	// unit vectors in the tangent plane along which normal maps vary, zero
+	// for vertices without them, nil if all are
+	Tangents, Bitangents []Vector
+
+	nodes []meshNode
+	areas *Distribution1D
+}
+
+// MeshGroup is a named part of a mesh, from the o and g statements of an OBJ
+// file or the nodes of a glTF file. Triangles are indices into the mesh.
+type MeshGroup struct {
+	Object, Group string
+	Triangles     []uint32
+}
+
+// meshNode is a node of the mesh's tree, stored depth first so that the first
+// child of an inner node follows it. Leaves have count triangles from start.
+type meshNode struct {
+	box          Box
+	right        int32
+	start, count int32
+	axis         Axis
 }
 
+// meshLeafSize is the number of triangles below which nodes aren't split.
+const meshLeafSize = 4
+
+// NewMesh makes a mesh of separate triangles, merging their equal vertices.
+// Without triangles the mesh is empty and hits nothing.
 func NewMesh(center Vector, scale float64, tris []*Triangle) *Mesh {
-	for _, v := range tris {
-		v.ScaleAndTranslate(scale, center)
+	var b meshBuilder
+	for _, t := range tris {
+		b.triangle(b.sharedVertex(t.V1, t.N1, t.T1), b.sharedVertex(t.V2, t.N2, t.T2), b.sharedVertex(t.V3, t.N3, t.T3), t.Mat)
 	}
-	box := tris[0].BoundingBox()
-	hittables := make([]Hittable, len(tris))
-	for i, triangle := range tris {
-		hittables[i] = triangle
-		box.Extend(triangle.BoundingBox())
+	return b.build(center, scale)
+}
+
+// meshBuilder collects the vertices and triangles of a mesh as it is loaded.
+type meshBuilder struct {
+	mesh   Mesh
+	shared map[[3]Vector]uint32
+	files  []string // read besides the mesh file itself, such as MTL files and their images
+}
+
+// vertex adds a vertex, the normal and texture coordinates may be zero.
+func (b *meshBuilder) vertex(p, n, uv Vector) uint32 {
+	m := &b.mesh
+	m.Positions = append(m.Positions, p)
+	m.Normals = append(m.Normals, n)
+	m.UVs = append(m.UVs, uv)
+	return uint32(len(m.Positions) - 1)
+}
+
+// sharedVertex adds a vertex unless an equal one was added this way before.
+func (b *meshBuilder) sharedVertex(p, n, uv Vector) uint32 {
+	if b.shared == nil {
+		b.shared = make(map[[3]Vector]uint32)
+	}
+	key := [3]Vector{p, n, uv}
+	i, ok := b.shared[key]
+	if !ok {
+		i = b.vertex(p, n, uv)
+		b.shared[key] = i
 	}
+	return i
+}
 
-	return &Mesh{tris, &box, build(hittables, 0), center}
+// tangents sets the tangents of vertex i, other vertices keep zero ones.
+func (b *meshBuilder) tangents(i uint32, tangent, bitangent Vector) {
+	m := &b.mesh
+	for len(m.Tangents) < len(m.Positions) {
+		m.Tangents = append(m.Tangents, Vector{})
+		m.Bitangents = append(m.Bitangents, Vector{})
+	}
+	m.Tangents[i], m.Bitangents[i] = tangent, bitangent
 }
-func (m *Mesh) RandomPoint(rnd *rand.Rand, point Vector) Vector {
-	return m.Triangles[rnd.Intn(len(m.Triangles))].RandomPoint(rnd, point)
+
+// triangle adds a triangle and returns its index.
+func (b *meshBuilder) triangle(v1, v2, v3 uint32, material *Material) uint32 {
+	m := &b.mesh
+	m.Indices = append(m.Indices, v1, v2, v3)
+	m.Materials = append(m.Materials, material)
+	return uint32(len(m.Materials) - 1)
 }
 
-func (m *Mesh) Hit(r Ray, tMin float64, tMax float64) (bool, Hit) {
-	i := 0
-	return m.Tree.Hit(r, tMin, tMax, &i)
+func (b *meshBuilder) count() int {
+	return len(b.mesh.Materials)
 }
-func (m *Mesh) Material() *Material {
-	return m.Triangles[0].Material()
+
+// build builds the tree of the mesh, then scales it and moves it to center.
+// The builder may not be used afterwards.
+func (b *meshBuilder) build(center Vector, scale float64) *Mesh {
+	m := b.finish()
+	m.transform(center, scale)
+	return m
 }
-func (m *Mesh) BoundingBox() Box {
-	return *m.Box
+
+// finish builds the tree of the mesh in the coordinates of its file.
+func (b *meshBuilder) finish() *Mesh {
+	m := &b.mesh
+	b.shared = nil
+	// drop the arrays that hold nothing
+	if allZero(m.Normals) {
+		m.Normals = nil
+	}
+	if allZero(m.UVs) {
+		m.UVs = nil
+	}
+	if m.Tangents != nil {
+		pad := make([]Vector, len(m.Positions)-len(m.Tangents))
+		m.Tangents = append(m.Tangents, pad...)
+		m.Bitangents = append(m.Bitangents, pad...)
+	}
+	m.build()
+	return m
 }
-func (m *Mesh) MidPoint() Vector {
-	return m.Center
+
+func allZero(vs []Vector) bool {
+	for _, v := range vs {
+		if v != (Vector{}) {
+			return false
+		}
+	}
+	return true
 }
-func parseIndex(value string, length int) int {
-	parsed, _ := strconv.ParseInt(value, 0, 0)
-	n := int(parsed)
-	if n < 0 {
-		n += length
+
+// build makes the tree, and sorts the triangles in the order of its leaves
+// so that those close together in space are close together in memory.
+func (m *Mesh) build() {
+	n := len(m.Materials)
+	boxes := make([]Box, n)
+	mids := make([]Vector, n)
+	order := make([]int32, n)
+	for i := range order {
+		t := m.Triangle(i)
+		boxes[i] = t.BoundingBox()
+		mids[i] = t.MidPoint()
+		order[i] = int32(i)
+	}
+	m.nodes = m.nodes[:0]
+	if n > 0 {
+		m.buildNode(order, 0, boxes, mids)
+	}
+
+	indices := make([]uint32, len(m.Indices))
+	materials := make([]*Material, n)
+	moved := make([]uint32, n)
+	for i, j := range order {
+		copy(indices[3*i:3*i+3], m.Indices[3*j:3*j+3])
+		materials[i] = m.Materials[j]
+		moved[j] = uint32(i)
+	}
+	m.Indices, m.Materials = indices, materials
+	for _, g := range m.Groups {
+		for i, t := range g.Triangles {
+			g.Triangles[i] = moved[t]
+		}
 	}
-	return n
 }
 
-func LoadOBJ(path string, center Vector, scale float64, parent Material) (*Mesh, error) {
-	fmt.Printf("Loading OBJ: %s\n", path)
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-	vs := make([]Vector, 1, 1024)  // 1-based indexing
-	vts := make([]Vector, 1, 1024) // 1-based indexing
-	vns := make([]Vector, 1, 1024) // 1-based indexing
-	var triangles []*Triangle
-	materials := make(map[string]*Material)
-	material := &parent
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		fields := strings.Fields(line)
-		if len(fields) == 0 {
+// transform scales the mesh about the origin and moves it to center. The
+// tree keeps its shape, only the boxes of its nodes are fitted again.
+func (m *Mesh) transform(center Vector, scale float64) {
+	for i, p := range m.Positions {
+		m.Positions[i] = p.MultiplyScalar(scale).Add(center)
+	}
+	m.Center = center
+	m.fit()
+}
+
+// fit fits the boxes of the tree's nodes to the triangles, and finds the
+// areas to sample points by.
+func (m *Mesh) fit() {
+	// children follow their parents, so going backwards meets them first
+	for i := len(m.nodes) - 1; i >= 0; i-- {
+		n := &m.nodes[i]
+		if n.count == 0 {
+			n.box = m.nodes[i+1].box
+			n.box.Extend(m.nodes[n.right].box)
 			continue
 		}
-		keyword := fields[0]
-		args := fields[1:]
-		switch keyword {
-		case "mtllib":
-			p := RelativePath(path, args[0])
-			if err := LoadMTL(p, parent, materials); err != nil {
-				return nil, err
+		n.box = m.Triangle(int(n.start)).BoundingBox()
+		for j := n.start + 1; j < n.start+n.count; j++ {
+			n.box.Extend(m.Triangle(int(j)).BoundingBox())
+		}
+	}
+	if len(m.nodes) > 0 {
+		m.Box = &m.nodes[0].box
+	} else {
+		m.Box = &Box{m.Center, m.Center}
+	}
+
+	areas := make([]float64, len(m.Materials))
+	for i := range areas {
+		areas[i] = m.Triangle(i).SurfaceArea()
+	}
+	m.areas = NewDistribution1D(areas)
+}
+
+// buildNode splits the triangles in order, which start at start, like the
+// scene's KD-tree does, and returns the index of the node.
+func (m *Mesh) buildNode(order []int32, start int, boxes []Box, mids []Vector) int32 {
+	index := int32(len(m.nodes))
+	box := boxes[order[0]]
+	for _, i := range order[1:] {
+		box.Extend(boxes[i])
+	}
+	m.nodes = append(m.nodes, meshNode{box: box, start: int32(start), count: int32(len(order))})
+	if len(order) <= meshLeafSize {
+		return index
+	}
+
+	// try SAHRes planes on every axis, counting the triangles in the slab
+	// before each to evaluate them all in one pass
+	bestCost := math.MaxFloat64
+	var bestAxis Axis
+	var bestBin int
+	for _, axis := range []Axis{AxisX, AxisY, AxisZ} {
+		if box.Max.Get(axis) <= box.Min.Get(axis) {
+			continue
+		}
+		var counts [SAHRes]int
+		var bins [SAHRes]Box
+		for _, i := range order {
+			b := bin(mids[i], box, axis)
+			if counts[b] == 0 {
+				bins[b] = boxes[i]
+			} else {
+				bins[b].Extend(boxes[i])
+			}
+			counts[b]++
+		}
+		// the area of everything right of each plane, from the right
+		var right [SAHRes]float64
+		var rightBox Box
+		var nRight int
+		for b := SAHRes - 1; b > 0; b-- {
+			if counts[b] > 0 {
+				if nRight == 0 {
+					rightBox = bins[b]
+				} else {
+					rightBox.Extend(bins[b])
+				}
+				nRight += counts[b]
 			}
-		case "usemtl":
-			if m, ok := materials[args[0]]; ok {
-				material = m
+			right[b] = float64(nRight) * rightBox.SurfaceArea()
+		}
+		var leftBox Box
+		var nLeft int
+		for b := 1; b < SAHRes; b++ {
+			if counts[b-1] > 0 {
+				if nLeft == 0 {
+					leftBox = bins[b-1]
+				} else {
+					leftBox.Extend(bins[b-1])
+				}
+				nLeft += counts[b-1]
 			}
-		case "v":
-			f := ParseFloats(args)
-			v := Vector{f[0], f[1], f[2]}
-			vs = append(vs, v)
-		case "vt":
-			f := ParseFloats(args)
-			v := Vector{f[0], f[1], 0}
-			vts = append(vts, v)
-		case "vn":
-			f := ParseFloats(args)
-			v := Vector{f[0], f[1], f[2]}
-			vns = append(vns, v)
-		case "f":
-			fvs := make([]int, len(args))
-			fvts := make([]int, len(args))
-			fvns := make([]int, len(args))
-			for i, arg := range args {
-				vertex := strings.Split(arg+"//", "/")
-				fvs[i] = parseIndex(vertex[0], len(vs))
-				fvts[i] = parseIndex(vertex[1], len(vts))
-				fvns[i] = parseIndex(vertex[2], len(vns))
+			if nLeft == 0 || nLeft == len(order) {
+				continue
 			}
-			for i := 1; i < len(fvs)-1; i++ {
-				i1, i2, i3 := 0, i, i+1
-				t := NewTriangle(
-					vs[fvs[i1]],
-					vs[fvs[i2]],
-					vs[fvs[i3]],
-					vns[fvns[i1]],
-					vns[fvns[i2]],
-					vns[fvns[i3]], material)
-				t.T1 = vts[fvts[i1]]
-				t.T2 = vts[fvts[i2]]
-				t.T3 = vts[fvts[i3]]
-
-				triangles = append(triangles, t)
+			if cost := float64(nLeft)*leftBox.SurfaceArea() + right[b]; cost < bestCost {
+				bestCost, bestAxis, bestBin = cost, axis, b
 			}
 		}
 	}
-	return NewMesh(center, scale, triangles), scanner.Err()
+	if bestCost == math.MaxFloat64 {
+		return index
+	}
+
+	left := 0
+	for j, i := range order {
+		if bin(mids[i], box, bestAxis) < bestBin {
+			order[left], order[j] = order[j], order[left]
+			left++
+		}
+	}
+	m.buildNode(order[:left], start, boxes, mids)
+	right := m.buildNode(order[left:], start+left, boxes, mids)
+	m.nodes[index].right, m.nodes[index].count, m.nodes[index].axis = right, 0, bestAxis
+	return index
 }
-func LoadMTL(path string, parent Material, materials map[string]*Material) error {
-	fmt.Printf("Loading MTL: %s\n", path)
-	file, err := os.Open(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
+
+// bin is the slab of box along axis that p lies in.
+func bin(p Vector, box Box, axis Axis) int {
+	lo, hi := box.Min.Get(axis), box.Max.Get(axis)
+	b := int(SAHRes * (p.Get(axis) - lo) / (hi - lo))
+	if b >= SAHRes {
+		return SAHRes - 1
+	}
+	return b
+}
+
+// hit finds the closest triangle hit by r, or any one if closest is false,
+// counting the triangles tested.
+func (m *Mesh) hit(r Ray, tMin, tMax float64, closest bool, intersections *int) (bool, Hit) {
+	if len(m.nodes) == 0 {
+		return false, Hit{}
+	}
+	best := -1
+	var bu, bv float64
+	stack := make([]int32, 0, 64)
+	node := int32(0)
+	for {
+		n := &m.nodes[node]
+		t1, t2 := n.box.Intersect(r)
+		if t1 <= t2 && t2 >= tMin && t1 <= tMax {
+			if n.count == 0 {
+				// visit the child on the side the ray comes from first
+				first, second := node+1, n.right
+				if r.Direction.Get(n.axis) < 0 {
+					first, second = second, first
+				}
+				stack = append(stack, second)
+				node = first
+				continue
+			}
+			for i := int(n.start); i < int(n.start+n.count); i++ {
+				*intersections++
+				if t, u, v, ok := m.intersect(i, r, tMin, tMax); ok {
+					best, tMax, bu, bv = i, t, u, v
+					if !closest {
+						break
+					}
+				}
+			}
+			if best >= 0 && !closest {
+				break
+			}
 		}
-		return err
-	}
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	parentCopy := parent
-	material := &parentCopy
-	for scanner.Scan() {
-		line := scanner.Text()
-		fields := strings.Fields(line)
-		if len(fields) == 0 {
-			continue
+		if len(stack) == 0 {
+			break
 		}
-		keyword := fields[0]
-		args := fields[1:]
-		switch keyword {
-		case "newmtl":
-			parentCopy := parent
-			material = &parentCopy
-			materials[args[0]] = material
-		case "Ke":
-			c := ParseFloats(args)
-			max := math.Max(math.Max(c[0], c[1]), c[2])
-			if max > 0 {
-				material.Col = RGB{c[0] / max, c[1] / max, c[2] / max}
-				//	material.Emittance = max
+		node = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+	}
+	if best < 0 {
+		return false, Hit{}
+	}
+	t := m.Triangle(best)
+	tri := t.triangle()
+	uv := interpolate(tri.T1, tri.T2, tri.T3, bu, bv)
+	return true, Hit{T: tMax, Normal: tri.Normal(), UV: uv, Material: tri.Mat, Point: r.Step(tMax), Ray: r, Object: t}
+}
+
+// intersect is Triangle.Hit for triangle i, without making the Hit. u and v
+// are the barycentric coordinates of the hit.
+func (m *Mesh) intersect(i int, r Ray, tMin, tMax float64) (t, u, v float64, ok bool) {
+	v1 := m.Positions[m.Indices[3*i]]
+	v2 := m.Positions[m.Indices[3*i+1]]
+	v3 := m.Positions[m.Indices[3*i+2]]
+	e1x := v2.X - v1.X
+	e1y := v2.Y - v1.Y
+	e1z := v2.Z - v1.Z
+	e2x := v3.X - v1.X
+	e2y := v3.Y - v1.Y
+	e2z := v3.Z - v1.Z
+	px := r.Direction.Y*e2z - r.Direction.Z*e2y
+	py := r.Direction.Z*e2x - r.Direction.X*e2z
+	pz := r.Direction.X*e2y - r.Direction.Y*e2x
+	det := e1x*px + e1y*py + e1z*pz
+	if det > -EPS && det < EPS {
+		return 0, 0, 0, false
+	}
+	inv := 1 / det
+	tx := r.Origin.X - v1.X
+	ty := r.Origin.Y - v1.Y
+	tz := r.Origin.Z - v1.Z
+	u = (tx*px + ty*py + tz*pz) * inv
+	if u < 0 || u > 1 {
+		return 0, 0, 0, false
+	}
+	qx := ty*e1z - tz*e1y
+	qy := tz*e1x - tx*e1z
+	qz := tx*e1y - ty*e1x
+	v = (r.Direction.X*qx + r.Direction.Y*qy + r.Direction.Z*qz) * inv
+	if v < 0 || u+v > 1 {
+		return 0, 0, 0, false
+	}
+	d := (e2x*qx + e2y*qy + e2z*qz) * inv
+	if d < tMin || d > tMax {
+		return 0, 0, 0, false
+	}
+	return d, u, v, true
+}
+
+// SubMesh returns the triangles of the objects and groups with the given name
+// as a mesh of their own, sharing the vertices, or nil if there are none. It
+// is centred on the middle of its box.
+func (m *Mesh) SubMesh(name string) *Mesh {
+	sub := &Mesh{Positions: m.Positions, Normals: m.Normals, UVs: m.UVs, Colors: m.Colors, Tangents: m.Tangents, Bitangents: m.Bitangents}
+	for _, g := range m.Groups {
+		if g.Object == name || g.Group == name {
+			for _, t := range g.Triangles {
+				sub.Indices = append(sub.Indices, m.Indices[3*t:3*t+3]...)
+				sub.Materials = append(sub.Materials, m.Materials[t])
 			}
-		case "Kd":
-			c := ParseFloats(args)
-			material.Col = RGB{c[0], c[1], c[2]}
-			/*case "map_Kd":
-				p := RelativePath(path, args[0])
-				material.Texture = GetTexture(p)
-			case "map_bump":
-				p := RelativePath(path, args[0])
-				material.NormalTexture = GetTexture(p).Pow(1 / 2.2)*/
 		}
 	}
-	return scanner.Err()
+	if len(sub.Materials) == 0 {
+		return nil
+	}
+	sub.build()
+	sub.fit()
+	sub.Center = sub.Box.MidPoint()
+	return sub
+}
+
+func (m *Mesh) TriangleCount() int {
+	return len(m.Materials)
+}
+
+func (m *Mesh) Triangle(i int) MeshTriangle {
+	return MeshTriangle{m, i}
+}
+
+// RandomPoint picks a point uniformly by area over the whole mesh.
+func (m *Mesh) RandomPoint(rnd *rand.Rand, point Vector) Vector {
+	i, _ := m.areas.SampleDiscrete(rnd.Float64())
+	return m.Triangle(i).RandomPoint(rnd, point)
+}
+
+func (m *Mesh) SurfaceArea() float64 {
+	return m.areas.Integral * float64(m.areas.Count())
+}
+
+func (m *Mesh) Hit(r Ray, tMin float64, tMax float64) (bool, Hit) {
+	i := 0
+	return m.hit(r, tMin, tMax, true, &i)
+}
+
+// Material is that of the first triangle, nil for an empty mesh.
+func (m *Mesh) Material() *Material {
+	if len(m.Materials) == 0 {
+		return nil
+	}
+	return m.Materials[0]
+}
+func (m *Mesh) BoundingBox() Box {
+	return *m.Box
+}
+func (m *Mesh) MidPoint() Vector {
+	return m.Center
 }
+
+// MeshTriangle is a triangle of a mesh, as hits and area lights refer to it.
+// It is a small value, made when needed.
+type MeshTriangle struct {
+	Mesh  *Mesh
+	Index int
+}
+
+// vertices are the corners of the triangle.
+func (t MeshTriangle) vertices() (a, b, c Vector) {
+	m := t.Mesh
+	i := m.Indices[3*t.Index : 3*t.Index+3]
+	return m.Positions[i[0]], m.Positions[i[1]], m.Positions[i[2]]
+}
+
+// triangle copies the triangle out of the mesh, for when a hit needs all of
+// its attributes.
+func (t MeshTriangle) triangle() Triangle {
+	m := t.Mesh
+	var tri Triangle
+	i := m.Indices[3*t.Index : 3*t.Index+3]
+	tri.V1, tri.V2, tri.V3 = m.Positions[i[0]], m.Positions[i[1]], m.Positions[i[2]]
+	if m.Normals != nil {
+		tri.N1, tri.N2, tri.N3 = m.Normals[i[0]], m.Normals[i[1]], m.Normals[i[2]]
+	}
+	if m.UVs != nil {
+		tri.T1, tri.T2, tri.T3 = m.UVs[i[0]], m.UVs[i[1]], m.UVs[i[2]]
+	}
+	tri.Mat = m.Materials[t.Index]
+	tri.FixNormals()
+	tri.Area = .5 * tri.V3.Subtract(tri.V1).Cross(tri.V3.Subtract(tri.V2)).Length()
+	return tri
+}
+
+// colorAt interpolates the vertex colours of the mesh at p, a point of the
+// triangle.
+func (t MeshTriangle) colorAt(p Vector) RGB {
+	m := t.Mesh
+	i := m.Indices[3*t.Index : 3*t.Index+3]
+	a := m.Positions[i[0]]
+	e1, e2, d := m.Positions[i[1]].Subtract(a), m.Positions[i[2]].Subtract(a), p.Subtract(a)
+	d11, d12, d22 := e1.Dot(e1), e1.Dot(e2), e2.Dot(e2)
+	dp1, dp2 := d.Dot(e1), d.Dot(e2)
+	det := d11*d22 - d12*d12
+	if det == 0 {
+		return m.Colors[i[0]]
+	}
+	u := (d22*dp1 - d12*dp2) / det
+	v := (d11*dp2 - d12*dp1) / det
+	c := m.Colors[i[0]].MultiplyScalar(1 - u - v)
+	return c.Add(m.Colors[i[1]].MultiplyScalar(u)).Add(m.Colors[i[2]].MultiplyScalar(v))
+}
+
+func (t MeshTriangle) Hit(r Ray, tMin, tMax float64) (bool, Hit) {
+	tri := t.triangle()
+	return tri.Hit(r, tMin, tMax)
+}
+
+func (t MeshTriangle) BoundingBox() Box {
+	a, b, c := t.vertices()
+	return Box{a.Min(b).Min(c), a.Max(b).Max(c)}
+}
+
+func (t MeshTriangle) MidPoint() Vector {
+	a, b, c := t.vertices()
+	return Vector{(a.X + b.X + c.X) / 3.0, (a.Y + b.Y + c.Y) / 3.0, (a.Z + b.Z + c.Z) / 3.0}
+}
+
+func (t MeshTriangle) Material() *Material {
+	return t.Mesh.Materials[t.Index]
+}
+
+func (t MeshTriangle) RandomPoint(rnd *rand.Rand, point Vector) Vector {
+	a, b, c := t.vertices()
+	return randomPointIn(a, b, c, rnd)
+}
+
+func (t MeshTriangle) SurfaceArea() float64 {
+	a, b, c := t.vertices()
+	return .5 * c.Subtract(a).Cross(c.Subtract(b)).Length()
+}
+
+func (t MeshTriangle) SamplePoint(rnd *rand.Rand) (Vector, Vector) {
+	return t.RandomPoint(rnd, Vector{}), t.GeometricNormal()
+}
+
+func (t MeshTriangle) SampleFrom(p Vector, rnd *rand.Rand) (Vector, Vector, float64) {
+	return sampleByArea(t, p, rnd)
+}
+
+func (t MeshTriangle) PdfFrom(p, direction Vector) float64 {
+	return pdfByArea(t, p, direction)
+}
+
+// GeometricNormal is Triangle.GeometricNormal: vertices without normals
+// count with the face normal, which always lies on its own side.
+func (t MeshTriangle) GeometricNormal() Vector {
+	m := t.Mesh
+	a, b, c := t.vertices()
+	n := b.Subtract(a).Cross(c.Subtract(a)).Normalize()
+	if m.Normals == nil {
+		return n
+	}
+	var side float64
+	for _, i := range m.Indices[3*t.Index : 3*t.Index+3] {
+		if vn := m.Normals[i]; vn != (Vector{}) {
+			side += n.Dot(vn)
+		} else {
+			side++
+		}
+	}
+	if side < 0 {
+		return n.MultiplyScalar(-1)
+	}
+	return n
+}
+
+// colourMaterials hands out copies of a material with the colours of
+// triangles, sharing one between all triangles of the same colour. Colours
+// are rounded to 8 bit sRGB, so that smoothly coloured scans don't need a
+// material for every triangle.
+type colourMaterials struct {
+	parent    Material
+	materials map[RGB]*Material
+}
+
+func newColourMaterials(parent Material) *colourMaterials {
+	return &colourMaterials{parent, make(map[RGB]*Material)}
+}
+
+func (c *colourMaterials) get(col RGB) *Material {
+	col = col.Pow(1 / 2.2).MultiplyScalar(255)
+	col = RGB{math.Round(col.R), math.Round(col.G), math.Round(col.B)}
+	col = col.DivScalar(255).Pow(2.2)
+	m, ok := c.materials[col]
+	if !ok {
+		material := c.parent
+		material.Col = col
+		m = &material
+		c.materials[col] = m
+	}
+	return m
+}
+
 func RelativePath(path1, path2 string) string {
 	dir, _ := path.Split(path1)
 	return path.Join(dir, path2)
 }
-func ParseFloats(items []string) []float64 {
-	result := make([]float64, len(items))
-	for i, item := range items {
-		f, _ := strconv.ParseFloat(item, 64)
-		result[i] = f
-	}
-	return result
-}
@@ -0,0 +1,240 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const MeshCacheVersion = 4
+
+// MeshCacheExt is added to the name of a mesh file to name its cache.
+const MeshCacheExt = ".meshcache"
+
+var errMeshCacheStale = errors.New("out of date")
+
+// meshCacheHeader comes first in a cache file, so that a stale cache is found
+// out without decoding the mesh.
+type meshCacheHeader struct {
+	Version int
+	Sources []meshCacheSource
+	Parent  Material
+}
+
+// meshCacheSource is a file the mesh was read from, with the hash of its
+// contents, or a file it refers to that doesn't exist, with meshCacheAbsent.
+type meshCacheSource struct {
+	Path string
+	Hash uint64
+}
+
+// meshCacheAbsent is the hash of missing files, so that the cache goes out of
+// date when they appear.
+const meshCacheAbsent = 0
+
+// meshCache is a mesh in the coordinates of its file, with its tree. Shared
+// materials are stored once, and nodes without their boxes, which are fitted
+// again when the mesh is placed.
+type meshCache struct {
+	Positions, Normals, UVs []Vector
+	Colors                  []RGB
+	Indices                 []uint32
+	Materials               []Material
+	TriangleMaterials       []uint32
+	Groups                  []*MeshGroup
+	Nodes                   []meshCacheNode
+}
+
+type meshCacheNode struct {
+	Right, Start, Count int32
+	Axis                Axis
+}
+
+// LoadMesh reads an OBJ, PLY or STL file, as told by its extension.
+func LoadMesh(path string, center Vector, scale float64, parent Material) (*Mesh, error) {
+	b, err := loadMesh(path, parent)
+	if err != nil {
+		return nil, err
+	}
+	return b.build(center, scale), nil
+}
+
+func loadMesh(path string, parent Material) (*meshBuilder, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".obj":
+		return loadOBJ(path, parent)
+	case ".ply":
+		return loadPLY(path, parent)
+	case ".stl":
+		return loadSTL(path, parent)
+	}
+	return nil, fmt.Errorf("%s: unknown mesh format", path)
+}
+
+// LoadCachedMesh is LoadMesh, but keeps the mesh and its tree in a cache file
+// next to path. The cache is used while the files the mesh was read from and
+// the parent material are unchanged, otherwise it is written again. Failing to
+// write it only gives a warning.
+func LoadCachedMesh(path string, center Vector, scale float64, parent Material) (*Mesh, error) {
+	cache := path + MeshCacheExt
+	m, err := readMeshCache(cache, parent)
+	if err == nil {
+		fmt.Printf("Loading cached mesh: %s\n", cache)
+		m.transform(center, scale)
+		return m, nil
+	}
+	if !os.IsNotExist(err) {
+		fmt.Printf("Ignoring mesh cache %s: %v\n", cache, err)
+	}
+
+	b, err := loadMesh(path, parent)
+	if err != nil {
+		return nil, err
+	}
+	m = b.finish()
+	if err := writeMeshCache(cache, append([]string{path}, b.files...), parent, m); err != nil {
+		fmt.Printf("Cannot write mesh cache: %v\n", err)
+	}
+	m.transform(center, scale)
+	return m, nil
+}
+
+// hashFile hashes the contents of a file, giving meshCacheAbsent if it
+// doesn't exist.
+func hashFile(path string) (uint64, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return meshCacheAbsent, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	h := fnv.New64a()
+	if _, err := io.Copy(h, file); err != nil {
+		return 0, err
+	}
+	return h.Sum64(), nil
+}
+
+func readMeshCache(path string, parent Material) (*Mesh, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	dec := gob.NewDecoder(bufio.NewReader(file))
+	var header meshCacheHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, err
+	}
+	if header.Version != MeshCacheVersion {
+		return nil, fmt.Errorf("unsupported version %d", header.Version)
+	}
+	if header.Parent != parent {
+		return nil, errMeshCacheStale
+	}
+	for _, s := range header.Sources {
+		if h, err := hashFile(s.Path); err != nil || h != s.Hash {
+			return nil, errMeshCacheStale
+		}
+	}
+
+	var c meshCache
+	if err := dec.Decode(&c); err != nil {
+		return nil, err
+	}
+	n := len(c.TriangleMaterials)
+	if n == 0 || len(c.Indices) != 3*n || len(c.Nodes) == 0 ||
+		(c.Normals != nil && len(c.Normals) != len(c.Positions)) || (c.UVs != nil && len(c.UVs) != len(c.Positions)) ||
+		(c.Colors != nil && len(c.Colors) != len(c.Positions)) {
+		return nil, errors.New("corrupt cache")
+	}
+	m := &Mesh{Positions: c.Positions, Normals: c.Normals, UVs: c.UVs, Colors: c.Colors, Indices: c.Indices, Groups: c.Groups}
+	for _, i := range c.Indices {
+		if int(i) >= len(c.Positions) {
+			return nil, errors.New("corrupt cache")
+		}
+	}
+	m.Materials = make([]*Material, n)
+	for i, j := range c.TriangleMaterials {
+		if int(j) >= len(c.Materials) {
+			return nil, errors.New("corrupt cache")
+		}
+		m.Materials[i] = &c.Materials[j]
+	}
+	m.nodes = make([]meshNode, len(c.Nodes))
+	for i, node := range c.Nodes {
+		inner := node.Count == 0 && int(node.Right) > i+1 && int(node.Right) < len(c.Nodes)
+		leaf := node.Count > 0 && node.Start >= 0 && int(node.Start+node.Count) <= n
+		if !inner && !leaf {
+			return nil, errors.New("corrupt cache")
+		}
+		m.nodes[i] = meshNode{right: node.Right, start: node.Start, count: node.Count, axis: node.Axis}
+	}
+	for _, g := range c.Groups {
+		for _, t := range g.Triangles {
+			if int(t) >= n {
+				return nil, errors.New("corrupt cache")
+			}
+		}
+	}
+	return m, nil
+}
+
+// writeMeshCache writes the cache of a mesh that isn't transformed yet,
+// through a temporary file so that readers never see half of it.
+func writeMeshCache(path string, sources []string, parent Material, m *Mesh) error {
+	header := meshCacheHeader{Version: MeshCacheVersion, Parent: parent}
+	for _, s := range sources {
+		h, err := hashFile(s)
+		if err != nil {
+			return err
+		}
+		header.Sources = append(header.Sources, meshCacheSource{s, h})
+	}
+	c := meshCache{Positions: m.Positions, Normals: m.Normals, UVs: m.UVs, Colors: m.Colors, Indices: m.Indices, Groups: m.Groups}
+	ids := make(map[*Material]uint32)
+	c.TriangleMaterials = make([]uint32, len(m.Materials))
+	for i, mat := range m.Materials {
+		id, ok := ids[mat]
+		if !ok {
+			id = uint32(len(c.Materials))
+			ids[mat] = id
+			c.Materials = append(c.Materials, *mat)
+		}
+		c.TriangleMaterials[i] = id
+	}
+	c.Nodes = make([]meshCacheNode, len(m.nodes))
+	for i, node := range m.nodes {
+		c.Nodes[i] = meshCacheNode{node.right, node.start, node.count, node.axis}
+	}
+
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	enc := gob.NewEncoder(w)
+	if err = enc.Encode(header); err == nil {
+		if err = enc.Encode(c); err == nil {
+			err = w.Flush()
+		}
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
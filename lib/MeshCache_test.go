@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"image/color"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func writePNG(t *testing.T, path string, c color.Gray) {
+	writeTexels(t, path, [4]color.Gray{c, c, c, c})
+}
+
+func TestMeshCacheSources(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	triangle := "v 0 0 0\nv 1 0 0\nv 0 1 0\nusemtl m\nf 1 2 3\n"
+	missing := write("missing.obj", "mtllib missing.mtl\n"+triangle)
+	textured := write("textured.obj", "mtllib textured.mtl\n"+triangle)
+	write("textured.mtl", "newmtl m\nmap_Kd texture.png\n")
+	texture := filepath.Join(dir, "texture.png")
+	writePNG(t, texture, color.Gray{128})
+
+	for _, path := range []string{missing, textured} {
+		if _, err := LoadCachedMesh(path, Vector{}, 1, Material{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readMeshCache(path+MeshCacheExt, Material{}); err != nil {
+			t.Errorf("%s: cache not written: %v", path, err)
+		}
+	}
+
+	// changing the texture changes the material
+	writePNG(t, texture, color.Gray{255})
+	if _, err := readMeshCache(textured+MeshCacheExt, Material{}); err != errMeshCacheStale {
+		t.Errorf("cache with a changed texture: %v", err)
+	}
+	m, err := LoadCachedMesh(textured, Vector{}, 1, Material{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := m.Materials[0].Col; c != (RGB{1, 1, 1}) {
+		t.Errorf("colour %v from the changed texture", c)
+	}
+}
+
+func TestMeshCacheMissingSources(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	triangle := "v 0 0 0\nv 1 0 0\nv 0 1 0\nusemtl m\nf 1 2 3\n"
+	obj := write("mesh.obj", "mtllib mesh.mtl\n"+triangle)
+	parent := Material{Col: RGB{.5, .5, .5}}
+	load := func(want RGB) {
+		m, err := LoadCachedMesh(obj, Vector{}, 1, parent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readMeshCache(obj+MeshCacheExt, parent); err != nil {
+			t.Errorf("cache not written: %v", err)
+		}
+		if c := m.Materials[0].Col; c != want {
+			t.Errorf("colour %v, want %v", c, want)
+		}
+	}
+	load(parent.Col)
+
+	// the MTL file appears, naming an image that is still missing
+	write("mesh.mtl", "newmtl m\nKd 1 0 0\nmap_Kd texture.png\n")
+	if _, err := readMeshCache(obj+MeshCacheExt, parent); err != errMeshCacheStale {
+		t.Errorf("cache without the new MTL file: %v", err)
+	}
+	load(RGB{1, 0, 0})
+
+	writePNG(t, filepath.Join(dir, "texture.png"), color.Gray{255})
+	if _, err := readMeshCache(obj+MeshCacheExt, parent); err != errMeshCacheStale {
+		t.Errorf("cache without the new image: %v", err)
+	}
+	load(RGB{1, 1, 1})
+}
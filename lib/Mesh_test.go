@@ -0,0 +1,202 @@
+package lib
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// randomMesh makes a mesh of triangles between vertices they share, the
+// larger ones crossing the smaller, so that the tree has work to do.
+func randomMesh(rnd *rand.Rand) *meshBuilder {
+	b := &meshBuilder{}
+	point := func() Vector {
+		return Vector{rnd.Float64(), rnd.Float64(), rnd.Float64()}
+	}
+	for i := 0; i < 300; i++ {
+		b.vertex(point().MultiplyScalar(4), Vector{}, Vector{})
+	}
+	mat := Lambertian(RGB{1, 1, 1})
+	for i := 0; i < 500; i++ {
+		v := rnd.Intn(300)
+		near := func() uint32 {
+			return uint32((v + 1 + rnd.Intn(10)) % 300)
+		}
+		b.triangle(uint32(v), near(), near(), mat)
+	}
+	return b
+}
+
+// bruteForceHit tests every triangle of the mesh.
+func bruteForceHit(m *Mesh, r Ray, tMin, tMax float64) (bool, Hit, int) {
+	best := -1
+	var bestHit Hit
+	for i := 0; i < m.TriangleCount(); i++ {
+		tri := m.Triangle(i).triangle()
+		if ok, hit := tri.Hit(r, tMin, tMax); ok {
+			best, bestHit, tMax = i, hit, hit.T
+		}
+	}
+	return best >= 0, bestHit, best
+}
+
+func checkMeshHits(t *testing.T, name string, m *Mesh, rnd *rand.Rand) {
+	box := m.BoundingBox()
+	size := box.Max.Subtract(box.Min)
+	hits := 0
+	for i := 0; i < 2000; i++ {
+		origin := box.Min.Add(size.Multiply(Vector{rnd.Float64(), rnd.Float64(), rnd.Float64()}).MultiplyScalar(1.5)).Subtract(size.MultiplyScalar(.25))
+		var target Vector
+		if i%2 == 0 {
+			// aim at a triangle, so that most rays hit
+			target = m.Triangle(rnd.Intn(m.TriangleCount())).RandomPoint(rnd, origin)
+		} else {
+			target = box.Min.Add(size.Multiply(Vector{rnd.Float64(), rnd.Float64(), rnd.Float64()}))
+		}
+		r := Ray{origin, target.Subtract(origin)}
+		tMax := math.MaxFloat64
+		if i%5 == 0 {
+			tMax = .5
+		}
+
+		ok, hit := m.Hit(r, RayEpsilon, tMax)
+		wantOK, want, wantIndex := bruteForceHit(m, r, RayEpsilon, tMax)
+		if ok != wantOK {
+			t.Fatalf("%s: ray %d: hit %v, brute force %v", name, i, ok, wantOK)
+		}
+		if !ok {
+			continue
+		}
+		hits++
+		if index := hit.Object.(MeshTriangle).Index; index != wantIndex && hit.T != want.T {
+			t.Fatalf("%s: ray %d: hit triangle %d at %v, brute force %d at %v", name, i, index, hit.T, wantIndex, want.T)
+		}
+		if hit.T != want.T || hit.Point != want.Point || hit.Normal != want.Normal || hit.Material != want.Material {
+			t.Fatalf("%s: ray %d: hit %+v, brute force %+v", name, i, hit, want)
+		}
+
+		// shadow rays take any hit in range
+		n := 0
+		if anyOK, _ := m.hit(r, RayEpsilon, tMax, false, &n); !anyOK {
+			t.Fatalf("%s: ray %d: no hit when looking for any", name, i)
+		}
+	}
+	if hits < 500 {
+		t.Errorf("%s: only %d of the rays hit", name, hits)
+	}
+}
+
+func TestMeshHit(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	checkMeshHits(t, "as built", randomMesh(rand.New(rand.NewSource(2))).build(Vector{}, 1), rnd)
+	checkMeshHits(t, "built scaled", randomMesh(rand.New(rand.NewSource(2))).build(Vector{1, -2, 3}, 2.5), rnd)
+
+	// a cached mesh is transformed after its tree has been built
+	m := randomMesh(rand.New(rand.NewSource(3))).finish()
+	m.transform(Vector{-5, 0, 1}, .3)
+	checkMeshHits(t, "transformed", m, rnd)
+}
+
+func inBox(b Box, p Vector) bool {
+	const e = 1e-9
+	return p.X >= b.Min.X-e && p.Y >= b.Min.Y-e && p.Z >= b.Min.Z-e &&
+		p.X <= b.Max.X+e && p.Y <= b.Max.Y+e && p.Z <= b.Max.Z+e
+}
+
+func TestSubMesh(t *testing.T) {
+	b := randomMesh(rand.New(rand.NewSource(4)))
+	// every third triangle is in group a
+	a := &MeshGroup{Object: "o", Group: "a"}
+	rest := &MeshGroup{Object: "o", Group: "b"}
+	for i := 0; i < b.count(); i++ {
+		if i%3 == 0 {
+			a.Triangles = append(a.Triangles, uint32(i))
+		} else {
+			rest.Triangles = append(rest.Triangles, uint32(i))
+		}
+	}
+	b.mesh.Groups = []*MeshGroup{a, rest}
+	m := b.build(Vector{1, 1, 1}, 2)
+
+	if m.SubMesh("c") != nil {
+		t.Error("found a group that doesn't exist")
+	}
+	if sub := m.SubMesh("o"); sub.TriangleCount() != m.TriangleCount() {
+		t.Errorf("object o has %d of the %d triangles", sub.TriangleCount(), m.TriangleCount())
+	}
+	sub := m.SubMesh("a")
+	if sub.TriangleCount() != len(a.Triangles) {
+		t.Fatalf("group a has %d triangles, want %d", sub.TriangleCount(), len(a.Triangles))
+	}
+	var area float64
+	for _, i := range a.Triangles {
+		area += m.Triangle(int(i)).SurfaceArea()
+	}
+	if math.Abs(sub.SurfaceArea()-area) > 1e-9*area {
+		t.Errorf("area %v, want %v", sub.SurfaceArea(), area)
+	}
+	box := sub.BoundingBox()
+	if !inBox(box, sub.MidPoint()) {
+		t.Errorf("centre %v outside the box %v", sub.MidPoint(), box)
+	}
+	rnd := rand.New(rand.NewSource(5))
+	for i := 0; i < 100; i++ {
+		if p := sub.RandomPoint(rnd, Vector{}); !inBox(box, p) {
+			t.Fatalf("random point %v outside the box %v", p, box)
+		}
+	}
+	checkMeshHits(t, "sub mesh", sub, rnd)
+}
+
+func TestEmptyMesh(t *testing.T) {
+	m := NewMesh(Vector{1, 2, 3}, 2, nil)
+	if m.TriangleCount() != 0 || m.SurfaceArea() != 0 {
+		t.Errorf("%d triangles of area %v", m.TriangleCount(), m.SurfaceArea())
+	}
+	if m.Material() != nil {
+		t.Errorf("material %v", m.Material())
+	}
+	if box := m.BoundingBox(); box != (Box{Vector{1, 2, 3}, Vector{1, 2, 3}}) {
+		t.Errorf("box %v", box)
+	}
+	if ok, hit := m.Hit(Ray{Vector{1, 2, 0}, Vector{0, 0, 1}}, 0, math.MaxFloat64); ok {
+		t.Errorf("hit %+v", hit)
+	}
+}
+
+// TestMeshTriangle checks the triangles of a mesh, which work on its vertices
+// in place, against copies of them.
+func TestMeshTriangle(t *testing.T) {
+	b := randomMesh(rand.New(rand.NewSource(6)))
+	// flip some normals and leave others out
+	for i := range b.mesh.Normals {
+		switch i % 3 {
+		case 0:
+			b.mesh.Normals[i] = Vector{0, 1, 0}
+		case 1:
+			b.mesh.Normals[i] = Vector{0, -1, 0}
+		}
+	}
+	m := b.build(Vector{}, 1)
+	for i := 0; i < m.TriangleCount(); i++ {
+		mt := m.Triangle(i)
+		tri := mt.triangle()
+		if mt.BoundingBox() != tri.BoundingBox() {
+			t.Fatalf("triangle %d: box %v, want %v", i, mt.BoundingBox(), tri.BoundingBox())
+		}
+		if mt.MidPoint() != tri.MidPoint() {
+			t.Fatalf("triangle %d: centre %v, want %v", i, mt.MidPoint(), tri.MidPoint())
+		}
+		if mt.SurfaceArea() != tri.SurfaceArea() {
+			t.Fatalf("triangle %d: area %v, want %v", i, mt.SurfaceArea(), tri.SurfaceArea())
+		}
+		if n, want := mt.GeometricNormal(), tri.GeometricNormal(); n.Subtract(want).Length() > 1e-9 && !math.IsNaN(want.X) {
+			t.Fatalf("triangle %d: normal %v, want %v", i, n, want)
+		}
+		p, _ := mt.SamplePoint(rand.New(rand.NewSource(int64(i))))
+		want, _ := tri.SamplePoint(rand.New(rand.NewSource(int64(i))))
+		if p != want {
+			t.Fatalf("triangle %d: sampled %v, want %v", i, p, want)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package lib
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ParseError is an error in a mesh file, at the given line.
+type ParseError struct {
+	Path string
+	Line int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.Path, e.Line, e.Err)
+}
+
+func LoadOBJ(path string, center Vector, scale float64, parent Material) (*Mesh, error) {
+	b, err := loadOBJ(path, parent)
+	if err != nil {
+		return nil, err
+	}
+	return b.build(center, scale), nil
+}
+
+func loadOBJ(path string, parent Material) (*meshBuilder, error) {
+	fmt.Printf("Loading OBJ: %s\n", path)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	b, err := parseOBJ(file, path, parent)
+	if err != nil {
+		return nil, err
+	}
+	if b.count() == 0 {
+		return nil, fmt.Errorf("%s: no faces", path)
+	}
+	return b, nil
+}
+
+// objFace is a triangle of a face, with indices into the vertex lists that
+// are -1 where the face gives none.
+type objFace struct {
+	v, vt, vn [3]int
+	smoothing int
+	material  *Material
+	group     *MeshGroup
+}
+
+// ParseOBJ reads an OBJ file from r, giving a mesh in the coordinates of the
+// file, or nil if it has no faces. path names it in errors and locates its
+// MTL files. Faces without normals get the averaged normals of the faces
+// around each vertex in the same smoothing group, or their own if they are in
+// none. Statements for things other than polygons are skipped with a warning.
+func ParseOBJ(r io.Reader, path string, parent Material) (*Mesh, error) {
+	b, err := parseOBJ(r, path, parent)
+	if err != nil || b.count() == 0 {
+		return nil, err
+	}
+	return b.build(Vector{}, 1), nil
+}
+
+func parseOBJ(r io.Reader, path string, parent Material) (*meshBuilder, error) {
+	var vs, vts, vns []Vector
+	var faces []objFace
+	b := &meshBuilder{}
+	materials := make(map[string]*Material)
+	material := &parent
+	object, group := "", ""
+	groups := make(map[[2]string]*MeshGroup)
+	smoothing := 0
+
+	warned := make(map[string]bool)
+	warn := func(msg string) {
+		if !warned[msg] {
+			warned[msg] = true
+			fmt.Printf("%s: %s\n", path, msg)
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16<<20)
+	line, next := 0, 1
+	for scanner.Scan() {
+		text := scanner.Text()
+		line = next
+		next++
+		// a backslash at the end of a line continues it on the next
+		for strings.HasSuffix(text, "\\") {
+			text = text[:len(text)-1]
+			if !scanner.Scan() {
+				break
+			}
+			text += " " + scanner.Text()
+			next++
+		}
+		keyword, args := splitStatement(text)
+		if keyword == "" {
+			continue
+		}
+		fail := func(err error) error {
+			return &ParseError{path, line, fmt.Errorf("%s: %v", keyword, err)}
+		}
+		switch keyword {
+		case "v", "vn", "vt", "vp":
+			f, err := parseNumbers(args)
+			if err != nil {
+				return nil, fail(err)
+			}
+			switch keyword {
+			case "v":
+				// an optional w or vertex colour may follow
+				if len(f) < 3 {
+					return nil, fail(errors.New("need 3 coordinates"))
+				}
+				vs = append(vs, Vector{f[0], f[1], f[2]})
+			case "vn":
+				if len(f) < 3 {
+					return nil, fail(errors.New("need 3 coordinates"))
+				}
+				vns = append(vns, Vector{f[0], f[1], f[2]})
+			case "vt":
+				if len(f) < 1 || len(f) > 3 {
+					return nil, fail(errors.New("need 1 to 3 coordinates"))
+				}
+				// v defaults to 0
+				f = append(f, 0)
+				vts = append(vts, Vector{f[0], f[1], 0})
+			case "vp":
+				// only used by free-form geometry
+				if len(f) < 1 || len(f) > 3 {
+					return nil, fail(errors.New("need 1 to 3 coordinates"))
+				}
+			}
+		case "f":
+			if len(args) < 3 {
+				return nil, fail(errors.New("need at least 3 vertices"))
+			}
+			var v, vt, vn []int
+			for _, arg := range args {
+				i, j, k, err := parseFaceVertex(arg, len(vs), len(vts), len(vns))
+				if err != nil {
+					return nil, fail(err)
+				}
+				v, vt, vn = append(v, i), append(vt, j), append(vn, k)
+			}
+			key := [2]string{object, group}
+			g := groups[key]
+			if g == nil {
+				g = &MeshGroup{Object: object, Group: group}
+				groups[key] = g
+				b.mesh.Groups = append(b.mesh.Groups, g)
+			}
+			for i := 1; i < len(v)-1; i++ {
+				a, b, c := 0, i, i+1
+				faces = append(faces, objFace{
+					v:         [3]int{v[a], v[b], v[c]},
+					vt:        [3]int{vt[a], vt[b], vt[c]},
+					vn:        [3]int{vn[a], vn[b], vn[c]},
+					smoothing: smoothing,
+					material:  material,
+					group:     g,
+				})
+			}
+		case "o":
+			object, group = joinArgs(args), ""
+		case "g":
+			group = joinArgs(args)
+		case "s":
+			if len(args) != 1 {
+				return nil, fail(errors.New("need 1 argument"))
+			}
+			if args[0] == "off" {
+				smoothing = 0
+				break
+			}
+			s, err := strconv.Atoi(args[0])
+			if err != nil {
+				return nil, fail(err)
+			}
+			smoothing = s
+		case "mtllib":
+			if len(args) == 0 {
+				return nil, fail(errors.New("missing file name"))
+			}
+			// a name may contain spaces, so only split it if the whole
+			// doesn't exist
+			names := []string{joinArgs(args)}
+			if _, err := os.Stat(RelativePath(path, names[0])); err != nil {
+				names = args
+			}
+			for _, name := range names {
+				mtl := RelativePath(path, name)
+				files, err := LoadMTL(mtl, parent, materials)
+				if err != nil {
+					return nil, fail(err)
+				}
+				b.files = append(b.files, files...)
+			}
+		case "usemtl":
+			name := joinArgs(args)
+			if m, ok := materials[name]; ok {
+				material = m
+			} else {
+				warn(fmt.Sprintf("unknown material %q", name))
+				material = &parent
+			}
+		default:
+			warn(fmt.Sprintf("%s is not supported", keyword))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &ParseError{path, next, err}
+	}
+
+	smooth := smoothNormals(faces, vs)
+	for _, f := range faces {
+		var v [3]uint32
+		for i := range v {
+			var t, n Vector
+			if f.vt[i] >= 0 {
+				t = vts[f.vt[i]]
+			}
+			switch {
+			case f.vn[i] >= 0:
+				n = vns[f.vn[i]]
+			case f.smoothing != 0:
+				n = smooth[[2]int{f.smoothing, f.v[i]}]
+			}
+			v[i] = b.sharedVertex(vs[f.v[i]], n, t)
+		}
+		f.group.Triangles = append(f.group.Triangles, b.triangle(v[0], v[1], v[2], f.material))
+	}
+	return b, nil
+}
+
+// parseFaceVertex parses v, v/vt, v//vn or v/vt/vn, given the lengths of the
+// vertex lists, and returns 0-based indices or -1 for missing ones.
+func parseFaceVertex(arg string, nv, nvt, nvn int) (v, vt, vn int, err error) {
+	parts := strings.Split(arg, "/")
+	if len(parts) > 3 {
+		return 0, 0, 0, fmt.Errorf("bad vertex %q", arg)
+	}
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+	if v, err = resolveIndex(parts[0], nv); err != nil {
+		return
+	}
+	vt, vn = -1, -1
+	if parts[1] != "" {
+		if vt, err = resolveIndex(parts[1], nvt); err != nil {
+			return
+		}
+	}
+	if parts[2] != "" {
+		if vn, err = resolveIndex(parts[2], nvn); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// resolveIndex turns a 1-based index, or a negative one counting back from
+// the end, into a 0-based index into a list of length n.
+func resolveIndex(s string, n int) (int, error) {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case i > 0 && i <= n:
+		return i - 1, nil
+	case i < 0 && -i <= n:
+		return n + i, nil
+	}
+	return 0, fmt.Errorf("index %d out of range, %d defined", i, n)
+}
+
+// smoothNormals averages the normals of the faces around each vertex within
+// each smoothing group, weighted by their area. The key is the smoothing
+// group and the vertex index.
+func smoothNormals(faces []objFace, vs []Vector) map[[2]int]Vector {
+	normals := make(map[[2]int]Vector)
+	for _, f := range faces {
+		if f.smoothing == 0 {
+			continue
+		}
+		n := vs[f.v[1]].Subtract(vs[f.v[0]]).Cross(vs[f.v[2]].Subtract(vs[f.v[0]]))
+		for _, v := range f.v {
+			key := [2]int{f.smoothing, v}
+			normals[key] = normals[key].Add(n)
+		}
+	}
+	for k, n := range normals {
+		if l := n.Length(); l > 0 {
+			normals[k] = n.DivideScalar(l)
+		}
+	}
+	return normals
+}
@@ -0,0 +1,105 @@
+package lib
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func FuzzParseOBJ(f *testing.F) {
+	for _, seed := range []string{
+		"v 0 0 0\nv 1 0 0\nv 0 1 0\nf 1 2 3\n",
+		"v 0 0 0\nv 1 0 0\nv 0 1 0\nf -3 -2 -1\n",
+		"v 0 0 0\nv 1 0 0\nv 0 1 0\nf 1 2 4\n",
+		"v 0 0 0\nv 1 0 0\nv 0 1 0\nf 0 -1 -4\n",
+		"v 0 0 0\nv 1 0 0\nv 0 1 0\nvt 0 0\nvn 0 0 1\nf 1/1/1 2//1 3/1\n",
+		"v 0 0 0 \\\n 1\nv 1 0 0\nv 0 1 0 \\\n\nf 1 2 \\\n3\n",
+		"v 0 0 0\nv 1 0 0\nv 0 1 0\nv 1 1 0\ns 1\nf 1 2 3\ns off\nf 2 4 3\n",
+		"o a\ng b c\nv 0 0 0\nv 0 0 0\nv 0 0 0\nf 1 2 3 1\n",
+		"f 1/2/3/4 1 1\n",
+		"vt 1 2 3 4\n",
+		"v nan 0 0\nv 1 0 0\nv 0 1 0\nf 1 2 3\n",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, obj string) {
+		m, err := ParseOBJ(strings.NewReader(obj), filepath.Join(t.TempDir(), "fuzz.obj"), Material{})
+		if err != nil || m == nil {
+			return
+		}
+		if len(m.Indices)%3 != 0 || len(m.Materials) != len(m.Indices)/3 {
+			t.Fatalf("%d indices for %d triangles", len(m.Indices), len(m.Materials))
+		}
+		for _, i := range m.Indices {
+			if int(i) >= len(m.Positions) {
+				t.Fatalf("index %d of %d positions", i, len(m.Positions))
+			}
+		}
+	})
+}
+
+func TestParseOBJErrors(t *testing.T) {
+	tests := []struct {
+		name, obj string
+		line      int
+	}{
+		{"short vertex", "v 0 0 0\nv 1 0\n", 2},
+		{"bad number", "# comment\n\nvn 0 x 1\n", 3},
+		{"not a number", "v 0 0 0\nv NaN 0 0\n", 2},
+		{"infinite", "v 0 0 0\nv 1 0 0\nv 0 -inf 0\n", 3},
+		{"short face", "v 0 0 0\nv 1 0 0\nf 1 2\n", 3},
+		{"index out of range", "v 0 0 0\nv 1 0 0\nv 0 1 0\nf 1 2 4\n", 4},
+		{"zero index", "v 0 0 0\nv 1 0 0\nv 0 1 0\nf 0 1 2\n", 4},
+		{"negative index out of range", "v 0 0 0\nv 1 0 0\nv 0 1 0\nf -1 -2 -4\n", 4},
+		{"missing normal", "v 0 0 0\nv 1 0 0\nv 0 1 0\nf 1//1 2 3\n", 4},
+		{"after a continuation", "v 0 0 \\\n0\nv 1 0 0\nv 0 1 0\nf 1 2 5\n", 5},
+		{"continued", "v 0 0 0\nv 1 0 0\nv 0 1 0\nf 1 \\\n2 \\\n9\n", 4},
+		{"bad smoothing group", "s on\n", 1},
+	}
+	for _, test := range tests {
+		_, err := ParseOBJ(strings.NewReader(test.obj), "test.obj", Material{})
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("%s: error %v is not a ParseError", test.name, err)
+			continue
+		}
+		if perr.Path != "test.obj" || perr.Line != test.line {
+			t.Errorf("%s: error at %s:%d, want test.obj:%d", test.name, perr.Path, perr.Line, test.line)
+		}
+	}
+}
+
+func TestParseOBJNegativeIndices(t *testing.T) {
+	tests := []struct {
+		name, obj string
+		want      [][3]Vector
+	}{
+		{"positive", "v 0 0 0\nv 1 0 0\nv 0 1 0\nf 1 2 3\n",
+			[][3]Vector{{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}}}},
+		{"negative", "v 0 0 0\nv 1 0 0\nv 0 1 0\nf -3 -2 -1\n",
+			[][3]Vector{{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}}}},
+		{"relative to each face", "v 0 0 0\nv 1 0 0\nv 0 1 0\nf -3 -2 -1\nv 1 1 0\nf -3 -1 -2\n",
+			[][3]Vector{{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}}, {{1, 0, 0}, {1, 1, 0}, {0, 1, 0}}}},
+		{"mixed", "v 0 0 0\nv 1 0 0\nv 0 1 0\nv 1 1 0\nf 2 -1 -2\n",
+			[][3]Vector{{{1, 0, 0}, {1, 1, 0}, {0, 1, 0}}}},
+	}
+	for _, test := range tests {
+		m, err := ParseOBJ(strings.NewReader(test.obj), "test.obj", Material{})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(m.Indices) != 3*len(test.want) {
+			t.Errorf("%s: %d triangles, want %d", test.name, len(m.Indices)/3, len(test.want))
+			continue
+		}
+		for i, want := range test.want {
+			for j := range want {
+				if p := m.Positions[m.Indices[3*i+j]]; p != want[j] {
+					t.Errorf("%s: vertex %d of triangle %d is %v, want %v", test.name, j, i, p, want[j])
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type plyProperty struct {
+	name      string
+	typ       string
+	countType string // set for lists, whose length comes first
+}
+
+type plyElement struct {
+	name       string
+	count      int
+	properties []plyProperty
+}
+
+var plySizes = map[string]int{
+	"char": 1, "uchar": 1, "short": 2, "ushort": 2, "int": 4, "uint": 4, "float": 4, "double": 8,
+	"int8": 1, "uint8": 1, "int16": 2, "uint16": 2, "int32": 4, "uint32": 4, "float32": 4, "float64": 8,
+}
+
+// LoadPLY reads an ASCII or binary PLY file of either byte order. Vertex
+// colours are kept in the mesh, replacing the colour of parent. Faces are
+// read one at a time, so only the vertices are held in memory besides the
+// mesh.
+func LoadPLY(path string, center Vector, scale float64, parent Material) (*Mesh, error) {
+	b, err := loadPLY(path, parent)
+	if err != nil {
+		return nil, err
+	}
+	return b.build(center, scale), nil
+}
+
+func loadPLY(path string, parent Material) (*meshBuilder, error) {
+	fmt.Printf("Loading PLY: %s\n", path)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	r := &plyReader{r: bufio.NewReaderSize(file, 1<<20), path: path}
+	elements, err := r.header()
+	if err != nil {
+		return nil, err
+	}
+
+	var vs, ns []Vector
+	var cs []RGB
+	b := &meshBuilder{}
+	for _, e := range elements {
+		switch e.name {
+		case "vertex":
+			vs, ns, cs, err = r.vertices(e)
+		case "face":
+			err = r.faces(e, b, vs, ns, cs, &parent)
+		default:
+			err = r.skip(e)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if b.count() == 0 {
+		return nil, fmt.Errorf("%s: no faces", path)
+	}
+	return b, nil
+}
+
+// plyReader reads the values of a PLY file one at a time, from text lines or
+// binary data.
+type plyReader struct {
+	r      *bufio.Reader
+	path   string
+	order  binary.ByteOrder // nil for ASCII files
+	line   int
+	fields []string
+	buf    [8]byte
+	list   []float64
+}
+
+func (r *plyReader) fail(err error) error {
+	if r.order == nil {
+		return &ParseError{r.path, r.line, err}
+	}
+	return fmt.Errorf("%s: %v", r.path, err)
+}
+
+func (r *plyReader) readLine() (string, error) {
+	s, err := r.r.ReadString('\n')
+	if err == io.EOF && s != "" {
+		err = nil
+	}
+	r.line++
+	return strings.TrimRight(s, "\r\n"), err
+}
+
+func (r *plyReader) header() ([]*plyElement, error) {
+	magic, err := r.readLine()
+	if err != nil || magic != "ply" {
+		return nil, fmt.Errorf("%s: not a PLY file", r.path)
+	}
+	var elements []*plyElement
+	format := false
+	for {
+		line, err := r.readLine()
+		if err == io.EOF {
+			return nil, r.fail(errors.New("missing end_header"))
+		}
+		if err != nil {
+			return nil, err
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		switch f[0] {
+		case "format":
+			if len(f) != 3 {
+				return nil, r.fail(errors.New("format: need 2 arguments"))
+			}
+			switch f[1] {
+			case "ascii":
+			case "binary_little_endian":
+				r.order = binary.LittleEndian
+			case "binary_big_endian":
+				r.order = binary.BigEndian
+			default:
+				return nil, r.fail(fmt.Errorf("unknown format %s", f[1]))
+			}
+			format = true
+		case "element":
+			if len(f) != 3 {
+				return nil, r.fail(errors.New("element: need 2 arguments"))
+			}
+			n, err := strconv.Atoi(f[2])
+			if err != nil || n < 0 {
+				return nil, r.fail(fmt.Errorf("element: bad count %q", f[2]))
+			}
+			elements = append(elements, &plyElement{name: f[1], count: n})
+		case "property":
+			if len(elements) == 0 {
+				return nil, r.fail(errors.New("property before element"))
+			}
+			var p plyProperty
+			switch {
+			case len(f) == 5 && f[1] == "list":
+				p = plyProperty{name: f[4], typ: f[3], countType: f[2]}
+			case len(f) == 3:
+				p = plyProperty{name: f[2], typ: f[1]}
+			default:
+				return nil, r.fail(errors.New("property: bad arguments"))
+			}
+			if plySizes[p.typ] == 0 || (p.countType != "" && plySizes[p.countType] == 0) {
+				return nil, r.fail(errors.New("property: unknown type"))
+			}
+			e := elements[len(elements)-1]
+			e.properties = append(e.properties, p)
+		case "comment", "obj_info":
+		case "end_header":
+			if !format {
+				return nil, r.fail(errors.New("missing format"))
+			}
+			return elements, nil
+		default:
+			return nil, r.fail(fmt.Errorf("unknown keyword %s", f[0]))
+		}
+	}
+}
+
+// value reads one value of the given type.
+func (r *plyReader) value(typ string) (float64, error) {
+	if r.order == nil {
+		if len(r.fields) == 0 {
+			return 0, errors.New("missing value")
+		}
+		s := r.fields[0]
+		r.fields = r.fields[1:]
+		return strconv.ParseFloat(s, 64)
+	}
+	b := r.buf[:plySizes[typ]]
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	switch typ {
+	case "char", "int8":
+		return float64(int8(b[0])), nil
+	case "uchar", "uint8":
+		return float64(b[0]), nil
+	case "short", "int16":
+		return float64(int16(r.order.Uint16(b))), nil
+	case "ushort", "uint16":
+		return float64(r.order.Uint16(b)), nil
+	case "int", "int32":
+		return float64(int32(r.order.Uint32(b))), nil
+	case "uint", "uint32":
+		return float64(r.order.Uint32(b)), nil
+	case "float", "float32":
+		return float64(math.Float32frombits(r.order.Uint32(b))), nil
+	}
+	return math.Float64frombits(r.order.Uint64(b)), nil
+}
+
+// element reads the next instance of e, calling f with every scalar value and
+// list. ASCII files give each instance on a line of its own.
+func (r *plyReader) element(e *plyElement, index int, f func(p int, values []float64)) error {
+	for r.order == nil && len(r.fields) == 0 {
+		line, err := r.readLine()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return r.fail(fmt.Errorf("%s %d: %v", e.name, index, err))
+		}
+		r.fields = strings.Fields(line)
+	}
+	list := r.list
+	for i, p := range e.properties {
+		var err error
+		if p.countType == "" {
+			var v float64
+			if v, err = r.value(p.typ); err == nil {
+				list = append(list[:0], v)
+			}
+		} else {
+			var n float64
+			if n, err = r.value(p.countType); err == nil {
+				if n < 0 || n != math.Trunc(n) {
+					err = fmt.Errorf("bad list length %v", n)
+				}
+				list = list[:0]
+				for j := 0; j < int(n) && err == nil; j++ {
+					var v float64
+					v, err = r.value(p.typ)
+					list = append(list, v)
+				}
+			}
+		}
+		if err != nil {
+			return r.fail(fmt.Errorf("%s %d: %s: %v", e.name, index, p.name, err))
+		}
+		f(i, list)
+	}
+	r.list = list
+	if r.order == nil && len(r.fields) > 0 {
+		return r.fail(fmt.Errorf("%s %d: too many values", e.name, index))
+	}
+	return nil
+}
+
+func (r *plyReader) skip(e *plyElement) error {
+	for i := 0; i < e.count; i++ {
+		if err := r.element(e, i, func(int, []float64) {}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *plyReader) vertices(e *plyElement) (vs, ns []Vector, cs []RGB, err error) {
+	has := make(map[string]bool)
+	for _, p := range e.properties {
+		has[p.name] = true
+	}
+	if !has["x"] || !has["y"] || !has["z"] {
+		return nil, nil, nil, fmt.Errorf("%s: vertices without positions", r.path)
+	}
+	vs = make([]Vector, e.count)
+	if has["nx"] && has["ny"] && has["nz"] {
+		ns = make([]Vector, e.count)
+	}
+	if has["red"] && has["green"] && has["blue"] {
+		cs = make([]RGB, e.count)
+	}
+	for i := 0; i < e.count; i++ {
+		err = r.element(e, i, func(p int, values []float64) {
+			if len(values) != 1 {
+				return
+			}
+			v := values[0]
+			switch e.properties[p].name {
+			case "x":
+				vs[i].X = v
+			case "y":
+				vs[i].Y = v
+			case "z":
+				vs[i].Z = v
+			}
+			if ns != nil {
+				switch e.properties[p].name {
+				case "nx":
+					ns[i].X = v
+				case "ny":
+					ns[i].Y = v
+				case "nz":
+					ns[i].Z = v
+				}
+			}
+			if cs != nil {
+				// integer colours count up to the largest value of their type
+				if t := e.properties[p].typ; t != "float" && t != "float32" && t != "double" && t != "float64" {
+					v /= math.Pow(2, 8*float64(plySizes[t])) - 1
+				}
+				switch e.properties[p].name {
+				case "red":
+					cs[i].R = v
+				case "green":
+					cs[i].G = v
+				case "blue":
+					cs[i].B = v
+				}
+			}
+		})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if cs != nil {
+			// colours are stored with the sRGB gamma
+			cs[i] = cs[i].Pow(2.2)
+		}
+	}
+	return vs, ns, cs, nil
+}
+
+func (r *plyReader) faces(e *plyElement, b *meshBuilder, vs, ns []Vector, cs []RGB, parent *Material) error {
+	indices := -1
+	for i, p := range e.properties {
+		if p.countType != "" && (p.name == "vertex_indices" || p.name == "vertex_index") {
+			indices = i
+		}
+	}
+	if indices < 0 {
+		return fmt.Errorf("%s: faces without vertex indices", r.path)
+	}
+	base := uint32(len(b.mesh.Positions))
+	for i, v := range vs {
+		var n Vector
+		if ns != nil {
+			n = ns[i]
+		}
+		b.vertex(v, n, Vector{})
+		if cs != nil {
+			b.mesh.Colors = append(b.mesh.Colors, cs[i])
+		}
+	}
+	var face []int
+	for i := 0; i < e.count; i++ {
+		var bad error
+		err := r.element(e, i, func(p int, values []float64) {
+			if p != indices {
+				return
+			}
+			face = face[:0]
+			for _, v := range values {
+				if v < 0 || int(v) >= len(vs) {
+					bad = fmt.Errorf("face %d: index %d out of range, %d vertices", i, int(v), len(vs))
+					return
+				}
+				face = append(face, int(v))
+			}
+		})
+		if err == nil && bad != nil {
+			err = r.fail(bad)
+		}
+		if err != nil {
+			return err
+		}
+		for j := 1; j+1 < len(face); j++ {
+			b.triangle(base+uint32(face[0]), base+uint32(face[j]), base+uint32(face[j+1]), parent)
+		}
+	}
+	return nil
+}
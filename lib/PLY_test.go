@@ -0,0 +1,58 @@
+package lib
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func TestPLYVertexColors(t *testing.T) {
+	ply := `ply
+format ascii 1.0
+element vertex 3
+property float x
+property float y
+property float z
+property uchar red
+property uchar green
+property uchar blue
+element face 1
+property list uchar int vertex_indices
+end_header
+0 0 0 255 0 0
+1 0 0 0 255 0
+0 1 0 0 0 255
+3 0 1 2
+`
+	path := filepath.Join(t.TempDir(), "triangle.ply")
+	if err := ioutil.WriteFile(path, []byte(ply), 0666); err != nil {
+		t.Fatal(err)
+	}
+	m, err := LoadPLY(path, Vector{}, 1, Material{Col: RGB{.5, .5, .5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Colors) != len(m.Positions) {
+		t.Fatalf("%d colours for %d vertices", len(m.Colors), len(m.Positions))
+	}
+
+	tests := []struct {
+		x, y float64
+		want RGB
+	}{
+		{1. / 3, 1. / 3, RGB{1. / 3, 1. / 3, 1. / 3}},
+		{.5, .01, RGB{.49, .5, .01}},
+		{.1, .2, RGB{.7, .1, .2}},
+	}
+	for _, test := range tests {
+		ok, hit := m.Hit(Ray{Vector{test.x, test.y, 1}, Vector{0, 0, -1}}, 0, math.MaxFloat64)
+		if !ok {
+			t.Fatalf("missed the triangle at %v, %v", test.x, test.y)
+		}
+		got := hit.Surface().Color()
+		if math.Abs(got.R-test.want.R) > 1e-9 || math.Abs(got.G-test.want.G) > 1e-9 || math.Abs(got.B-test.want.B) > 1e-9 {
+			t.Errorf("colour at %v, %v is %v, want %v", test.x, test.y, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"math"
+)
+
+// PathTracer is the unidirectional path tracer. Camera paths bounce through
+// the scene until they leave it, are ended by Russian roulette or reach the
+// depth limit of a kind of bounce, sampling ShadowRays shadow rays towards the
+// lights at every diffuse surface.
+type PathTracer struct {
+	MaxDepth             int // diffuse bounces
+	MaxSpecularDepth     int // mirror and glossy reflections
+	MaxTransmissionDepth int // refractions
+	RouletteDepth        int // bounces before Russian roulette may end a path
+	ShadowRays           int
+}
+
+// pathEstimate accumulates the light carried along a path and its
+// throughput, in whatever representation of colour the integrator uses.
+type pathEstimate interface {
+	// add adds light arriving through the path so far
+	add(light RGB)
+	// scale multiplies the throughput by the weight of a bounce
+	scale(weight RGB)
+	divide(f float64)
+	maxThroughput() float64
+	// refracted is told about refractions through m
+	refracted(m *Material)
+}
+
+type rgbEstimate struct {
+	L, beta RGB
+}
+
+func (e *rgbEstimate) add(light RGB) {
+	e.L = e.L.Add(e.beta.Multiply(light))
+}
+
+func (e *rgbEstimate) scale(weight RGB) {
+	e.beta = e.beta.Multiply(weight)
+}
+
+func (e *rgbEstimate) divide(f float64) {
+	e.beta = e.beta.DivScalar(f)
+}
+
+func (e *rgbEstimate) maxThroughput() float64 {
+	return e.beta.MaxComponent()
+}
+
+func (e *rgbEstimate) refracted(m *Material) {}
+
+func (p *PathTracer) Li(r Ray, ctx *SampleContext) RGB {
+	e := &rgbEstimate{beta: RGB{1, 1, 1}}
+	p.trace(r, ctx, e, 0)
+	return e.L
+}
+
+// trace follows a camera path, adding the light it finds to e. BSDFs refract
+// at the given wavelength in nanometres, if it isn't zero.
+func (p *PathTracer) trace(r Ray, ctx *SampleContext, e pathEstimate, wavelength float64) {
+	scene := ctx.Scene
+	// set after diffuse bounces, whose direct lighting has already been
+	// sampled
+	diffuse := false
+	var bounces, diffuseBounces, specularBounces, transmissionBounces int
+	for {
+		ok, hit := scene.KDTree.Hit(r, RayEpsilon, math.MaxFloat64, ctx.Intersections)
+		if !ok {
+			e.add(escaped(r, scene, diffuse))
+			return
+		}
+		// emitters are sampled as lights at diffuse surfaces
+		if hit.Material.Emittance > 0 && !diffuse {
+			e.add(hit.Emitted())
+		}
+		bsdf := NewBSDF(hit)
+		bsdf.Wavelength = wavelength
+		wo := r.Direction.Normalize().MultiplyScalar(-1)
+		wi, weight, pdf, specular := bsdf.Sample(wo, ctx.Rand)
+		if pdf == 0 || weight == (RGB{}) {
+			return
+		}
+		e.scale(weight)
+		switch {
+		case !specular:
+			e.add(scene.DirectLighting(hit.Point, facing(hit), p.ShadowRays, ctx.Rand))
+			diffuseBounces++
+			if diffuseBounces > p.MaxDepth {
+				return
+			}
+		case bsdf.Normal.Dot(wo)*bsdf.Normal.Dot(wi) < 0:
+			e.refracted(hit.Material)
+			transmissionBounces++
+			if transmissionBounces > p.MaxTransmissionDepth {
+				return
+			}
+		default:
+			specularBounces++
+			if specularBounces > p.MaxSpecularDepth {
+				return
+			}
+		}
+		diffuse = !specular
+
+		bounces++
+		if bounces > p.RouletteDepth {
+			q := math.Max(.05, 1-e.maxThroughput())
+			if ctx.Rand.Float64() < q {
+				return
+			}
+			e.divide(1 - q)
+		}
+		r = Ray{hit.Point, wi}
+	}
+}
+
+// escaped is the light arriving along a ray that left the scene. The
+// background is sampled directly at diffuse surfaces, so it is not counted
+// again for rays leaving them.
+func escaped(r Ray, scene *Scene, diffuse bool) RGB {
+	if scene.Background == nil || diffuse {
+		return RGB{}
+	}
+	return scene.Background.Radiance(r.Direction)
+}
@@ -0,0 +1,80 @@
+package lib
+
+import (
+	"sort"
+)
+
+type Photon struct {
+	Point     Vector
+	Direction Vector // towards where the photon came from
+	Power     RGB
+}
+
+// PhotonMap is a balanced kd-tree of photons, stored implicitly: the photon in
+// the middle of every range splits the rest of it along axes[middle].
+type PhotonMap struct {
+	photons []Photon
+	axes    []Axis
+}
+
+func NewPhotonMap(photons []Photon) *PhotonMap {
+	m := &PhotonMap{photons: photons, axes: make([]Axis, len(photons))}
+	m.build(0, len(photons))
+	return m
+}
+
+func (m *PhotonMap) Count() int {
+	return len(m.photons)
+}
+
+func (m *PhotonMap) build(lo, hi int) {
+	if hi-lo <= 1 {
+		return
+	}
+	box := Box{m.photons[lo].Point, m.photons[lo].Point}
+	for _, p := range m.photons[lo+1 : hi] {
+		box.Min = box.Min.Min(p.Point)
+		box.Max = box.Max.Max(p.Point)
+	}
+	extent := box.Max.Subtract(box.Min)
+	axis := AxisX
+	if extent.Y > extent.X && extent.Y >= extent.Z {
+		axis = AxisY
+	} else if extent.Z > extent.X && extent.Z > extent.Y {
+		axis = AxisZ
+	}
+	photons := m.photons[lo:hi]
+	sort.Slice(photons, func(i, j int) bool {
+		return photons[i].Point.Get(axis) < photons[j].Point.Get(axis)
+	})
+	mid := (lo + hi) / 2
+	m.axes[mid] = axis
+	m.build(lo, mid)
+	m.build(mid+1, hi)
+}
+
+// Lookup calls f for every photon within radius of p.
+func (m *PhotonMap) Lookup(p Vector, radius float64, f func(*Photon)) {
+	m.lookup(0, len(m.photons), p, radius, f)
+}
+
+func (m *PhotonMap) lookup(lo, hi int, p Vector, radius float64, f func(*Photon)) {
+	if lo >= hi {
+		return
+	}
+	mid := (lo + hi) / 2
+	photon := &m.photons[mid]
+	if photon.Point.Subtract(p).SquaredLength() <= radius*radius {
+		f(photon)
+	}
+	if hi-lo == 1 {
+		return
+	}
+	d := p.Get(m.axes[mid]) - photon.Point.Get(m.axes[mid])
+	if d <= radius {
+		m.lookup(lo, mid, p, radius, f)
+	}
+	if d >= -radius {
+		m.lookup(mid+1, hi, p, radius, f)
+	}
+}
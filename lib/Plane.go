@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Plane is the infinite plane through Point facing along Normal. It has no
+// finite bounding box, so the KD-tree keeps it apart, and no area to be a
+// light with.
+type Plane struct {
+	Point, Normal Vector
+	Mat           *Material
+}
+
+func (p *Plane) Material() *Material {
+	return p.Mat
+}
+
+// Hit gives the coordinates of the hit point along the basis of the normal as
+// UV, in scene units.
+func (p *Plane) Hit(r Ray, tMin, tMax float64) (bool, Hit) {
+	n := p.Normal.Normalize()
+	denom := n.Dot(r.Direction)
+	if math.Abs(denom) < EPS {
+		return false, Hit{}
+	}
+	t := n.Dot(p.Point.Subtract(r.Origin)) / denom
+	if t < tMin || t > tMax {
+		return false, Hit{}
+	}
+	q := r.Step(t)
+	s, v := n.Basis()
+	d := q.Subtract(p.Point)
+	return true, Hit{T: t, Point: q, Normal: n, UV: Vector{d.Dot(s), d.Dot(v), 0}, Ray: r, Material: p.Mat}
+}
+
+func (p *Plane) BoundingBox() Box {
+	inf := math.Inf(1)
+	return Box{Vector{-inf, -inf, -inf}, Vector{inf, inf, inf}}
+}
+
+func (p *Plane) MidPoint() Vector {
+	return p.Point
+}
+
+// RandomPoint gives the point of the plane closest to point.
+func (p *Plane) RandomPoint(rnd *rand.Rand, point Vector) Vector {
+	n := p.Normal.Normalize()
+	return point.Subtract(n.MultiplyScalar(n.Dot(point.Subtract(p.Point))))
+}
@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Quad is the parallelogram spanned by the edges U and V from Corner. Its
+// normal is U x V.
+type Quad struct {
+	Corner, U, V Vector
+	Mat          *Material
+}
+
+func (q *Quad) Material() *Material {
+	return q.Mat
+}
+
+func (q *Quad) Normal() Vector {
+	return q.U.Cross(q.V).Normalize()
+}
+
+func (q *Quad) Hit(r Ray, tMin, tMax float64) (bool, Hit) {
+	n := q.U.Cross(q.V)
+	denom := n.Dot(r.Direction)
+	if math.Abs(denom) < EPS {
+		return false, Hit{}
+	}
+	t := n.Dot(q.Corner.Subtract(r.Origin)) / denom
+	if t < tMin || t > tMax {
+		return false, Hit{}
+	}
+	p := r.Step(t)
+	w := n.DivideScalar(n.SquaredLength())
+	d := p.Subtract(q.Corner)
+	alpha := w.Dot(d.Cross(q.V))
+	beta := w.Dot(q.U.Cross(d))
+	if alpha < 0 || alpha > 1 || beta < 0 || beta > 1 {
+		return false, Hit{}
+	}
+	return true, Hit{T: t, Point: p, Normal: n.Normalize(), UV: Vector{alpha, beta, 0}, Ray: r, Material: q.Mat}
+}
+
+func (q *Quad) BoundingBox() Box {
+	a := q.Corner
+	b := a.Add(q.U)
+	c := a.Add(q.V)
+	d := b.Add(q.V)
+	pad := Vector{RayEpsilon, RayEpsilon, RayEpsilon}
+	return Box{a.Min(b).Min(c).Min(d).Subtract(pad), a.Max(b).Max(c).Max(d).Add(pad)}
+}
+
+func (q *Quad) MidPoint() Vector {
+	return q.Corner.Add(q.U.MultiplyScalar(.5)).Add(q.V.MultiplyScalar(.5))
+}
+
+func (q *Quad) RandomPoint(rnd *rand.Rand, point Vector) Vector {
+	p, _ := q.SamplePoint(rnd)
+	return p
+}
+
+func (q *Quad) SurfaceArea() float64 {
+	return q.U.Cross(q.V).Length()
+}
+
+func (q *Quad) SamplePoint(rnd *rand.Rand) (Vector, Vector) {
+	p := q.Corner.Add(q.U.MultiplyScalar(rnd.Float64())).Add(q.V.MultiplyScalar(rnd.Float64()))
+	return p, q.Normal()
+}
+
+func (q *Quad) SampleFrom(p Vector, rnd *rand.Rand) (Vector, Vector, float64) {
+	return sampleByArea(q, p, rnd)
+}
+
+func (q *Quad) PdfFrom(p, direction Vector) float64 {
+	return pdfByArea(q, p, direction)
+}
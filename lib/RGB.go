@@ -34,8 +34,14 @@ func (c RGB) Sqrt() RGB {
 func (c RGB) MaxComponent() float64 {
 	return math.Max(c.R, math.Max(c.G, c.B))
 }
+func (c RGB) Luminance() float64 {
+	return .2126*c.R + .7152*c.G + .0722*c.B
+}
 func (c RGB) RGBA() color.RGBA {
-	return color.RGBA{uint8(c.R * 255.0), uint8(c.G * 255.0), uint8(c.B * 255.0), uint8(255)}
+	return color.RGBA{toByte(c.R), toByte(c.G), toByte(c.B), uint8(255)}
+}
+func toByte(f float64) uint8 {
+	return uint8(math.Max(0, math.Min(1, f)) * 255.0)
 }
 func (a RGB) Mix(b RGB, pct float64) RGB {
 	a = a.MultiplyScalar(1 - pct)
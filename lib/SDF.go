@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"math"
+	"math/rand"
+)
+
+const (
+	sdfEpsilon  = 1e-4 // how close to the surface sphere tracing stops
+	sdfMaxSteps = 512
+)
+
+// DistanceFunc gives the signed distance from p to a surface, negative
+// inside. It may underestimate the distance but must not overestimate it, or
+// sphere tracing steps through the surface.
+type DistanceFunc func(p Vector) float64
+
+// SDF is the implicit surface where Distance is zero, found by sphere tracing
+// within Bounds, which must enclose it.
+type SDF struct {
+	Distance DistanceFunc
+	Bounds   Box
+	Mat      *Material
+	// Key stands in for Distance in scene hashes, which can't look into
+	// functions: SDFs of different surfaces need different keys, such as
+	// their kind and parameters.
+	Key string
+}
+
+func (s *SDF) Material() *Material {
+	return s.Mat
+}
+
+// Hit steps along the ray by the distance to the surface until it is close
+// enough. Rays that start on the surface and move away from it or through it,
+// as reflected and refracted rays do, first step until they are clear of it,
+// so that they don't hit it again at once.
+func (s *SDF) Hit(r Ray, tMin, tMax float64) (bool, Hit) {
+	t1, t2 := s.Bounds.Intersect(r)
+	t, end := math.Max(t1, tMin), math.Min(t2, tMax)
+	if t > end {
+		return false, Hit{}
+	}
+	length := r.Direction.Length()
+	// a ray that enters the bounds can't be leaving the surface
+	leaving := t1 <= tMin
+	for i := 0; i < sdfMaxSteps && t <= end; i++ {
+		d := s.Distance(r.Step(t))
+		if math.Abs(d) < sdfEpsilon {
+			// leaving rays get further away or cross the surface they
+			// start on, only approaching ones hit it
+			next := s.Distance(r.Step(t + sdfEpsilon/length))
+			if !leaving || next*d > 0 && math.Abs(next) < math.Abs(d) {
+				p := r.Step(t)
+				return true, Hit{T: t, Point: p, Normal: s.Normal(p), Ray: r, Material: s.Mat}
+			}
+			d = sdfEpsilon
+		} else {
+			leaving = false
+		}
+		t += math.Abs(d) / length
+	}
+	return false, Hit{}
+}
+
+// Normal is the gradient of the distance at p by central differences.
+func (s *SDF) Normal(p Vector) Vector {
+	const h = sdfEpsilon
+	return Vector{
+		s.Distance(Vector{p.X + h, p.Y, p.Z}) - s.Distance(Vector{p.X - h, p.Y, p.Z}),
+		s.Distance(Vector{p.X, p.Y + h, p.Z}) - s.Distance(Vector{p.X, p.Y - h, p.Z}),
+		s.Distance(Vector{p.X, p.Y, p.Z + h}) - s.Distance(Vector{p.X, p.Y, p.Z - h}),
+	}.Normalize()
+}
+
+func (s *SDF) BoundingBox() Box {
+	return s.Bounds
+}
+
+func (s *SDF) MidPoint() Vector {
+	return s.Bounds.MidPoint()
+}
+
+// RandomPoint moves a random point of the bounds onto the surface along the
+// gradient. The points aren't spread evenly.
+func (s *SDF) RandomPoint(rnd *rand.Rand, point Vector) Vector {
+	size := s.Bounds.Max.Subtract(s.Bounds.Min)
+	p := s.Bounds.Min.Add(size.Multiply(Vector{rnd.Float64(), rnd.Float64(), rnd.Float64()}))
+	for i := 0; i < 32; i++ {
+		d := s.Distance(p)
+		if math.Abs(d) < sdfEpsilon {
+			break
+		}
+		p = p.Subtract(s.Normal(p).MultiplyScalar(d))
+	}
+	return p
+}
+
+// SphereDistance is the distance function of a sphere.
+func SphereDistance(center Vector, radius float64) DistanceFunc {
+	return func(p Vector) float64 {
+		return p.Subtract(center).Length() - radius
+	}
+}
+
+// RoundedBoxDistance is the distance function of an axis-aligned box with the
+// given half size, whose edges are rounded off by radius.
+func RoundedBoxDistance(center, halfSize Vector, radius float64) DistanceFunc {
+	inner := halfSize.SubtractScalar(radius)
+	return func(p Vector) float64 {
+		q := p.Subtract(center)
+		q = Vector{math.Abs(q.X), math.Abs(q.Y), math.Abs(q.Z)}.Subtract(inner)
+		outside := q.Max(Vector{}).Length()
+		inside := math.Min(math.Max(q.X, math.Max(q.Y, q.Z)), 0)
+		return outside + inside - radius
+	}
+}
+
+// SmoothUnion joins two surfaces, blending them where they come within k of
+// each other, as metaballs do.
+func SmoothUnion(a, b DistanceFunc, k float64) DistanceFunc {
+	return func(p Vector) float64 {
+		da, db := a(p), b(p)
+		h := math.Max(0, math.Min(1, .5+.5*(db-da)/k))
+		return db + (da-db)*h - k*h*(1-h)
+	}
+}
+
+// SmoothSubtract carves b out of a, rounding the edges of the cut by k.
+func SmoothSubtract(a, b DistanceFunc, k float64) DistanceFunc {
+	return func(p Vector) float64 {
+		da, db := a(p), b(p)
+		h := math.Max(0, math.Min(1, .5-.5*(da+db)/k))
+		return da + (-db-da)*h + k*h*(1-h)
+	}
+}
@@ -0,0 +1,163 @@
+package lib
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func sdfSphere() (*SDF, *Sphere) {
+	mat := Lambertian(RGB{1, 1, 1})
+	s := &SDF{
+		Distance: SphereDistance(Vector{1, 2, 3}, 1),
+		Bounds:   Box{Vector{-.5, .5, 1.5}, Vector{2.5, 3.5, 4.5}},
+		Mat:      mat,
+		Key:      "sphere",
+	}
+	return s, &Sphere{Center: Vector{1, 2, 3}, Radius: 1, Mat: mat}
+}
+
+func TestSDFHit(t *testing.T) {
+	s, sphere := sdfSphere()
+	rnd := rand.New(rand.NewSource(1))
+	hits := 0
+	for i := 0; i < 1000; i++ {
+		origin := Vector{rnd.Float64(), rnd.Float64(), rnd.Float64()}.MultiplyScalar(10).Subtract(Vector{4, 3, 2})
+		target := Vector{rnd.Float64(), rnd.Float64(), rnd.Float64()}.MultiplyScalar(2.4).Add(Vector{-.2, .8, 1.8})
+		r := Ray{origin, target.Subtract(origin)}
+		ok, hit := s.Hit(r, RayEpsilon, math.MaxFloat64)
+		wantOK, want := sphere.Hit(r, RayEpsilon, math.MaxFloat64)
+		if ok != wantOK {
+			// rays that only graze the sphere may go either way
+			if d := r.Direction.Normalize().Cross(sphere.Center.Subtract(origin)).Length(); math.Abs(d-1) > 1e-3 {
+				t.Fatalf("ray %d: hit %v, sphere %v", i, ok, wantOK)
+			}
+			continue
+		}
+		if !ok {
+			continue
+		}
+		hits++
+		// tracing stops short of the surface, by more the flatter the ray meets it
+		if d := s.Distance(hit.Point); math.Abs(d) > sdfEpsilon || hit.T > want.T {
+			t.Errorf("ray %d: hit at %v, %v from the surface, sphere at %v", i, hit.T, d, want.T)
+		}
+		if n := hit.Point.Subtract(sphere.Center).Normalize(); hit.Normal.Subtract(n).Length() > 1e-6 {
+			t.Errorf("ray %d: normal %v, want %v", i, hit.Normal, n)
+		}
+		if hit.Material != s.Mat {
+			t.Errorf("ray %d: material %v", i, hit.Material)
+		}
+	}
+	if hits < 300 {
+		t.Errorf("only %d of the rays hit", hits)
+	}
+}
+
+func TestSDFFromSurface(t *testing.T) {
+	s, _ := sdfSphere()
+	tests := []struct {
+		name      string
+		origin    Vector
+		direction Vector
+		ok        bool
+		t         float64
+	}{
+		// secondary rays leaving the surface must not hit it again at once
+		{"leaving", Vector{1, 2, 2}, Vector{0, 0, -1}, false, 0},
+		{"leaving obliquely", Vector{1, 2, 2}, Vector{1, 1, -1}, false, 0},
+		{"leaving at a grazing angle", Vector{1, 2, 2}, Vector{1, 0, -.01}, false, 0},
+		// where tracing stopped, just outside
+		{"leaving from outside", Vector{1, 2, 2 - sdfEpsilon/2}, Vector{0, 1, -.01}, false, 0},
+		// refracted rays cross the inside to the far side
+		{"entering", Vector{1, 2, 2}, Vector{0, 0, 1}, true, 2},
+		{"entering scaled", Vector{1, 2, 2}, Vector{0, 0, 4}, true, .5},
+		{"entering obliquely", Vector{1, 2, 2}, Vector{0, 1, 1}, true, 1},
+		{"entering from outside", Vector{1, 2, 2 - sdfEpsilon/2}, Vector{0, 0, 1}, true, 2 + sdfEpsilon/2},
+	}
+	for _, test := range tests {
+		for _, tMin := range []float64{0, RayEpsilon} {
+			ok, hit := s.Hit(Ray{test.origin, test.direction}, tMin, math.MaxFloat64)
+			if ok != test.ok {
+				t.Errorf("%s from %v: hit %v at %v, want %v", test.name, tMin, ok, hit.T, test.ok)
+				continue
+			}
+			if ok && math.Abs(hit.T-test.t)*test.direction.Length() > 2*sdfEpsilon {
+				t.Errorf("%s from %v: hit at %v, want %v", test.name, tMin, hit.T, test.t)
+			}
+		}
+	}
+}
+
+func TestSDFGrazing(t *testing.T) {
+	s, sphere := sdfSphere()
+	for _, offset := range []float64{-1e-2, -1e-3, 1e-3, 1e-2} {
+		// along x, passing the top of the sphere at height offset
+		r := Ray{Vector{-5, 3 + offset, 3}, Vector{1, 0, 0}}
+		ok, hit := s.Hit(r, RayEpsilon, math.MaxFloat64)
+		if offset > 0 {
+			if ok {
+				t.Errorf("offset %v: hit at %v, want a miss", offset, hit.T)
+			}
+			continue
+		}
+		_, want := sphere.Hit(r, RayEpsilon, math.MaxFloat64)
+		// a ray close to the surface may stop where it is within sdfEpsilon
+		if !ok || math.Abs(hit.T-want.T) > math.Sqrt(2*sdfEpsilon) {
+			t.Errorf("offset %v: hit %v at %v, sphere at %v", offset, ok, hit.T, want.T)
+		}
+	}
+}
+
+func TestSmoothCombinations(t *testing.T) {
+	constant := func(d float64) DistanceFunc {
+		return func(Vector) float64 { return d }
+	}
+	const k = .5
+	tests := []struct {
+		name   string
+		f      DistanceFunc
+		a, b   float64
+		result float64
+	}{
+		// apart by more than k the blend is the plain union
+		{"union of a", SmoothUnion(constant(.2), constant(1), k), .2, 1, .2},
+		{"union of b", SmoothUnion(constant(1), constant(-.3), k), 1, -.3, -.3},
+		// where they are equal it reaches k/4 further
+		{"union blended", SmoothUnion(constant(.3), constant(.3), k), .3, .3, .3 - k/4},
+		{"union half blended", SmoothUnion(constant(0), constant(.25), k), 0, .25, .25 - .25*.75 - k*.75*.25},
+		// well outside b, a is left alone
+		{"subtract outside b", SmoothSubtract(constant(.2), constant(1), k), .2, 1, .2},
+		// well inside b, the surface of b is the boundary
+		{"subtract inside b", SmoothSubtract(constant(-1), constant(-.2), k), -1, -.2, .2},
+		{"subtract blended", SmoothSubtract(constant(.1), constant(-.1), k), .1, -.1, .1 + k/4},
+	}
+	for _, test := range tests {
+		if d := test.f(Vector{}); math.Abs(d-test.result) > 1e-12 {
+			t.Errorf("%s of %v and %v is %v, want %v", test.name, test.a, test.b, d, test.result)
+		}
+	}
+
+	// blending spheres fills the gap between them
+	a, b := SphereDistance(Vector{-1, 0, 0}, .9), SphereDistance(Vector{1, 0, 0}, .9)
+	if d := SmoothUnion(a, b, k)(Vector{}); d >= 0 || math.Min(a(Vector{}), b(Vector{})) <= 0 {
+		t.Errorf("the gap between the spheres is at %v", d)
+	}
+}
+
+func TestSDFHash(t *testing.T) {
+	cam := NewCamera(Vector{0, 0, -5}, Vector{}, 45, 1, 0)
+	hash := func(key string) uint64 {
+		s, _ := sdfSphere()
+		s.Key = key
+		scene := &Scene{}
+		scene.Add(s)
+		return scene.Hash(cam)
+	}
+	if hash("a") == hash("b") {
+		t.Error("SDFs with different keys hash the same")
+	}
+	if hash("a") != hash("a") {
+		t.Error("SDFs with the same key hash differently")
+	}
+}
@@ -0,0 +1,212 @@
+package lib
+
+import (
+	"math"
+	"math/rand"
+)
+
+// SPPM is stochastic progressive photon mapping (Hachisuka and Jensen,
+// "Stochastic Progressive Photon Mapping"). Every pass follows one camera path
+// per pixel through specular bounces to a visible point on a diffuse surface,
+// where direct lighting is sampled, then emits photons from the lights into a
+// PhotonMap and gathers those near each visible point. The gather radius of a
+// pixel shrinks as it collects photons, so the estimate converges; caustics,
+// which paths from the camera hardly ever find, come from the photons.
+type SPPM struct {
+	MaxDepth       int
+	PhotonsPerPass int
+	InitialRadius  float64
+	Alpha          float64 // fraction of new photons kept when shrinking the radius
+	ShadowRays     int
+
+	lights       []Light
+	lightSampler *PowerLightSampler
+}
+
+func NewSPPM(scene *Scene, maxDepth, photonsPerPass, shadowRays int) *SPPM {
+	s := &SPPM{
+		MaxDepth:       maxDepth,
+		PhotonsPerPass: photonsPerPass,
+		Alpha:          2.0 / 3,
+		ShadowRays:     shadowRays,
+	}
+	center, radius := scene.BoundingSphere()
+	s.InitialRadius = radius / 100
+	s.lights = append([]Light(nil), scene.Lights...)
+	if scene.Background != nil {
+		s.lights = append(s.lights, NewBackgroundLight(scene.Background, center, radius))
+	}
+	s.lightSampler = NewPowerLightSampler(s.lights)
+	return s
+}
+
+type sppmPixel struct {
+	radius float64
+	ld     RGB     // sum of the direct light over all passes
+	n      float64 // photons accumulated so far
+	tau    RGB     // flux of the accumulated photons
+
+	// visible point of the current pass
+	found bool
+	p, wo Vector
+	bsdf  BSDF
+	beta  RGB
+
+	phi RGB // flux of the photons gathered this pass
+	m   int
+}
+
+// Render runs the given number of passes and adds their estimate to film as
+// one sample per pixel. film covers the whole width by height image.
+func (s *SPPM) Render(scene *Scene, cam *Camera, film *Buffer, width, height, passes int, seed int64, threads int) {
+	var intersections int
+	pixels := make([]sppmPixel, width*height)
+	for i := range pixels {
+		pixels[i].radius = s.InitialRadius
+	}
+	photons := s.PhotonsPerPass
+	if photons <= 0 {
+		photons = width * height
+	}
+	for pass := 0; pass < passes; pass++ {
+		passSeed := seed + int64(pass)<<24
+
+		parallel(height, threads, func(y int) {
+			rnd := rand.New(rand.NewSource(passSeed + int64(y)))
+			for x := 0; x < width; x++ {
+				fx := (float64(x) + rnd.Float64()) / float64(width)
+				fy := (float64(y) + rnd.Float64()) / float64(height)
+				s.visiblePoint(scene, cam.RayAt(fx, fy, rnd), &pixels[y*width+x], rnd, &intersections)
+			}
+		})
+
+		chunks := make([][]Photon, threads)
+		parallel(threads, threads, func(i int) {
+			rnd := rand.New(rand.NewSource(passSeed + int64(height) + int64(i)))
+			for j := i; j < photons; j += threads {
+				chunks[i] = s.tracePhoton(scene, chunks[i], rnd, &intersections)
+			}
+		})
+		var all []Photon
+		for _, c := range chunks {
+			all = append(all, c...)
+		}
+		photonMap := NewPhotonMap(all)
+
+		parallel(len(pixels), threads, func(i int) {
+			p := &pixels[i]
+			if !p.found {
+				return
+			}
+			photonMap.Lookup(p.p, p.radius, func(photon *Photon) {
+				f := p.bsdf.F(p.wo, photon.Direction)
+				if f == (RGB{}) {
+					return
+				}
+				p.phi = p.phi.Add(photon.Power.Multiply(f))
+				p.m++
+			})
+			if p.m > 0 {
+				n := p.n + s.Alpha*float64(p.m)
+				radius := p.radius * math.Sqrt(n/(p.n+float64(p.m)))
+				ratio := radius / p.radius
+				p.tau = p.tau.Add(p.beta.Multiply(p.phi)).MultiplyScalar(ratio * ratio)
+				p.n, p.radius = n, radius
+			}
+			p.phi, p.m = RGB{}, 0
+		})
+	}
+
+	emitted := float64(passes) * float64(photons)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := &pixels[y*width+x]
+			L := p.ld.DivScalar(float64(passes))
+			L = L.Add(p.tau.DivScalar(emitted * math.Pi * p.radius * p.radius))
+			film.AddSample(x, y, L)
+		}
+	}
+}
+
+// visiblePoint follows r through specular bounces to the first diffuse
+// surface, adding the light found on the way and the direct light there to
+// p.ld.
+func (s *SPPM) visiblePoint(scene *Scene, r Ray, p *sppmPixel, rnd *rand.Rand, intersections *int) {
+	p.found = false
+	beta := RGB{1, 1, 1}
+	for depth := 0; depth <= s.MaxDepth; depth++ {
+		ok, hit := scene.KDTree.Hit(r, RayEpsilon, math.MaxFloat64, intersections)
+		if !ok {
+			if scene.Background != nil {
+				p.ld = p.ld.Add(beta.Multiply(scene.Background.Radiance(r.Direction)))
+			}
+			return
+		}
+		if hit.Material.Emittance > 0 {
+			p.ld = p.ld.Add(beta.Multiply(hit.Emitted()))
+		}
+		bsdf := NewBSDF(hit)
+		wo := r.Direction.Normalize().MultiplyScalar(-1)
+		if bsdf.Connectable() {
+			n := bsdf.Normal
+			if n.Dot(wo) < 0 {
+				n = n.MultiplyScalar(-1)
+			}
+			// DirectLighting is divided by pi already, as F is
+			direct := scene.DirectLighting(hit.Point, n, s.ShadowRays, rnd)
+			p.ld = p.ld.Add(beta.Multiply(bsdf.F(wo, n).MultiplyScalar(math.Pi)).Multiply(direct))
+			p.found, p.p, p.wo, p.bsdf, p.beta = true, hit.Point, wo, bsdf, beta
+			return
+		}
+		wi, weight, pdf, _ := bsdf.Sample(wo, rnd)
+		if pdf == 0 {
+			return
+		}
+		beta = beta.Multiply(weight)
+		r = Ray{hit.Point, wi}
+	}
+}
+
+// tracePhoton emits a photon from a light and appends it to photons at every
+// diffuse surface it reaches after the first, whose light is sampled directly
+// by the visible points instead.
+func (s *SPPM) tracePhoton(scene *Scene, photons []Photon, rnd *rand.Rand, intersections *int) []Photon {
+	l, pmf := s.lightSampler.Sample(Vector{}, Vector{}, rnd.Float64())
+	if l == nil || pmf == 0 {
+		return photons
+	}
+	e := l.SampleEmission(rnd)
+	if e.PdfPos == 0 || e.PdfDir == 0 || e.Radiance == (RGB{}) {
+		return photons
+	}
+	cos := 1.0
+	if e.Normal != (Vector{}) {
+		cos = math.Abs(e.Normal.Dot(e.Ray.Direction))
+	}
+	beta := e.Radiance.MultiplyScalar(cos / (pmf * e.PdfPos * e.PdfDir))
+	r := e.Ray
+	for depth := 0; depth < s.MaxDepth; depth++ {
+		ok, hit := scene.KDTree.Hit(r, RayEpsilon, math.MaxFloat64, intersections)
+		if !ok {
+			break
+		}
+		bsdf := NewBSDF(hit)
+		wo := r.Direction.Normalize().MultiplyScalar(-1)
+		if depth > 0 && bsdf.Connectable() {
+			photons = append(photons, Photon{hit.Point, wo, beta})
+		}
+		wi, weight, pdf, _ := bsdf.Sample(wo, rnd)
+		if pdf == 0 {
+			break
+		}
+		// Russian roulette keeps the photon powers from spreading
+		next := beta.Multiply(weight)
+		q := math.Min(1, next.Luminance()/beta.Luminance())
+		if q <= 0 || rnd.Float64() >= q {
+			break
+		}
+		beta = next.DivScalar(q)
+		r = Ray{hit.Point, wi}
+	}
+	return photons
+}
@@ -0,0 +1,152 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// LoadSTL reads an ASCII or binary STL file. Binary files may colour their
+// triangles as VisCAM and SolidView do, with 5 bits per channel in the
+// attribute bytes. Facets are flat, turned to face the way their normal points
+// if it disagrees with their winding. Every solid of an ASCII file becomes a
+// group of the mesh.
+func LoadSTL(path string, center Vector, scale float64, parent Material) (*Mesh, error) {
+	b, err := loadSTL(path, parent)
+	if err != nil {
+		return nil, err
+	}
+	return b.build(center, scale), nil
+}
+
+func loadSTL(path string, parent Material) (*meshBuilder, error) {
+	fmt.Printf("Loading STL: %s\n", path)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReaderSize(file, 1<<20)
+
+	// binary files may start with "solid" as well, but their size gives them
+	// away
+	b := &meshBuilder{}
+	header, err := r.Peek(84)
+	if err == nil && info.Size() == 84+50*int64(binary.LittleEndian.Uint32(header[80:])) {
+		err = readBinarySTL(r, path, b, parent)
+	} else {
+		err = readASCIISTL(r, path, b, &parent)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if b.count() == 0 {
+		return nil, fmt.Errorf("%s: no facets", path)
+	}
+	return b, nil
+}
+
+func readBinarySTL(r io.Reader, path string, b *meshBuilder, parent Material) error {
+	var header [84]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	count := int(binary.LittleEndian.Uint32(header[80:]))
+	materials := newColourMaterials(parent)
+	var buf [50]byte
+	for i := 0; i < count; i++ {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return fmt.Errorf("%s: facet %d: %v", path, i, err)
+		}
+		var v [4]Vector
+		for j := range v {
+			var f [3]float64
+			for k := range f {
+				f[k] = float64(math.Float32frombits(binary.LittleEndian.Uint32(buf[12*j+4*k:])))
+			}
+			v[j] = Vector{f[0], f[1], f[2]}
+		}
+		material := &parent
+		if a := binary.LittleEndian.Uint16(buf[48:]); a&0x8000 != 0 {
+			c := RGB{float64(a >> 10 & 31), float64(a >> 5 & 31), float64(a & 31)}
+			material = materials.get(c.DivScalar(31).Pow(2.2))
+		}
+		stlFacet(b, v[0], v[1], v[2], v[3], material)
+	}
+	return nil
+}
+
+func readASCIISTL(r io.Reader, path string, b *meshBuilder, parent *Material) error {
+	var group *MeshGroup
+	var normal Vector
+	var vs []Vector
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		f := strings.Fields(scanner.Text())
+		if len(f) == 0 {
+			continue
+		}
+		fail := func(err error) error {
+			return &ParseError{path, line, fmt.Errorf("%s: %v", f[0], err)}
+		}
+		switch f[0] {
+		case "solid":
+			group = &MeshGroup{Object: joinArgs(f[1:])}
+			b.mesh.Groups = append(b.mesh.Groups, group)
+		case "facet":
+			if len(f) != 5 || f[1] != "normal" {
+				return fail(errors.New("expected facet normal x y z"))
+			}
+			n, err := parseNumbers(f[2:])
+			if err != nil {
+				return fail(err)
+			}
+			normal, vs = Vector{n[0], n[1], n[2]}, vs[:0]
+		case "vertex":
+			if len(f) != 4 {
+				return fail(errors.New("need 3 coordinates"))
+			}
+			v, err := parseNumbers(f[1:])
+			if err != nil {
+				return fail(err)
+			}
+			vs = append(vs, Vector{v[0], v[1], v[2]})
+		case "endfacet":
+			if len(vs) != 3 {
+				return fail(fmt.Errorf("facet has %d vertices", len(vs)))
+			}
+			t := stlFacet(b, normal, vs[0], vs[1], vs[2], parent)
+			if group != nil {
+				group.Triangles = append(group.Triangles, t)
+			}
+		case "outer", "endloop", "endsolid":
+		default:
+			if line == 1 {
+				return fmt.Errorf("%s: not an STL file", path)
+			}
+			return fail(errors.New("unknown keyword"))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// stlFacet adds a flat triangle, wound to face along n unless n is zero, and
+// returns its index.
+func stlFacet(b *meshBuilder, n, v1, v2, v3 Vector, material *Material) uint32 {
+	if v2.Subtract(v1).Cross(v3.Subtract(v1)).Dot(n) < 0 {
+		v2, v3 = v3, v2
+	}
+	return b.triangle(b.sharedVertex(v1, Vector{}, Vector{}), b.sharedVertex(v2, Vector{}, Vector{}), b.sharedVertex(v3, Vector{}, Vector{}), material)
+}
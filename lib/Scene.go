@@ -1,38 +1,281 @@
 package lib
 
 import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"math"
 	"math/rand"
 )
 
 type Scene struct {
-	objects []Hittable
-	Lights  []Hittable
-	KDTree  *KDNode
+	objects       []Hittable
+	Lights        []Light
+	KDTree        *KDNode
+	Background    Background
+	lightSampling string
+	lightSampler  LightSampler
+	areaLights    map[Hittable]*AreaLight
 }
 
+const DefaultLightSampling = "bvh"
+
 func (s *Scene) Add(h Hittable) {
 	s.objects = append(s.objects, h)
-	if h.Material().Emittance > 0 {
-		s.Lights = append(s.Lights, h)
-	}
-	s.KDTree = build(s.objects, 0)
-
+	s.addLights(h)
+	s.KDTree = MakeKDTree(s.objects)
+	s.updateLights()
 }
 func (s *Scene) AddAll(hittables []Hittable) {
 	for _, h := range hittables {
 		s.objects = append(s.objects, h)
-		if h.Material().Emittance > 0 {
-			s.Lights = append(s.Lights, h)
+		s.addLights(h)
+	}
+	s.KDTree = MakeKDTree(s.objects)
+	s.updateLights()
+}
+
+// AddLight adds a light that has no geometry of its own, such as a point light.
+func (s *Scene) AddLight(l Light) {
+	s.Lights = append(s.Lights, l)
+	s.updateLights()
+}
+
+// addLights registers emissive geometry as area lights, one per emissive
+// triangle for meshes.
+func (s *Scene) addLights(h Hittable) {
+	switch h := h.(type) {
+	case *Mesh:
+		for i, m := range h.Materials {
+			if m.Emittance > 0 {
+				s.addAreaLight(h.Triangle(i))
+			}
 		}
+	case Shape:
+		s.addAreaLight(h)
+	}
+}
+
+func (s *Scene) addAreaLight(shape Shape) {
+	if shape.Material().Emittance <= 0 {
+		return
+	}
+	if s.areaLights == nil {
+		s.areaLights = make(map[Hittable]*AreaLight)
 	}
-	s.KDTree = build(s.objects, 0)
+	l := NewAreaLight(shape)
+	s.areaLights[shape] = l
+	s.Lights = append(s.Lights, l)
+}
+
+// SetLightSampling chooses how lights are picked for direct lighting, see
+// NewLightSampler.
+func (s *Scene) SetLightSampling(name string) bool {
+	if _, ok := NewLightSampler(name, nil); !ok {
+		return false
+	}
+	s.lightSampling = name
+	s.updateLights()
+	return true
+}
+
+func (s *Scene) updateLights() {
+	center, radius := s.BoundingSphere()
+	for _, l := range s.Lights {
+		if d, ok := l.(*DirectionalLight); ok {
+			d.center, d.radius = center, radius
+		}
+	}
+	name := s.lightSampling
+	if name == "" {
+		name = DefaultLightSampling
+	}
+	s.lightSampler, _ = NewLightSampler(name, s.Lights)
+}
+
+// BoundingSphere encloses all objects of the scene.
+func (s *Scene) BoundingSphere() (Vector, float64) {
+	if s.KDTree == nil {
+		return Vector{}, 0
+	}
+	box := s.KDTree.BoundingBox
+	return box.MidPoint(), box.Max.Subtract(box.Min).Length() / 2
+}
+
+// LightOf returns the area light of an emissive object, nil if it has none.
+func (s *Scene) LightOf(object Hittable) *AreaLight {
+	return s.areaLights[object]
 }
+
 func (s *Scene) RayToRandomLight(p Vector, rnd *rand.Rand) Vector {
 	light := s.Lights[rnd.Intn(len(s.Lights))]
 
-	return light.RandomPoint(rnd, p).Subtract(p).Normalize()
+	return light.Sample(p, rnd).Direction
+}
+
+// DirectLighting estimates the light arriving directly from the lights and
+// the background at a point with the given normal, divided by pi so that
+// multiplying it by a diffuse albedo gives the reflected radiance. Each of the
+// samples goes to one light chosen by the light sampler, so the cost does not
+// depend on the number of lights.
+func (s *Scene) DirectLighting(point, normal Vector, samples int, rnd *rand.Rand) RGB {
+	if samples <= 0 {
+		return RGB{}
+	}
+	var intersections int
+	var contrib RGB
+	if len(s.Lights) > 0 && s.lightSampler != nil {
+		var lightContrib RGB
+		for i := 0; i < samples; i++ {
+			light, pmf := s.lightSampler.Sample(point, normal, rnd.Float64())
+			if light == nil || pmf == 0 {
+				continue
+			}
+			ls := light.Sample(point, rnd)
+			cos := normal.Dot(ls.Direction)
+			if ls.Pdf == 0 || cos <= 0 || ls.Radiance == (RGB{}) {
+				continue
+			}
+			tMax := ls.Distance * (1 - RayEpsilon)
+			if math.IsInf(ls.Distance, 1) {
+				tMax = math.MaxFloat64
+			}
+			if !s.KDTree.Intersects(Ray{Origin: point, Direction: ls.Direction}, RayEpsilon, tMax, &intersections) {
+				lightContrib = lightContrib.Add(ls.Radiance.MultiplyScalar(cos / (ls.Pdf * pmf)))
+			}
+		}
+		contrib = contrib.Add(lightContrib.DivScalar(float64(samples)))
+	}
+	if s.Background != nil {
+		var backgroundContrib RGB
+		for i := 0; i < samples; i++ {
+			direction, radiance, pdf := s.Background.Sample(rnd)
+			cos := normal.Dot(direction)
+			if pdf == 0 || cos <= 0 {
+				continue
+			}
+			if !s.KDTree.Intersects(Ray{Origin: point, Direction: direction}, RayEpsilon, math.MaxFloat64, &intersections) {
+				backgroundContrib = backgroundContrib.Add(radiance.MultiplyScalar(cos / pdf))
+			}
+		}
+		contrib = contrib.Add(backgroundContrib.DivScalar(float64(samples)))
+	}
+	return contrib.DivScalar(math.Pi)
 }
 
 func (w *Scene) Count() int {
 	return len(w.objects)
 }
+
+// hashValue writes v to h. binary.Write only fails for values it can't
+// encode, which would otherwise drop out of the hash without a trace.
+func hashValue(h hash.Hash64, v interface{}) {
+	if err := binary.Write(h, binary.LittleEndian, v); err != nil {
+		panic(fmt.Sprintf("cannot hash %T: %v", v, err))
+	}
+}
+
+// Hash identifies the scene contents and the camera looking at them, so that
+// renders of different scenes are never mixed together.
+func (s *Scene) Hash(cam *Camera) uint64 {
+	h := fnv.New64a()
+	hashValue(h, [...]Vector{cam.origin, cam.lowerLeft, cam.horizontal, cam.vertical})
+	hashValue(h, cam.lensRadius)
+	for _, o := range s.objects {
+		hashHittable(h, o)
+	}
+	for _, l := range s.Lights {
+		fmt.Fprintf(h, "%T", l)
+		switch l := l.(type) {
+		case *PointLight:
+			hashValue(h, *l)
+		case *SpotLight:
+			hashValue(h, *l)
+		case *DirectionalLight:
+			hashValue(h, [...]Vector{l.Direction})
+			hashValue(h, l.Irradiance)
+		case *AreaLight:
+			hashValue(h, l.Emission)
+			hashValue(h, l.TwoSided)
+		}
+	}
+	switch b := s.Background.(type) {
+	case *EnvironmentLight:
+		hashValue(h, [...]float64{float64(b.W), float64(b.H), b.Rotation, b.Intensity})
+		hashValue(h, b.Pixels)
+	case *Sky:
+		hashValue(h, [...]float64{b.Sun.X, b.Sun.Y, b.Sun.Z, b.Turbidity, b.Intensity})
+	}
+	return h.Sum64()
+}
+
+func hashHittable(h hash.Hash64, o Hittable) {
+	fmt.Fprintf(h, "%T", o)
+	hashValue(h, o.BoundingBox())
+	hashValue(h, o.MidPoint())
+	if m := o.Material(); m != nil {
+		hashMaterial(h, m)
+	}
+	switch o := o.(type) {
+	case *Sphere:
+		hashValue(h, o.Center)
+		hashValue(h, o.Radius)
+	case *Quad:
+		hashValue(h, [...]Vector{o.Corner, o.U, o.V})
+	case *Disc:
+		hashValue(h, [...]Vector{o.Center, o.Normal})
+		hashValue(h, o.Radius)
+	case *Triangle:
+		hashValue(h, [...]Vector{o.V1, o.V2, o.V3, o.N1, o.N2, o.N3, o.T1, o.T2, o.T3})
+	case *Plane:
+		hashValue(h, [...]Vector{o.Point, o.Normal})
+	case *Cuboid:
+		hashValue(h, [...]Vector{o.Corner, o.U, o.V, o.W})
+	case *Cylinder:
+		hashValue(h, [...]Vector{o.Base, o.Axis})
+		hashValue(h, o.Radius)
+	case *Cone:
+		hashValue(h, [...]Vector{o.Base, o.Axis})
+		hashValue(h, o.Radius)
+	case *Torus:
+		hashValue(h, [...]Vector{o.Center, o.Axis})
+		hashValue(h, [...]float64{o.MajorRadius, o.MinorRadius})
+	case *SDF:
+		fmt.Fprintf(h, "%q", o.Key)
+	case *CSG:
+		hashValue(h, int64(o.Operation))
+		hashHittable(h, o.A)
+		hashHittable(h, o.B)
+	case *Mesh:
+		hashValue(h, o.Positions)
+		hashValue(h, o.Normals)
+		hashValue(h, o.UVs)
+		hashValue(h, o.Colors)
+		hashValue(h, o.Indices)
+		// materials are mostly shared, so hash each once and then their order
+		ids := make(map[*Material]uint32)
+		order := make([]uint32, len(o.Materials))
+		for i, m := range o.Materials {
+			id, ok := ids[m]
+			if !ok {
+				id = uint32(len(ids))
+				ids[m] = id
+				hashMaterial(h, m)
+			}
+			order[i] = id
+		}
+		hashValue(h, order)
+	}
+}
+
+func hashMaterial(h hash.Hash64, m *Material) {
+	hashValue(h, [...]RGB{m.Col, m.Emission})
+	hashValue(h, [...]float64{m.Index, m.Reflectivity, m.Transparency, m.Gloss, m.Emittance, m.Tint})
+	hashValue(h, m.TwoSided)
+	hashValue(h, [...]float64{m.CauchyB, m.CauchyC})
+	hashValue(h, m.Sellmeier)
+	if m.Textures != nil {
+		m.Textures.Hash(h)
+	}
+}
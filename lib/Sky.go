@@ -0,0 +1,188 @@
+package lib
+
+import (
+	"math"
+	"math/rand"
+)
+
+const SunRadius = .00465 // angular radius of the sun in radians
+
+// GroundAlbedo is the reflectance of the diffuse ground below the horizon.
+const GroundAlbedo = .2
+
+// Sky is the analytic daylight model of Preetham, Shirley and Smits ("A
+// Practical Analytic Model for Daylight") together with a sun disk attenuated
+// by the same atmosphere. Radiance is in kcd/m^2 scaled by Intensity. Below the
+// horizon is a diffuse ground lit by the sky and sun.
+type Sky struct {
+	Sun       Vector // direction towards the sun
+	Turbidity float64
+	Intensity float64
+
+	perezY, perezX, perezY2 [5]float64
+	zenith                  [3]float64 // Y, x, y
+	sunRadiance             RGB
+	ground                  RGB
+	cosSunRadius            float64
+	table                   *EnvironmentLight
+	pSun                    float64
+}
+
+// NewSky places the sun at the given elevation above the horizon and azimuth
+// from +x towards +z, both in radians.
+func NewSky(elevation, azimuth, turbidity, intensity float64) *Sky {
+	s := &Sky{
+		Sun:          Vector{math.Cos(elevation) * math.Cos(azimuth), math.Sin(elevation), math.Cos(elevation) * math.Sin(azimuth)},
+		Turbidity:    turbidity,
+		Intensity:    intensity,
+		cosSunRadius: math.Cos(SunRadius),
+	}
+	t := turbidity
+	s.perezY = [5]float64{.1787*t - 1.4630, -.3554*t + .4275, -.0227*t + 5.3251, .1206*t - 2.5771, -.0670*t + .3703}
+	s.perezX = [5]float64{-.0193*t - .2592, -.0665*t + .0008, -.0004*t + .2125, -.0641*t - .8989, -.0033*t + .0452}
+	s.perezY2 = [5]float64{-.0167*t - .2608, -.0950*t + .0092, -.0079*t + .2102, -.0441*t - 1.6537, -.0109*t + .0529}
+
+	thetaS := math.Acos(math.Min(1, math.Max(0, s.Sun.Y)))
+	theta2 := thetaS * thetaS
+	theta3 := theta2 * thetaS
+	chi := (4.0/9 - t/120) * (math.Pi - 2*thetaS)
+	s.zenith[0] = (4.0453*t-4.9710)*math.Tan(chi) - .2155*t + 2.4192
+	s.zenith[1] = t*t*(.00166*theta3-.00375*theta2+.00209*thetaS) +
+		t*(-.02903*theta3+.06377*theta2-.03202*thetaS+.00394) +
+		(.11693*theta3 - .21196*theta2 + .06052*thetaS + .25886)
+	s.zenith[2] = t*t*(.00275*theta3-.00610*theta2+.00317*thetaS) +
+		t*(-.04214*theta3+.08970*theta2-.04153*thetaS+.00516) +
+		(.15346*theta3 - .26756*theta2 + .06670*thetaS + .26688)
+	// thetaS stops at the horizon, so a set sun has to be put out
+	set := s.Sun.Y < -math.Sin(SunRadius)
+	if !set {
+		s.sunRadiance = sunRadiance(thetaS, t)
+	}
+
+	// the light reflected by the ground, from the irradiance of the sky
+	// over the upper hemisphere and of the sun
+	var irradiance RGB
+	n, m := 32, 64
+	dTheta, dPhi := math.Pi/2/float64(n), 2*math.Pi/float64(m)
+	for y := 0; y < n; y++ {
+		theta := (float64(y) + .5) * dTheta
+		for x := 0; x < m; x++ {
+			phi := (float64(x) + .5) * dPhi
+			d := Vector{math.Sin(theta) * math.Cos(phi), math.Cos(theta), math.Sin(theta) * math.Sin(phi)}
+			irradiance = irradiance.Add(s.skyRadiance(d).MultiplyScalar(math.Cos(theta) * math.Sin(theta) * dTheta * dPhi))
+		}
+	}
+	sunSolidAngle := 2 * math.Pi * (1 - s.cosSunRadius)
+	irradiance = irradiance.Add(s.sunRadiance.MultiplyScalar(sunSolidAngle * math.Max(0, s.Sun.Y)))
+	s.ground = irradiance.MultiplyScalar(GroundAlbedo / math.Pi)
+
+	// tabulate the sky without the sun for importance sampling
+	w, h := 128, 64
+	pixels := make([]RGB, w*h)
+	for y := 0; y < h; y++ {
+		theta := math.Pi * (float64(y) + .5) / float64(h)
+		for x := 0; x < w; x++ {
+			phi := 2 * math.Pi * (float64(x) + .5) / float64(w)
+			d := Vector{math.Sin(theta) * math.Cos(phi), math.Cos(theta), math.Sin(theta) * math.Sin(phi)}
+			pixels[y*w+x] = s.skyRadiance(d)
+		}
+	}
+	s.table = NewEnvironmentLight(w, h, pixels, 0, 1)
+
+	// pick the sun in proportion to the power it contributes, but never
+	// neglect either part entirely
+	sunPower := s.sunRadiance.Luminance() * sunSolidAngle
+	skyPower := s.table.dist.marginal.Integral * 2 * math.Pi * math.Pi
+	s.pSun = .5
+	if sunPower+skyPower > 0 {
+		s.pSun = math.Max(.1, math.Min(.9, sunPower/(sunPower+skyPower)))
+	}
+	if set {
+		s.pSun = 0
+	}
+	return s
+}
+
+func (s *Sky) perez(c [5]float64, cosTheta, gamma float64) float64 {
+	cosGamma := math.Cos(gamma)
+	return (1 + c[0]*math.Exp(c[1]/cosTheta)) * (1 + c[2]*math.Exp(c[3]*gamma) + c[4]*cosGamma*cosGamma)
+}
+
+func (s *Sky) skyRadiance(direction Vector) RGB {
+	d := direction.Normalize()
+	if d.Y < 0 {
+		return s.ground
+	}
+	cosTheta := math.Max(d.Y, .01)
+	gamma := math.Acos(math.Max(-1, math.Min(1, d.Dot(s.Sun))))
+	thetaS := math.Acos(math.Min(1, math.Max(0, s.Sun.Y)))
+
+	Y := s.zenith[0] * s.perez(s.perezY, cosTheta, gamma) / s.perez(s.perezY, 1, thetaS)
+	x := s.zenith[1] * s.perez(s.perezX, cosTheta, gamma) / s.perez(s.perezX, 1, thetaS)
+	y := s.zenith[2] * s.perez(s.perezY2, cosTheta, gamma) / s.perez(s.perezY2, 1, thetaS)
+	if Y <= 0 || y <= 0 {
+		return RGB{}
+	}
+	c := XYZToRGB(x/y*Y, Y, (1-x-y)/y*Y)
+	return RGB{math.Max(0, c.R), math.Max(0, c.G), math.Max(0, c.B)}
+}
+
+// Radiance adds the sun disk to the sky above the horizon. The ground hides
+// the part of a setting sun below it.
+func (s *Sky) Radiance(direction Vector) RGB {
+	c := s.skyRadiance(direction)
+	if d := direction.Normalize(); d.Y >= 0 && d.Dot(s.Sun) >= s.cosSunRadius {
+		c = c.Add(s.sunRadiance)
+	}
+	return c.MultiplyScalar(s.Intensity)
+}
+
+func (s *Sky) Sample(rnd *rand.Rand) (Vector, RGB, float64) {
+	var d Vector
+	if rnd.Float64() < s.pSun {
+		d = UniformCone(s.Sun, s.cosSunRadius, rnd.Float64(), rnd.Float64())
+	} else {
+		var pdf float64
+		d, _, pdf = s.table.Sample(rnd)
+		if pdf == 0 {
+			return Vector{}, RGB{}, 0
+		}
+	}
+	return d, s.Radiance(d), s.Pdf(d)
+}
+
+func (s *Sky) Pdf(direction Vector) float64 {
+	pdf := (1 - s.pSun) * s.table.Pdf(direction)
+	if direction.Normalize().Dot(s.Sun) >= s.cosSunRadius {
+		pdf += s.pSun / (2 * math.Pi * (1 - s.cosSunRadius))
+	}
+	return pdf
+}
+
+// sunRadiance attenuates the extraterrestrial sun by Rayleigh and aerosol
+// scattering along the optical path (Preetham et al., appendix A.2), sampled
+// at representative wavelengths for red, green and blue.
+func sunRadiance(thetaS, turbidity float64) RGB {
+	if thetaS > math.Pi/2 {
+		return RGB{}
+	}
+	const luminance = 1.6e6 // kcd/m^2 at the top of the atmosphere
+	beta := .04608*turbidity - .04586
+	deg := thetaS * 180 / math.Pi
+	m := 1 / (math.Cos(thetaS) + .15*math.Pow(93.885-deg, -1.253)) // relative optical mass
+	tau := func(lambda float64) float64 {
+		rayleigh := math.Exp(-m * .008735 * math.Pow(lambda, -4.08))
+		aerosol := math.Exp(-m * beta * math.Pow(lambda, -1.3))
+		return rayleigh * aerosol
+	}
+	return RGB{tau(.680), tau(.550), tau(.440)}.MultiplyScalar(luminance)
+}
+
+// XYZToRGB converts CIE XYZ to linear sRGB.
+func XYZToRGB(x, y, z float64) RGB {
+	return RGB{
+		3.2404542*x - 1.5371385*y - .4985314*z,
+		-.9692660*x + 1.8760108*y + .0415560*z,
+		.0556434*x - .2040259*y + 1.0572252*z,
+	}
+}
@@ -0,0 +1,39 @@
+package lib
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSkyBelowHorizon(t *testing.T) {
+	tests := []struct {
+		name      string
+		elevation float64
+	}{
+		{"set", -.2},
+		{"just set", -2 * SunRadius},
+		{"setting", -SunRadius / 2},
+	}
+	for _, test := range tests {
+		s := NewSky(test.elevation, 0, 3, 1)
+		ground := s.Radiance(Vector{0, -1, 0})
+		for _, d := range []Vector{s.Sun, s.Sun.Add(Vector{0, -SunRadius / 2, 0})} {
+			if d.Y >= 0 {
+				continue
+			}
+			if c := s.Radiance(d); c != ground {
+				t.Errorf("%s: radiance %v towards the sun below the horizon, ground %v", test.name, c, ground)
+			}
+		}
+		if ground.MaxComponent() > 10 || !finite(ground) {
+			t.Errorf("%s: ground %v", test.name, ground)
+		}
+	}
+
+	// while the sun is up, it is much brighter than the ground
+	s := NewSky(.3, 0, 3, 1)
+	sun, ground := s.Radiance(s.Sun), s.Radiance(Vector{0, -1, 0})
+	if sun.Luminance() < 1000*ground.Luminance() || math.IsNaN(sun.Luminance()) {
+		t.Errorf("sun %v, ground %v", sun, ground)
+	}
+}
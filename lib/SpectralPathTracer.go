@@ -0,0 +1,43 @@
+package lib
+
+// SpectralPathTracer traces the same paths as PathTracer, but carries
+// radiance at a few sampled wavelengths instead of in RGB, so that materials
+// with dispersion split white light into its colours.
+type SpectralPathTracer struct {
+	PathTracer
+}
+
+type spectralEstimate struct {
+	lambda  Wavelengths
+	L, beta Spectrum
+}
+
+func (e *spectralEstimate) add(light RGB) {
+	e.L = e.L.Add(e.beta.Multiply(e.lambda.Reflectance(light)))
+}
+
+func (e *spectralEstimate) scale(weight RGB) {
+	e.beta = e.beta.Multiply(e.lambda.Reflectance(weight))
+}
+
+func (e *spectralEstimate) divide(f float64) {
+	e.beta = e.beta.DivScalar(f)
+}
+
+func (e *spectralEstimate) maxThroughput() float64 {
+	return e.beta.MaxComponent()
+}
+
+// refracted keeps only the hero wavelength once a dispersive material has
+// bent the others along different paths.
+func (e *spectralEstimate) refracted(m *Material) {
+	if m.Dispersive() {
+		e.lambda.TerminateSecondary()
+	}
+}
+
+func (p *SpectralPathTracer) Li(r Ray, ctx *SampleContext) RGB {
+	e := &spectralEstimate{lambda: SampleWavelengths(ctx.Rand.Float64()), beta: Spectrum{1, 1, 1, 1}}
+	p.trace(r, ctx, e, e.lambda.Lambda[0])
+	return e.lambda.RGB(e.L)
+}
@@ -0,0 +1,212 @@
+package lib
+
+import (
+	"math"
+)
+
+// Spectral rendering works on four wavelengths per path (Wilkie et al., "Hero
+// Wavelength Spectral Sampling"): one picked at random and three more spread
+// evenly over the visible range from it. RGB colours are turned into spectra
+// with Smits' method and the radiance found at the wavelengths is turned back
+// into RGB through CIE XYZ.
+
+const (
+	MinWavelength = 360.0 // nanometres
+	MaxWavelength = 830.0
+)
+
+const WavelengthSamples = 4
+
+// Spectrum holds values at the wavelengths of a Wavelengths.
+type Spectrum [WavelengthSamples]float64
+
+func (s Spectrum) Add(o Spectrum) Spectrum {
+	for i := range s {
+		s[i] += o[i]
+	}
+	return s
+}
+
+func (s Spectrum) Multiply(o Spectrum) Spectrum {
+	for i := range s {
+		s[i] *= o[i]
+	}
+	return s
+}
+
+func (s Spectrum) MultiplyScalar(f float64) Spectrum {
+	for i := range s {
+		s[i] *= f
+	}
+	return s
+}
+
+func (s Spectrum) DivScalar(f float64) Spectrum {
+	return s.MultiplyScalar(1 / f)
+}
+
+func (s Spectrum) MaxComponent() float64 {
+	m := s[0]
+	for _, v := range s[1:] {
+		m = math.Max(m, v)
+	}
+	return m
+}
+
+type Wavelengths struct {
+	Lambda Spectrum // nanometres
+	Pdf    Spectrum
+}
+
+// SampleWavelengths picks the wavelengths of a path for u in [0, 1).
+func SampleWavelengths(u float64) Wavelengths {
+	var w Wavelengths
+	span := MaxWavelength - MinWavelength
+	for i := range w.Lambda {
+		w.Lambda[i] = MinWavelength + math.Mod(u*span+float64(i)*span/WavelengthSamples, span)
+		w.Pdf[i] = 1 / span
+	}
+	return w
+}
+
+// TerminateSecondary leaves only the first wavelength, once the path has been
+// refracted by a dispersive material and no longer holds for the others.
+func (w *Wavelengths) TerminateSecondary() {
+	if w.Pdf[1] == 0 {
+		return
+	}
+	for i := 1; i < len(w.Pdf); i++ {
+		w.Pdf[i] = 0
+	}
+	w.Pdf[0] /= WavelengthSamples
+}
+
+// Reflectance is the spectrum of an RGB reflectance at the wavelengths.
+// Lights are turned into spectra the same way; the white balance in RGB keeps
+// white lights white.
+func (w *Wavelengths) Reflectance(c RGB) Spectrum {
+	var s Spectrum
+	for i, l := range w.Lambda {
+		s[i] = smits(c, l)
+	}
+	return s
+}
+
+// RGB is the colour of radiance s at the wavelengths.
+func (w *Wavelengths) RGB(s Spectrum) RGB {
+	var x, y, z float64
+	for i, l := range w.Lambda {
+		if w.Pdf[i] == 0 {
+			continue
+		}
+		v := s[i] / w.Pdf[i]
+		x += v * cieX(l)
+		y += v * cieY(l)
+		z += v * cieZ(l)
+	}
+	n := WavelengthSamples * cieYIntegral
+	return XYZToRGB(x/n, y/n, z/n).Multiply(spectralWhiteBalance)
+}
+
+// The CIE 1931 colour matching functions, as fitted by Wyman, Sloan and
+// Shirley, "Simple Analytic Approximations to the CIE XYZ Color Matching
+// Functions".
+func cieX(l float64) float64 {
+	return 1.056*lobe(l, 599.8, 37.9, 31.0) + .362*lobe(l, 442.0, 16.0, 26.7) - .065*lobe(l, 501.1, 20.4, 26.2)
+}
+
+func cieY(l float64) float64 {
+	return .821*lobe(l, 568.8, 46.9, 40.5) + .286*lobe(l, 530.9, 16.3, 31.1)
+}
+
+func cieZ(l float64) float64 {
+	return 1.217*lobe(l, 437.0, 11.8, 36.0) + .681*lobe(l, 459.0, 26.0, 13.8)
+}
+
+// lobe is a Gaussian with different widths left and right of its mean.
+func lobe(l, mean, left, right float64) float64 {
+	sigma := right
+	if l < mean {
+		sigma = left
+	}
+	t := (l - mean) / sigma
+	return math.Exp(-t * t / 2)
+}
+
+var cieYIntegral, spectralWhiteBalance = spectralConstants()
+
+// spectralConstants integrates the matching functions: the integral of Y
+// normalises spectra to unit luminance, and the colour of a flat spectrum,
+// which is not quite white in sRGB, is divided out.
+func spectralConstants() (float64, RGB) {
+	const steps = 4700
+	dl := (MaxWavelength - MinWavelength) / steps
+	var x, y, z float64
+	for i := 0; i < steps; i++ {
+		l := MinWavelength + (float64(i)+.5)*dl
+		x += cieX(l) * dl
+		y += cieY(l) * dl
+		z += cieZ(l) * dl
+	}
+	white := XYZToRGB(x/y, 1, z/y)
+	return y, RGB{1 / white.R, 1 / white.G, 1 / white.B}
+}
+
+// Smits' basis spectra ("An RGB to Spectrum Conversion for Reflectances"),
+// sampled at ten wavelengths from 380 to 720 nm.
+var (
+	smitsWhite   = [10]float64{1, 1, .9999, .9993, .9992, .9998, 1, 1, 1, 1}
+	smitsCyan    = [10]float64{.9710, .9426, 1.0007, 1.0007, 1.0007, 1.0007, .1564, 0, 0, 0}
+	smitsMagenta = [10]float64{1, 1, .9685, .2229, 0, .0458, .8369, 1, 1, .9959}
+	smitsYellow  = [10]float64{.0001, 0, .1088, .6651, 1, 1, .9996, .9586, .9685, .9840}
+	smitsRed     = [10]float64{.1012, .0515, 0, 0, 0, 0, .8325, 1.0149, 1.0149, 1.0149}
+	smitsGreen   = [10]float64{0, 0, .0273, .7937, 1, .9418, .1719, 0, 0, .0025}
+	smitsBlue    = [10]float64{1, 1, .8916, .3323, 0, 0, .0003, .0369, .0483, .0496}
+)
+
+// smits is the value of the spectrum of c at wavelength l: the white part of
+// the colour, plus the secondary and then the primary colour making up the
+// rest.
+func smits(c RGB, l float64) float64 {
+	white, secondary, primary := smitsAt(&smitsWhite, l), 0.0, 0.0
+	switch {
+	case c.R <= c.G && c.R <= c.B:
+		v := c.R * white
+		if c.G <= c.B {
+			secondary, primary = (c.G-c.R)*smitsAt(&smitsCyan, l), (c.B-c.G)*smitsAt(&smitsBlue, l)
+		} else {
+			secondary, primary = (c.B-c.R)*smitsAt(&smitsCyan, l), (c.G-c.B)*smitsAt(&smitsGreen, l)
+		}
+		return v + secondary + primary
+	case c.G <= c.R && c.G <= c.B:
+		v := c.G * white
+		if c.R <= c.B {
+			secondary, primary = (c.R-c.G)*smitsAt(&smitsMagenta, l), (c.B-c.R)*smitsAt(&smitsBlue, l)
+		} else {
+			secondary, primary = (c.B-c.G)*smitsAt(&smitsMagenta, l), (c.R-c.B)*smitsAt(&smitsRed, l)
+		}
+		return v + secondary + primary
+	}
+	v := c.B * white
+	if c.R <= c.G {
+		secondary, primary = (c.R-c.B)*smitsAt(&smitsYellow, l), (c.G-c.R)*smitsAt(&smitsGreen, l)
+	} else {
+		secondary, primary = (c.G-c.B)*smitsAt(&smitsYellow, l), (c.R-c.G)*smitsAt(&smitsRed, l)
+	}
+	return v + secondary + primary
+}
+
+// smitsAt interpolates a basis spectrum linearly, holding its end values
+// beyond the sampled range.
+func smitsAt(basis *[10]float64, l float64) float64 {
+	x := (l - 380) / (720 - 380) * 9
+	if x <= 0 {
+		return basis[0]
+	}
+	if x >= 9 {
+		return basis[9]
+	}
+	i := int(x)
+	f := x - float64(i)
+	return basis[i]*(1-f) + basis[i+1]*f
+}
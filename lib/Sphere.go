@@ -20,6 +20,51 @@ func (s *Sphere) RandomPoint(rnd *rand.Rand, point Vector) Vector {
 	return hem.MultiplyScalar(s.Radius).Add(s.Center)
 }
 
+func (s *Sphere) SurfaceArea() float64 {
+	return 4 * math.Pi * s.Radius * s.Radius
+}
+
+func (s *Sphere) SamplePoint(rnd *rand.Rand) (Vector, Vector) {
+	z := 1 - 2*rnd.Float64()
+	r := math.Sqrt(math.Max(0, 1-z*z))
+	phi := 2 * math.Pi * rnd.Float64()
+	n := Vector{r * math.Cos(phi), r * math.Sin(phi), z}
+	return s.Center.Add(n.MultiplyScalar(s.Radius)), n
+}
+
+// SampleFrom samples the cone of directions the sphere subtends from p, which
+// wastes no samples on the far side of the sphere.
+func (s *Sphere) SampleFrom(p Vector, rnd *rand.Rand) (Vector, Vector, float64) {
+	d2 := p.Subtract(s.Center).SquaredLength()
+	if d2 <= s.Radius*s.Radius {
+		return sampleByArea(s, p, rnd)
+	}
+	axis := s.Center.Subtract(p).Normalize()
+	cosMax := math.Sqrt(math.Max(0, 1-s.Radius*s.Radius/d2))
+	direction := UniformCone(axis, cosMax, rnd.Float64(), rnd.Float64())
+	pdf := 1 / (2 * math.Pi * (1 - cosMax))
+	ok, hit := s.Hit(Ray{p, direction}, 0, math.Inf(1))
+	if !ok {
+		// grazing the silhouette
+		t := direction.Dot(s.Center.Subtract(p))
+		q := p.Add(direction.MultiplyScalar(t))
+		return q, q.Subtract(s.Center).Normalize(), pdf
+	}
+	return hit.Point, hit.Normal, pdf
+}
+
+func (s *Sphere) PdfFrom(p, direction Vector) float64 {
+	d2 := p.Subtract(s.Center).SquaredLength()
+	if d2 <= s.Radius*s.Radius {
+		return pdfByArea(s, p, direction)
+	}
+	cosMax := math.Sqrt(math.Max(0, 1-s.Radius*s.Radius/d2))
+	if direction.Normalize().Dot(s.Center.Subtract(p).Normalize()) < cosMax {
+		return 0
+	}
+	return 1 / (2 * math.Pi * (1 - cosMax))
+}
+
 func (s *Sphere) Hit(r Ray, tMin float64, tMax float64) (bool, Hit) {
 	centerToRay := r.Origin.Subtract(s.Center)
 	a := r.Direction.SquaredLength()
@@ -37,6 +82,7 @@ func (s *Sphere) Hit(r Ray, tMin float64, tMax float64) (bool, Hit) {
 			hit.T = temp
 			hit.Point = r.Step(temp)
 			hit.Normal = hit.Point.Subtract(s.Center).DivideScalar(s.Radius)
+			hit.UV = sphereUV(hit.Normal)
 			return true, hit
 		}
 		temp = (-b + sqrtDiscrim) / a
@@ -44,11 +90,23 @@ func (s *Sphere) Hit(r Ray, tMin float64, tMax float64) (bool, Hit) {
 			hit.T = temp
 			hit.Point = r.Step(temp)
 			hit.Normal = hit.Point.Subtract(s.Center).DivideScalar(s.Radius)
+			hit.UV = sphereUV(hit.Normal)
 			return true, hit
 		}
 	}
 	return false, Hit{}
 }
+
+// sphereUV maps a unit normal to its longitude around the vertical axis as U
+// and its latitude from the bottom as V.
+func sphereUV(n Vector) Vector {
+	u := math.Atan2(n.Z, n.X) / (2 * math.Pi)
+	if u < 0 {
+		u++
+	}
+	return Vector{u, math.Acos(math.Max(-1, math.Min(1, -n.Y))) / math.Pi, 0}
+}
+
 func (s *Sphere) BoundingBox() Box {
 	rad := Vector{s.Radius, s.Radius, s.Radius}
 	return Box{s.Center.Subtract(rad), s.Center.Add(rad)}
@@ -57,3 +115,7 @@ func (s *Sphere) BoundingBox() Box {
 func (s *Sphere) MidPoint() Vector {
 	return s.Center
 }
+
+func (s *Sphere) Crossings(r Ray) []Hit {
+	return convexCrossings(s, r)
+}
@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"hash"
+	"image"
+	"math"
+)
+
+// Texture is an image in linear RGB, looked up by texture coordinates that
+// repeat outside [0, 1], with (0, 0) at the bottom left as in OBJ files.
+type Texture struct {
+	W, H   int
+	Pixels []RGB // the top row first
+}
+
+// NewTexture copies an image, undoing the sRGB gamma of colour images.
+func NewTexture(img image.Image, colour bool) *Texture {
+	b := img.Bounds()
+	t := &Texture{W: b.Dx(), H: b.Dy(), Pixels: make([]RGB, 0, b.Dx()*b.Dy())}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			c := RGB{float64(r), float64(g), float64(bl)}.DivScalar(0xffff)
+			if colour {
+				c = c.Pow(2.2)
+			}
+			t.Pixels = append(t.Pixels, c)
+		}
+	}
+	return t
+}
+
+func (t *Texture) texel(x, y int) RGB {
+	x, y = x%t.W, y%t.H
+	if x < 0 {
+		x += t.W
+	}
+	if y < 0 {
+		y += t.H
+	}
+	return t.Pixels[y*t.W+x]
+}
+
+// At interpolates bilinearly between the four texels around uv.
+func (t *Texture) At(uv Vector) RGB {
+	if t.W == 0 || t.H == 0 {
+		return RGB{}
+	}
+	x := uv.X*float64(t.W) - .5
+	y := (1-uv.Y)*float64(t.H) - .5
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := x-x0, y-y0
+	// texture coordinates far out of range don't fit an int
+	ix, iy := int(math.Mod(x0, float64(t.W))), int(math.Mod(y0, float64(t.H)))
+	top := t.texel(ix, iy).Mix(t.texel(ix+1, iy), fx)
+	bottom := t.texel(ix, iy+1).Mix(t.texel(ix+1, iy+1), fx)
+	return top.Mix(bottom, fy)
+}
+
+// Average is the mean of all texels.
+func (t *Texture) Average() RGB {
+	var sum RGB
+	for _, c := range t.Pixels {
+		sum = sum.Add(c)
+	}
+	return sum.DivScalar(float64(len(t.Pixels)))
+}
+
+func (t *Texture) hash(h hash.Hash64) {
+	hashValue(h, [...]int64{int64(t.W), int64(t.H)})
+	hashValue(h, t.Pixels)
+}
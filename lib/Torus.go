@@ -0,0 +1,245 @@
+package lib
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Torus is the ring around Center in the plane facing along Axis, whose tube
+// has MinorRadius and runs at MajorRadius from the center.
+type Torus struct {
+	Center, Axis             Vector
+	MajorRadius, MinorRadius float64
+	Mat                      *Material
+}
+
+func (tr *Torus) Material() *Material {
+	return tr.Mat
+}
+
+// frame gives the basis of the torus, with y along its axis.
+func (tr *Torus) frame() (x, y, z Vector) {
+	y = tr.Axis.Normalize()
+	x, z = y.Basis()
+	return
+}
+
+// roots solves the quartic of the torus for the line of r, giving the sorted
+// values of t where it crosses the surface. It starts from where the line
+// enters the bounding sphere, to keep the coefficients small.
+func (tr *Torus) roots(r Ray) []float64 {
+	x, y, z := tr.frame()
+	length := r.Direction.Length()
+	d := r.Direction.DivideScalar(length)
+	o := r.Origin.Subtract(tr.Center)
+
+	// the bounding sphere
+	bound := tr.MajorRadius + tr.MinorRadius
+	b := o.Dot(d)
+	disc := b*b - o.SquaredLength() + bound*bound
+	if disc <= 0 {
+		return nil
+	}
+	start := -b - math.Sqrt(disc)
+	o = o.Add(d.MultiplyScalar(start))
+
+	o = Vector{o.Dot(x), o.Dot(y), o.Dot(z)}
+	d = Vector{d.Dot(x), d.Dot(y), d.Dot(z)}
+	R2, r2 := tr.MajorRadius*tr.MajorRadius, tr.MinorRadius*tr.MinorRadius
+	e := o.SquaredLength() + R2 - r2
+	f := o.Dot(d)
+	dxz := d.X*d.X + d.Z*d.Z
+	oxz := o.X*d.X + o.Z*d.Z
+	c3 := 4 * f
+	c2 := 4*f*f + 2*e - 4*R2*dxz
+	c1 := 4*f*e - 8*R2*oxz
+	c0 := e*e - 4*R2*(o.X*o.X+o.Z*o.Z)
+
+	ts := solveQuartic(c3, c2, c1, c0)
+	for i, t := range ts {
+		// polish the root, which loses precision in the solution
+		for j := 0; j < 2; j++ {
+			p := (((t+c3)*t+c2)*t+c1)*t + c0
+			dp := ((4*t+3*c3)*t+2*c2)*t + c1
+			if dp == 0 {
+				break
+			}
+			t -= p / dp
+		}
+		ts[i] = (start + t) / length
+	}
+	sort.Float64s(ts)
+	return ts
+}
+
+// Hit gives the angles around the axis and around the tube as UV, scaled to
+// [0, 1].
+func (tr *Torus) Hit(r Ray, tMin, tMax float64) (bool, Hit) {
+	for _, t := range tr.roots(r) {
+		if t > tMin && t < tMax {
+			return true, tr.hitAt(r, t)
+		}
+	}
+	return false, Hit{}
+}
+
+// Crossings pairs up the roots, which come in twos as the line enters and
+// leaves the tube.
+func (tr *Torus) Crossings(r Ray) []Hit {
+	ts := tr.roots(r)
+	if len(ts)%2 != 0 {
+		// grazing the surface
+		return nil
+	}
+	hits := make([]Hit, len(ts))
+	for i, t := range ts {
+		hits[i] = tr.hitAt(r, t)
+	}
+	return hits
+}
+
+func (tr *Torus) hitAt(r Ray, t float64) Hit {
+	x, y, z := tr.frame()
+	p := r.Step(t)
+	q := p.Subtract(tr.Center)
+	q = Vector{q.Dot(x), q.Dot(y), q.Dot(z)}
+	ring := math.Hypot(q.X, q.Z)
+	var core Vector
+	if ring > 0 {
+		core = Vector{q.X, 0, q.Z}.MultiplyScalar(tr.MajorRadius / ring)
+	}
+	n := q.Subtract(core).Normalize()
+	u := math.Atan2(q.Z, q.X) / (2 * math.Pi)
+	v := math.Atan2(q.Y, ring-tr.MajorRadius) / (2 * math.Pi)
+	if u < 0 {
+		u++
+	}
+	if v < 0 {
+		v++
+	}
+	normal := x.MultiplyScalar(n.X).Add(y.MultiplyScalar(n.Y)).Add(z.MultiplyScalar(n.Z))
+	return Hit{T: t, Point: p, Normal: normal, UV: Vector{u, v, 0}, Ray: r, Material: tr.Mat}
+}
+
+func (tr *Torus) BoundingBox() Box {
+	e := circleExtent(tr.Axis.Normalize(), tr.MajorRadius).AddScalar(tr.MinorRadius)
+	return Box{tr.Center.Subtract(e), tr.Center.Add(e)}
+}
+
+func (tr *Torus) MidPoint() Vector {
+	return tr.Center
+}
+
+func (tr *Torus) RandomPoint(rnd *rand.Rand, point Vector) Vector {
+	p, _ := tr.SamplePoint(rnd)
+	return p
+}
+
+func (tr *Torus) SurfaceArea() float64 {
+	return 4 * math.Pi * math.Pi * tr.MajorRadius * tr.MinorRadius
+}
+
+func (tr *Torus) SamplePoint(rnd *rand.Rand) (Vector, Vector) {
+	x, y, z := tr.frame()
+	// the outside of the tube is larger than the inside, so pick the angle
+	// around it by rejection
+	var theta float64
+	for {
+		theta = 2 * math.Pi * rnd.Float64()
+		if rnd.Float64()*(tr.MajorRadius+tr.MinorRadius) < tr.MajorRadius+tr.MinorRadius*math.Cos(theta) {
+			break
+		}
+	}
+	phi := 2 * math.Pi * rnd.Float64()
+	radial := x.MultiplyScalar(math.Cos(phi)).Add(z.MultiplyScalar(math.Sin(phi)))
+	n := radial.MultiplyScalar(math.Cos(theta)).Add(y.MultiplyScalar(math.Sin(theta)))
+	return tr.Center.Add(radial.MultiplyScalar(tr.MajorRadius)).Add(n.MultiplyScalar(tr.MinorRadius)), n
+}
+
+func (tr *Torus) SampleFrom(p Vector, rnd *rand.Rand) (Vector, Vector, float64) {
+	return sampleByArea(tr, p, rnd)
+}
+
+func (tr *Torus) PdfFrom(p, direction Vector) float64 {
+	return pdfByArea(tr, p, direction)
+}
+
+// solveQuartic gives the real roots of t⁴ + a t³ + b t² + c t + d by
+// Ferrari's method.
+func solveQuartic(a, b, c, d float64) []float64 {
+	// substitute t = y - a/4 to drop the cubic term
+	shift := a / 4
+	p := b - 6*shift*shift
+	q := c - 2*b*shift + 8*shift*shift*shift
+	r := d - c*shift + b*shift*shift - 3*shift*shift*shift*shift
+
+	var ys []float64
+	if math.Abs(q) < 1e-12 {
+		// biquadratic
+		for _, z := range solveQuadratic(p, r) {
+			if z >= 0 {
+				ys = append(ys, math.Sqrt(z), -math.Sqrt(z))
+			}
+		}
+	} else {
+		// split into two quadratics with a positive root m of the resolvent
+		// cubic
+		m := largestCubicRoot(p, p*p/4-r, -q*q/8)
+		if m <= 0 {
+			return nil
+		}
+		s := math.Sqrt(2 * m)
+		ys = append(solveQuadratic(-s, p/2+m+q/(2*s)), solveQuadratic(s, p/2+m-q/(2*s))...)
+	}
+	for i := range ys {
+		ys[i] -= shift
+	}
+	return ys
+}
+
+// solveQuadratic gives the real roots of t² + b t + c.
+func solveQuadratic(b, c float64) []float64 {
+	disc := b*b - 4*c
+	if disc < 0 {
+		return nil
+	}
+	// avoid cancellation between -b and the square root
+	sq := math.Sqrt(disc)
+	q := -(b + math.Copysign(sq, b)) / 2
+	if q == 0 {
+		return []float64{0, 0}
+	}
+	return []float64{q, c / q}
+}
+
+// largestCubicRoot gives the largest real root of t³ + a t² + b t + c.
+func largestCubicRoot(a, b, c float64) float64 {
+	Q := (a*a - 3*b) / 9
+	R := (2*a*a*a - 9*a*b + 27*c) / 54
+	var t float64
+	if R*R < Q*Q*Q {
+		theta := math.Acos(R / math.Sqrt(Q*Q*Q))
+		t = -2*math.Sqrt(Q)*math.Cos(theta/3) - a/3
+		for _, k := range []float64{1, -1} {
+			t = math.Max(t, -2*math.Sqrt(Q)*math.Cos((theta+k*2*math.Pi)/3)-a/3)
+		}
+	} else {
+		A := -math.Copysign(math.Cbrt(math.Abs(R)+math.Sqrt(R*R-Q*Q*Q)), R)
+		B := 0.0
+		if A != 0 {
+			B = Q / A
+		}
+		t = A + B - a/3
+	}
+	// polish
+	for i := 0; i < 2; i++ {
+		f := ((t+a)*t+b)*t + c
+		df := (3*t+2*a)*t + b
+		if df == 0 {
+			break
+		}
+		t -= f / df
+	}
+	return t
+}
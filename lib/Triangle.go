@@ -28,18 +28,50 @@ func NewTriangle(v1, v2, v3, n1, n2, n3 Vector, mat *Material) *Triangle {
 }
 
 func (tri *Triangle) RandomPoint(rnd *rand.Rand, point Vector) Vector {
+	return randomPointIn(tri.V1, tri.V2, tri.V3, rnd)
+}
+
+// randomPointIn picks a point uniformly in the triangle abc.
+func randomPointIn(a, b, c Vector, rnd *rand.Rand) Vector {
 	sum := math.Sqrt(rnd.Float64()) // takes varying line length s+t = sum into account
 	t := rnd.Float64() * sum
 	s := sum - t
 	r := 1.0 - s - t
 
-	return tri.V1.MultiplyScalar(r).Add(tri.V2.MultiplyScalar(s)).Add(tri.V3.MultiplyScalar(t))
+	return a.MultiplyScalar(r).Add(b.MultiplyScalar(s)).Add(c.MultiplyScalar(t))
+}
+
+func (t *Triangle) SamplePoint(rnd *rand.Rand) (Vector, Vector) {
+	return t.RandomPoint(rnd, Vector{}), t.GeometricNormal()
+}
+
+func (t *Triangle) SampleFrom(p Vector, rnd *rand.Rand) (Vector, Vector, float64) {
+	return sampleByArea(t, p, rnd)
+}
+
+func (t *Triangle) PdfFrom(p, direction Vector) float64 {
+	return pdfByArea(t, p, direction)
+}
+
+func (t *Triangle) SurfaceArea() float64 {
+	return t.Area
+}
+
+// GeometricNormal is the normal of the triangle's plane, on the same side as
+// its shading normals.
+func (t *Triangle) GeometricNormal() Vector {
+	n := t.V2.Subtract(t.V1).Cross(t.V3.Subtract(t.V1)).Normalize()
+	if n.Dot(t.Normal()) < 0 {
+		return n.MultiplyScalar(-1)
+	}
+	return n
 }
 
 func (t *Triangle) ScaleAndTranslate(scale float64, translate Vector) {
 	t.V1 = t.V1.MultiplyScalar(scale).Add(translate)
 	t.V2 = t.V2.MultiplyScalar(scale).Add(translate)
 	t.V3 = t.V3.MultiplyScalar(scale).Add(translate)
+	t.Area *= scale * scale
 }
 
 func (t *Triangle) Material() *Material {
@@ -76,10 +108,17 @@ func (t *Triangle) Hit(r Ray, tMin, tMax float64) (bool, Hit) {
 		return false, Hit{}
 	}
 	d := (e2x*qx + e2y*qy + e2z*qz) * inv
-	if d < tMin {
+	if d < tMin || d > tMax {
 		return false, Hit{}
 	}
-	return true, Hit{T: d, Normal: t.Normal(), Material: t.Material(), Point: r.Step(d), Ray: r}
+	uv := interpolate(t.T1, t.T2, t.T3, u, v)
+	return true, Hit{T: d, Normal: t.Normal(), UV: uv, Material: t.Material(), Point: r.Step(d), Ray: r}
+}
+
+// interpolate weighs the values at the corners of a triangle by the
+// barycentric coordinates u and v of the second and third corner.
+func interpolate(a, b, c Vector, u, v float64) Vector {
+	return a.MultiplyScalar(1 - u - v).Add(b.MultiplyScalar(u)).Add(c.MultiplyScalar(v))
 }
 func (t *Triangle) Normal() Vector {
 	return (t.N1.Add(t.N2).Add(t.N3)).DivideScalar(3)
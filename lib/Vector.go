@@ -20,6 +20,46 @@ func VectorInUnitSphere(rnd *rand.Rand) Vector {
 		}
 	}
 }
+
+// UniformCone returns a direction within the cone around axis whose half
+// angle has the given cosine.
+func UniformCone(axis Vector, cosMax, u, v float64) Vector {
+	cosTheta := 1 - u*(1-cosMax)
+	sinTheta := math.Sqrt(math.Max(0, 1-cosTheta*cosTheta))
+	phi := 2 * math.Pi * v
+	s, t := axis.Basis()
+	return s.MultiplyScalar(sinTheta * math.Cos(phi)).Add(t.MultiplyScalar(sinTheta * math.Sin(phi))).Add(axis.MultiplyScalar(cosTheta))
+}
+
+// CosineHemisphere returns a direction in the hemisphere around the unit
+// vector n with density cos(theta)/pi.
+func CosineHemisphere(n Vector, u, v float64) Vector {
+	r := math.Sqrt(u)
+	phi := 2 * math.Pi * v
+	s, t := n.Basis()
+	return s.MultiplyScalar(r * math.Cos(phi)).Add(t.MultiplyScalar(r * math.Sin(phi))).Add(n.MultiplyScalar(math.Sqrt(math.Max(0, 1-u))))
+}
+
+// UniformDisc returns a point in the unit disc around the origin in the xy
+// plane.
+func UniformDisc(u, v float64) (float64, float64) {
+	r := math.Sqrt(u)
+	phi := 2 * math.Pi * v
+	return r * math.Cos(phi), r * math.Sin(phi)
+}
+
+// Basis returns two unit vectors that together with the unit vector v form an
+// orthonormal basis.
+func (v Vector) Basis() (Vector, Vector) {
+	var s Vector
+	if math.Abs(v.X) > math.Abs(v.Y) {
+		s = Vector{-v.Z, 0, v.X}.Normalize()
+	} else {
+		s = Vector{0, v.Z, -v.Y}.Normalize()
+	}
+	return s, v.Cross(s)
+}
+
 func (v Vector) Get(a Axis) float64 {
 	switch a {
 	case AxisX:
@@ -94,6 +134,11 @@ func (v Vector) Max(v2 Vector) Vector {
 	return Vector{math.Max(v.X, v2.X), math.Max(v.Y, v2.Y), math.Max(v.Z, v2.Z)}
 }
 
+func (v Vector) RotateY(angle float64) Vector {
+	sin, cos := math.Sincos(angle)
+	return Vector{v.X*cos + v.Z*sin, v.Y, -v.X*sin + v.Z*cos}
+}
+
 func (v Vector) Reflect(ov Vector) Vector {
 	b := 2 * v.Dot(ov)
 	return v.Subtract(ov.MultiplyScalar(b))
@@ -7,6 +7,7 @@ import (
 )
 
 const EPS = 1e-9
+const RayEpsilon = .001 // offset of secondary rays from the surface they leave
 
 func WritePng(filename string, img image.Image) (err error) {
 	file, err := os.Create(filename)